@@ -0,0 +1,214 @@
+package client
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	ErrBreakerOpen    = errors.New("熔断器已经打开，服务暂时不可用")
+	ErrBreakerTimeout = errors.New("熔断器调用超时")
+)
+
+// 熔断器的状态
+type breakerState int
+
+const (
+	breakerClosed   breakerState = iota // 关闭，请求正常通过
+	breakerOpen                         // 打开，请求直接拒绝
+	breakerHalfOpen                     // 半开，放行少量请求探测服务是否恢复
+)
+
+// 决定熔断器什么时候打开
+type tripper interface {
+	onSuccess()
+	onFailure() bool // 返回true表示需要打开熔断器
+	reset()
+}
+
+// 熔断器的通用状态机
+// 关闭状态下由tripper决定是否打开；打开cooldown之后进入半开状态，放行probes个探测请求
+// 探测成功则关闭，失败则重新打开
+type circuitBreaker struct {
+	mu       sync.Mutex
+	state    breakerState
+	openedAt time.Time     // 打开的时间
+	cooldown time.Duration // 打开多久之后进入半开状态
+	probes   int           // 半开状态允许放行的探测请求数
+	probing  int           // 半开状态已经放行的探测请求数
+	tripper  tripper
+}
+
+func newCircuitBreaker(cooldown time.Duration, tripper tripper) *circuitBreaker {
+	return &circuitBreaker{
+		cooldown: cooldown,
+		probes:   1,
+		tripper:  tripper,
+	}
+}
+
+// 执行函数，熔断器打开时直接返回ErrBreakerOpen，超时或者出错都算作失败
+func (cb *circuitBreaker) Call(fn func() error, timeout time.Duration) error {
+	if !cb.Ready() {
+		return ErrBreakerOpen
+	}
+
+	var err error
+	if timeout <= 0 {
+		err = fn()
+	} else {
+		done := make(chan error, 1)
+		go func() {
+			done <- fn()
+		}()
+
+		timer := time.NewTimer(timeout)
+		select {
+		case err = <-done:
+			timer.Stop()
+		case <-timer.C:
+			err = ErrBreakerTimeout
+		}
+	}
+
+	if err != nil {
+		cb.Fail()
+	} else {
+		cb.Success()
+	}
+	return err
+}
+
+// 记录一次失败
+func (cb *circuitBreaker) Fail() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	switch cb.state {
+	case breakerHalfOpen: // 探测失败，重新打开
+		cb.open()
+	case breakerClosed:
+		if cb.tripper.onFailure() {
+			cb.open()
+		}
+	}
+}
+
+// 记录一次成功
+func (cb *circuitBreaker) Success() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	switch cb.state {
+	case breakerHalfOpen: // 探测成功，服务恢复了
+		cb.state = breakerClosed
+		cb.tripper.reset()
+	case breakerClosed:
+		cb.tripper.onSuccess()
+	}
+}
+
+// 是否允许请求通过（半开状态下每次返回true都会占用一个探测名额）
+func (cb *circuitBreaker) Ready() bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if cb.state == breakerOpen {
+		if time.Since(cb.openedAt) < cb.cooldown {
+			return false
+		}
+		cb.state = breakerHalfOpen
+		cb.openedAt = time.Now() // 半开状态开始的时间
+		cb.probing = 0
+	}
+
+	if cb.state == breakerHalfOpen {
+		if cb.probing >= cb.probes {
+			if time.Since(cb.openedAt) < cb.cooldown {
+				return false
+			}
+			// 探测请求一直没有结果（可能调用方没有上报），重新放行
+			cb.openedAt = time.Now()
+			cb.probing = 0
+		}
+		cb.probing++
+	}
+	return true
+}
+
+func (cb *circuitBreaker) open() {
+	cb.state = breakerOpen
+	cb.openedAt = time.Now()
+	cb.tripper.reset()
+}
+
+// 连续失败次数达到阈值就打开
+type consecTripper struct {
+	failureThreshold int
+	failures         int
+}
+
+func (t *consecTripper) onSuccess() {
+	t.failures = 0
+}
+
+func (t *consecTripper) onFailure() bool {
+	t.failures++
+	return t.failures >= t.failureThreshold
+}
+
+func (t *consecTripper) reset() {
+	t.failures = 0
+}
+
+// 连续失败failureThreshold次之后打开，cooldown之后放行一个探测请求
+func NewConsecCircuitBreaker(failureThreshold int, cooldown time.Duration) Breaker {
+	return newCircuitBreaker(cooldown, &consecTripper{failureThreshold: failureThreshold})
+}
+
+// 统计窗口内的错误率达到阈值就打开
+type errorRateTripper struct {
+	rate        float64       // 错误率阈值
+	minRequests int           // 窗口内请求数太少时不打开，防止偶发的错误造成误判
+	window      time.Duration // 统计窗口
+	windowStart time.Time
+	total       int
+	failures    int
+}
+
+func (t *errorRateTripper) roll() {
+	if time.Since(t.windowStart) >= t.window {
+		t.windowStart = time.Now()
+		t.total = 0
+		t.failures = 0
+	}
+}
+
+func (t *errorRateTripper) onSuccess() {
+	t.roll()
+	t.total++
+}
+
+func (t *errorRateTripper) onFailure() bool {
+	t.roll()
+	t.total++
+	t.failures++
+	return t.total >= t.minRequests && float64(t.failures)/float64(t.total) >= t.rate
+}
+
+func (t *errorRateTripper) reset() {
+	t.windowStart = time.Now()
+	t.total = 0
+	t.failures = 0
+}
+
+// window时间内请求数不少于minRequests且错误率达到rate之后打开，cooldown之后放行一个探测请求
+func NewErrorRateCircuitBreaker(rate float64, minRequests int, window, cooldown time.Duration) Breaker {
+	return newCircuitBreaker(cooldown, &errorRateTripper{
+		rate:        rate,
+		minRequests: minRequests,
+		window:      window,
+		windowStart: time.Now(),
+	})
+}
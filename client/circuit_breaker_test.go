@@ -0,0 +1,121 @@
+package client
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// 连续失败达到阈值才打开，中间有一次成功就重新计数
+func TestConsecBreakerOpensAfterFailures(t *testing.T) {
+	cb := NewConsecCircuitBreaker(3, time.Minute)
+
+	cb.Fail()
+	cb.Fail()
+	cb.Success()
+	cb.Fail()
+	cb.Fail()
+	if !cb.Ready() {
+		t.Fatal("没有连续失败3次，熔断器不应该打开")
+	}
+
+	cb.Fail()
+	if cb.Ready() {
+		t.Fatal("连续失败3次之后熔断器应该打开")
+	}
+	called := false
+	if err := cb.Call(func() error { called = true; return nil }, 0); err != ErrBreakerOpen || called {
+		t.Fatalf("熔断器打开时应该直接返回ErrBreakerOpen，实际为%v，函数被调用: %v", err, called)
+	}
+}
+
+// 窗口内的请求数达到下限并且错误率达到阈值才打开
+func TestErrorRateBreakerOpens(t *testing.T) {
+	cb := NewErrorRateCircuitBreaker(0.5, 4, time.Minute, time.Minute)
+
+	cb.Fail()
+	cb.Fail()
+	cb.Success()
+	if !cb.Ready() {
+		t.Fatal("请求数没有达到下限，熔断器不应该打开")
+	}
+
+	cb.Fail() // 4次请求3次失败
+	if cb.Ready() {
+		t.Fatal("错误率达到阈值之后熔断器应该打开")
+	}
+}
+
+// 超时和出错都算作失败
+func TestBreakerCallCountsTimeoutAsFailure(t *testing.T) {
+	cb := NewConsecCircuitBreaker(2, time.Minute)
+
+	if err := cb.Call(func() error { time.Sleep(50 * time.Millisecond); return nil }, 10*time.Millisecond); err != ErrBreakerTimeout {
+		t.Fatalf("调用超时应该返回ErrBreakerTimeout，实际为%v", err)
+	}
+	if err := cb.Call(func() error { return errors.New("失败") }, 0); err == nil {
+		t.Fatal("函数的错误应该原样返回")
+	}
+	if cb.Ready() {
+		t.Fatal("超时和出错各一次之后熔断器应该打开")
+	}
+}
+
+// 打开的熔断器cooldown之后进入半开状态，只放行一个探测请求
+func TestBreakerHalfOpenSingleProbe(t *testing.T) {
+	cooldown := 20 * time.Millisecond
+	cb := NewConsecCircuitBreaker(1, cooldown)
+
+	cb.Fail()
+	if cb.Ready() {
+		t.Fatal("cooldown之前熔断器应该保持打开")
+	}
+
+	time.Sleep(cooldown + 10*time.Millisecond)
+	if !cb.Ready() {
+		t.Fatal("cooldown之后应该放行一个探测请求")
+	}
+	if cb.Ready() {
+		t.Fatal("探测请求还没有结果时不应该再放行其他请求")
+	}
+}
+
+// 探测成功关闭熔断器
+func TestBreakerProbeSuccessCloses(t *testing.T) {
+	cooldown := 20 * time.Millisecond
+	cb := NewConsecCircuitBreaker(1, cooldown)
+
+	cb.Fail()
+	time.Sleep(cooldown + 10*time.Millisecond)
+	if !cb.Ready() {
+		t.Fatal("cooldown之后应该放行一个探测请求")
+	}
+	cb.Success()
+
+	for i := 0; i < 3; i++ {
+		if !cb.Ready() {
+			t.Fatal("探测成功之后熔断器应该关闭，请求都可以通过")
+		}
+	}
+}
+
+// 探测失败重新打开熔断器，再等一个cooldown才会放行下一个探测请求
+func TestBreakerProbeFailureReopens(t *testing.T) {
+	cooldown := 20 * time.Millisecond
+	cb := NewConsecCircuitBreaker(1, cooldown)
+
+	cb.Fail()
+	time.Sleep(cooldown + 10*time.Millisecond)
+	if !cb.Ready() {
+		t.Fatal("cooldown之后应该放行一个探测请求")
+	}
+	cb.Fail()
+	if cb.Ready() {
+		t.Fatal("探测失败之后熔断器应该重新打开")
+	}
+
+	time.Sleep(cooldown + 10*time.Millisecond)
+	if !cb.Ready() {
+		t.Fatal("重新打开cooldown之后应该再放行一个探测请求")
+	}
+}
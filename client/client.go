@@ -1,12 +1,51 @@
 package client
 
 import (
+	"avrilko-rpc/log"
 	"avrilko-rpc/protocol"
+	"avrilko-rpc/share"
+	"bufio"
 	"context"
 	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+const (
+	ReadBuffSize = 16 * 1024 // 读取消息时候缓冲区大小
+)
+
+var (
+	ErrShutdown         = errors.New("客户端已经关闭")
+	ErrUnsupportedCodec = errors.New("不支持的序列化方式")
+	ErrHeartbeatTimeout = errors.New("心跳检测超时，连接已经断开")
+)
+
+// 服务端返回的错误（服务端处理失败时会放在meta中返回）
+type ServiceError string
+
+func (e ServiceError) Error() string {
+	return string(e)
+}
+
+// 客户端默认配置
+var DefaultOption = Option{
+	Retries:             3,
+	ConnectTimeout:      10 * time.Second,
+	SerializeType:       protocol.MsgPack,
+	CompressType:        protocol.None,
+	BackupLatency:       10 * time.Millisecond,
+	MaxMissedHeartbeats: 3,
+	GenBreaker: func() Breaker {
+		return NewConsecCircuitBreaker(5, 30*time.Second)
+	},
+}
+
 type Call struct {
 	ServicePath   string
 	ServiceMethod string
@@ -17,6 +56,16 @@ type Call struct {
 	Error         error             // 调用完成之后的错误
 	Done          chan *Call        // 调用完整之后会讲数据塞到此通道中
 	Raw           bool              // 是否发送原始数据
+	seq           uint64            // 请求的序号
+}
+
+// 调用完成，通知调用方（通道满了直接丢弃，不能阻塞读协程）
+func (call *Call) done() {
+	select {
+	case call.Done <- call:
+	default:
+		log.Debug("rpc: Done通道容量不足，丢弃本次调用结果")
+	}
 }
 
 // 熔断器接口
@@ -68,4 +117,552 @@ type Option struct {
 	Heartbeat bool // 是否启用心跳检测
 
 	HeartbeatInterval time.Duration // 心跳检测的间隔时间
+
+	MaxMissedHeartbeats int // 连续多少次心跳没有响应就认为连接已经断开（小于1按1处理）
+
+	FileTransferServiceName string // 服务端文件传输服务的服务名（EnableFileTransfer时使用的名字），为空使用share.SendFileServiceName
+}
+
+// RPCClient 默认实现，一个Client对应一条连接，连接上的请求通过seq多路复用
+type Client struct {
+	option Option // 客户端选项
+
+	Conn net.Conn      // 底层连接
+	r    *bufio.Reader // 读取缓冲区
+
+	mutex    sync.Mutex       // 保护下面的字段
+	seq      uint64           // 下一个请求的序号
+	pending  map[uint64]*Call // 等待响应的请求
+	closing  bool             // 用户主动关闭
+	shutdown bool             // 连接出错或者被服务端关闭
+
+	sending sync.Mutex // 保证同一时间只有一个协程在写conn
+
+	lastRead    int64                   // 最后一次收到服务端数据的时间（UnixNano），有数据说明连接是通的，不需要发心跳
+	onBroken    func()                  // 心跳检测判定连接断开之后调用（XClient用来移除缓存的客户端）
+	onHeartbeat func(rtt time.Duration) // 收到心跳响应之后调用，rtt为心跳的往返时间
+
+	Plugins PluginContainer // 插件容器
+
+	serverMessageChan chan<- *protocol.Message // 服务端主动推送的消息通道
+}
+
+// 新建一个客户端（需要调用Connect之后才能使用）
+func NewClient(option Option) *Client {
+	return &Client{
+		option:  option,
+		pending: make(map[uint64]*Call),
+	}
+}
+
+// 注册消息通道，服务端主动推送的消息会塞到此通道中（通道满了会丢弃消息）
+func (c *Client) RegisterServerMessageChan(ch chan<- *protocol.Message) {
+	c.mutex.Lock()
+	c.serverMessageChan = ch
+	c.mutex.Unlock()
+}
+
+// 卸载消息通道
+func (c *Client) UnregisterServerMessageChan() {
+	c.mutex.Lock()
+	c.serverMessageChan = nil
+	c.mutex.Unlock()
+}
+
+// 是否正在关闭
+func (c *Client) IsClosing() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.closing
+}
+
+// 是否已经关闭
+func (c *Client) IsShutDown() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.shutdown
+}
+
+// 异步调用，调用完成后会将call塞到done通道中
+func (c *Client) Go(ctx context.Context, servicePath, serviceMethod string, request, response interface{}, done chan *Call) *Call {
+	call := new(Call)
+	call.ServicePath = servicePath
+	call.ServiceMethod = serviceMethod
+	if meta := ctx.Value(share.ReqMetaDataKey); meta != nil { // 将上下文中的元数据带到服务端
+		call.Metadata = meta.(map[string]string)
+	}
+	call.request = request
+	call.response = response
+
+	if done == nil {
+		done = make(chan *Call, 10)
+	} else if cap(done) == 0 { // 无缓冲的通道会阻塞读协程
+		log.Panic("rpc: done通道必须是有缓冲的")
+	}
+	call.Done = done
+
+	c.send(ctx, call)
+	return call
+}
+
+// 同步调用
+func (c *Client) Call(ctx context.Context, servicePath, serviceMethod string, request, response interface{}) error {
+	call := c.Go(ctx, servicePath, serviceMethod, request, response, make(chan *Call, 1))
+
+	var err error
+	select {
+	case <-ctx.Done(): // 调用方已经不等了，把请求从pending中移除并通知服务端取消
+		c.mutex.Lock()
+		pending := c.pending[call.seq] == call
+		if pending {
+			delete(c.pending, call.seq)
+		}
+		c.mutex.Unlock()
+		if pending {
+			c.sendCancel(call.seq)
+		}
+		err = ctx.Err()
+	case call = <-call.Done:
+		err = call.Error
+		if meta := ctx.Value(share.ResMetaDataKey); meta != nil && len(call.ResMetadata) > 0 {
+			resMeta := meta.(map[string]string)
+			for k, v := range call.ResMetadata {
+				resMeta[k] = v
+			}
+		}
+	}
+
+	return err
+}
+
+// 发送原始数据，返回服务端的元数据和payload
+func (c *Client) SendRaw(ctx context.Context, r *protocol.Message) (map[string]string, []byte, error) {
+	call := new(Call)
+	call.ServicePath = r.ServicePath
+	call.ServiceMethod = r.ServiceMethod
+	call.Metadata = r.Metadata
+	call.Raw = true
+	call.Done = make(chan *Call, 1)
+
+	meta, err := metadataWithTimeout(ctx, r.Metadata)
+	if err != nil {
+		return nil, nil, err
+	}
+	r.Metadata = meta
+
+	seq, err := c.register(call)
+	if err != nil {
+		return nil, nil, err
+	}
+	r.SetSeq(seq)
+
+	if c.Plugins != nil {
+		if err = c.Plugins.DoClientBeforeEncode(r); err != nil {
+			c.removeCall(seq)
+			return nil, nil, err
+		}
+	}
+
+	data := r.EncodeSlicePointer()
+	err = c.write(*data)
+	protocol.PutData(data)
+	if err != nil {
+		c.removeCall(seq)
+		return nil, nil, err
+	}
+
+	if r.IsOneway() { // 不需要等服务端返回
+		c.removeCall(seq)
+		return nil, nil, nil
+	}
+
+	select {
+	case <-ctx.Done():
+		if c.removeCall(seq) != nil {
+			c.sendCancel(seq)
+		}
+		return nil, nil, ctx.Err()
+	case call = <-call.Done:
+		payload, _ := call.response.([]byte)
+		return call.ResMetadata, payload, call.Error
+	}
+}
+
+// 关闭客户端，所有等待中的请求都会返回ErrShutdown
+func (c *Client) Close() error {
+	c.mutex.Lock()
+	for seq, call := range c.pending {
+		delete(c.pending, seq)
+		if call != nil {
+			call.Error = ErrShutdown
+			call.done()
+		}
+	}
+
+	if c.closing || c.shutdown {
+		c.mutex.Unlock()
+		return ErrShutdown
+	}
+	c.closing = true
+	c.mutex.Unlock()
+
+	if c.Conn == nil {
+		return nil
+	}
+	return c.Conn.Close()
+}
+
+// 打包请求并写入conn
+func (c *Client) send(ctx context.Context, call *Call) {
+	codec := share.Codecs[c.option.SerializeType]
+	if codec == nil {
+		call.Error = ErrUnsupportedCodec
+		call.done()
+		return
+	}
+
+	seq, err := c.register(call)
+	if err != nil {
+		call.Error = err
+		call.done()
+		return
+	}
+
+	request := protocol.GetPooledMsg()
+	request.SetMessageType(protocol.Request)
+	request.SetSeq(seq)
+	request.SetSerializeType(c.option.SerializeType)
+	request.ServicePath = call.ServicePath
+	request.ServiceMethod = call.ServiceMethod
+	if call.response == nil { // 不需要返回值的当作单向请求，服务端不会回复
+		request.SetOneway(true)
+	}
+	request.Metadata, err = metadataWithTimeout(ctx, call.Metadata)
+	if err != nil { // 已经超时了没有必要再发
+		c.removeCall(seq)
+		protocol.FreeMsg(request)
+		call.Error = err
+		call.done()
+		return
+	}
+
+	data, err := codec.Encode(call.request)
+	if err == nil && c.Plugins != nil {
+		err = c.Plugins.DoClientBeforeEncode(request)
+	}
+	if err != nil {
+		c.removeCall(seq)
+		protocol.FreeMsg(request)
+		call.Error = err
+		call.done()
+		return
+	}
+	if len(data) > 1024 && c.option.CompressType != protocol.None { // 数据太小压缩意义不大
+		request.SetCompressType(c.option.CompressType)
+	}
+	request.Payload = data
+
+	allData := request.EncodeSlicePointer()
+	err = c.write(*allData)
+	protocol.PutData(allData)
+	protocol.FreeMsg(request)
+	if err != nil {
+		if c.removeCall(seq) != nil {
+			call.Error = err
+			call.done()
+		}
+		return
+	}
+
+	if call.response == nil { // 单向请求写完就结束
+		if c.removeCall(seq) != nil {
+			call.done()
+		}
+	}
+}
+
+// ctx设置了截止时间时，把剩余的超时时间放到元数据中带给服务端（复制一份，不修改调用方的map）
+func metadataWithTimeout(ctx context.Context, meta map[string]string) (map[string]string, error) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return meta, nil
+	}
+
+	timeout := time.Until(deadline)
+	if timeout <= 0 {
+		return meta, context.DeadlineExceeded
+	}
+
+	m := make(map[string]string, len(meta)+1)
+	for k, v := range meta {
+		m[k] = v
+	}
+	m[share.TimeoutKey] = strconv.FormatInt(int64(timeout), 10)
+	return m, nil
+}
+
+// 通知服务端取消seq对应的请求（尽力而为，发送失败就算了）
+func (c *Client) sendCancel(seq uint64) {
+	if c.IsShutDown() || c.IsClosing() {
+		return
+	}
+
+	request := protocol.GetPooledMsg()
+	request.SetMessageType(protocol.Request)
+	request.SetCancel(true)
+	request.SetOneway(true)
+	request.SetSeq(seq)
+
+	data := request.EncodeSlicePointer()
+	c.write(*data)
+	protocol.PutData(data)
+	protocol.FreeMsg(request)
+}
+
+// 分配序号并将请求放到pending中等待响应
+func (c *Client) register(call *Call) (uint64, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.shutdown || c.closing {
+		return 0, ErrShutdown
+	}
+
+	seq := c.seq
+	c.seq++
+	c.pending[seq] = call
+	call.seq = seq
+	return seq, nil
+}
+
+// 从pending中移除请求，返回被移除的请求（可能已经被读协程处理了，此时返回nil）
+func (c *Client) removeCall(seq uint64) *Call {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	call := c.pending[seq]
+	delete(c.pending, seq)
+	return call
+}
+
+// 写入数据（conn不是并发安全的，需要加锁保证一个请求的数据不会被拆开）
+func (c *Client) write(data []byte) error {
+	c.sending.Lock()
+	defer c.sending.Unlock()
+	if c.option.WriteTimeout != 0 {
+		c.Conn.SetWriteDeadline(time.Now().Add(c.option.WriteTimeout))
+	}
+	_, err := c.Conn.Write(data)
+	return err
+}
+
+// 读协程，将服务端的响应按seq交给对应的请求
+func (c *Client) input() {
+	var err error
+	for err == nil {
+		response := protocol.GetPooledMsg()
+		if c.option.ReadTimeout != 0 {
+			c.Conn.SetReadDeadline(time.Now().Add(c.option.ReadTimeout))
+		}
+
+		err = response.Decode(c.r)
+		if err != nil {
+			protocol.FreeMsg(response)
+			break
+		}
+		atomic.StoreInt64(&c.lastRead, time.Now().UnixNano())
+
+		if response.MessageType() == protocol.Request { // 服务端主动推送的消息
+			c.handleServerRequest(response)
+			continue
+		}
+
+		call := c.removeCall(response.Seq())
+		if call != nil { // 为nil说明调用方已经超时不等了
+			if c.Plugins != nil && !response.IsHeartbeat() {
+				call.Error = c.Plugins.DoClientAfterDecode(response)
+			}
+			if call.Error == nil {
+				c.handleResponse(call, response)
+			}
+			call.done()
+		}
+		protocol.FreeMsg(response)
+	}
+
+	// 连接出错了，结束所有等待中的请求
+	c.mutex.Lock()
+	broken := c.shutdown // 已经被心跳检测判定为断开
+	c.shutdown = true
+	closing := c.closing
+	if err == io.EOF {
+		if closing {
+			err = ErrShutdown
+		} else {
+			err = io.ErrUnexpectedEOF
+		}
+	}
+	for seq, call := range c.pending {
+		delete(c.pending, seq)
+		call.Error = err
+		call.done()
+	}
+	c.mutex.Unlock()
+
+	if !closing && !broken && err != io.ErrUnexpectedEOF {
+		log.WarnF("rpc客户端读取数据失败，连接%s将被关闭，错误原因%v", c.Conn.RemoteAddr(), err)
+	}
+	c.Conn.Close()
+
+	if c.Plugins != nil {
+		c.Plugins.DoClientConnectClose(c.Conn)
+	}
+}
+
+// 将服务端主动推送的消息交给注册的通道（不能阻塞读协程，通道满了直接丢弃）
+func (c *Client) handleServerRequest(msg *protocol.Message) {
+	c.mutex.Lock()
+	ch := c.serverMessageChan
+	c.mutex.Unlock()
+
+	if ch == nil {
+		protocol.FreeMsg(msg)
+		return
+	}
+
+	select {
+	case ch <- msg:
+	default:
+		log.WarnF("服务端推送消息的通道已满，丢弃消息%s.%s", msg.ServicePath, msg.ServiceMethod)
+		protocol.FreeMsg(msg)
+	}
+}
+
+// 将服务端的响应解码到call中
+func (c *Client) handleResponse(call *Call, response *protocol.Message) {
+	if len(response.Metadata) > 0 {
+		call.ResMetadata = response.Metadata
+	}
+
+	if response.MessageStatusType() == protocol.Error {
+		call.Error = ServiceError(response.Metadata[protocol.ServiceError])
+		if call.Raw {
+			call.response = response.Payload
+		}
+		return
+	}
+
+	if call.Raw {
+		call.response = response.Payload
+		return
+	}
+
+	if len(response.Payload) == 0 || call.response == nil {
+		return
+	}
+	codec := share.Codecs[response.SerializeType()]
+	if codec == nil {
+		call.Error = ServiceError(ErrUnsupportedCodec.Error())
+		return
+	}
+	if err := codec.Decode(response.Payload, call.response); err != nil {
+		call.Error = ServiceError(err.Error())
+	}
+}
+
+// 心跳协程，连接空闲时每隔HeartbeatInterval发送一次心跳
+// 连续MaxMissedHeartbeats次没有响应则认为连接已经断开，关闭连接让调用方重新建立
+func (c *Client) heartbeat() {
+	interval := c.option.HeartbeatInterval
+	maxMissed := c.option.MaxMissedHeartbeats
+	if maxMissed < 1 {
+		maxMissed = 1
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	missed := 0
+	for range ticker.C {
+		if c.IsClosing() || c.IsShutDown() {
+			return
+		}
+
+		// 最近一个周期内收到过数据，连接是通的
+		if time.Since(time.Unix(0, atomic.LoadInt64(&c.lastRead))) < interval {
+			missed = 0
+			continue
+		}
+
+		start := time.Now()
+		if err := c.sendHeartbeat(interval); err != nil {
+			if err == ErrShutdown {
+				return
+			}
+			missed++
+			log.DebugF("rpc客户端心跳检测失败%d次，连接%s，错误原因%v", missed, c.Conn.RemoteAddr(), err)
+			if missed >= maxMissed {
+				log.WarnF("rpc客户端连续%d次心跳没有响应，连接%s将被关闭", missed, c.Conn.RemoteAddr())
+				c.broken(ErrHeartbeatTimeout)
+				return
+			}
+			continue
+		}
+		missed = 0
+		if c.onHeartbeat != nil {
+			c.onHeartbeat(time.Since(start))
+		}
+	}
+}
+
+// 发送一次心跳并等待服务端原样返回
+func (c *Client) sendHeartbeat(timeout time.Duration) error {
+	call := &Call{Raw: true, Done: make(chan *Call, 1)}
+	seq, err := c.register(call)
+	if err != nil {
+		return err
+	}
+
+	request := protocol.GetPooledMsg()
+	request.SetMessageType(protocol.Request)
+	request.SetHeartbeat(true)
+	request.SetSeq(seq)
+	request.SetSerializeType(c.option.SerializeType)
+	data := request.EncodeSlicePointer()
+	err = c.write(*data)
+	protocol.PutData(data)
+	protocol.FreeMsg(request)
+	if err != nil {
+		c.removeCall(seq)
+		return err
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		c.removeCall(seq)
+		return ErrHeartbeatTimeout
+	case call = <-call.Done:
+		return call.Error
+	}
+}
+
+// 连接已经不可用，结束所有等待中的请求并关闭连接
+func (c *Client) broken(err error) {
+	c.mutex.Lock()
+	if c.closing || c.shutdown {
+		c.mutex.Unlock()
+		return
+	}
+	c.shutdown = true
+	for seq, call := range c.pending {
+		delete(c.pending, seq)
+		call.Error = err
+		call.done()
+	}
+	c.mutex.Unlock()
+
+	c.Conn.Close()
+	if c.onBroken != nil {
+		c.onBroken()
+	}
 }
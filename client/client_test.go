@@ -0,0 +1,208 @@
+package client
+
+import (
+	"avrilko-rpc/protocol"
+	"avrilko-rpc/server"
+	"avrilko-rpc/share"
+	"context"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// 连接到addr的客户端（不开启心跳）
+func newTestClient(t *testing.T, addr string) *Client {
+	t.Helper()
+	option := DefaultOption
+	option.Heartbeat = false
+	c := NewClient(option)
+	if err := c.Connect("tcp", addr); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestClientCall(t *testing.T) {
+	c := newTestClient(t, startArithServer(t))
+
+	reply := &ArithReply{}
+	if err := c.Call(context.Background(), "Arith", "Mul", &ArithArgs{A: 7, B: 8}, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.C != 56 {
+		t.Fatalf("返回结果不正确: %d", reply.C)
+	}
+
+	if err := c.Call(context.Background(), "Arith", "NotExist", &ArithArgs{}, &ArithReply{}); err == nil {
+		t.Fatal("调用不存在的方法应该返回错误")
+	} else if _, ok := err.(ServiceError); !ok {
+		t.Fatalf("服务端的错误应该是ServiceError，实际为%T: %v", err, err)
+	}
+}
+
+// 同一个连接上并发的多个请求按seq拿到各自的结果
+func TestClientGo(t *testing.T) {
+	c := newTestClient(t, startArithServer(t))
+
+	n := 10
+	done := make(chan *Call, n)
+	replies := make([]*ArithReply, n)
+	for i := 0; i < n; i++ {
+		replies[i] = &ArithReply{}
+		c.Go(context.Background(), "Arith", "Mul", &ArithArgs{A: i, B: 10}, replies[i], done)
+	}
+
+	for i := 0; i < n; i++ {
+		select {
+		case call := <-done:
+			if call.Error != nil {
+				t.Fatal(call.Error)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("等待调用结果超时")
+		}
+	}
+	for i, reply := range replies {
+		if reply.C != i*10 {
+			t.Fatalf("第%d个请求的返回结果不正确: %d", i, reply.C)
+		}
+	}
+}
+
+// 关闭客户端时等待中的请求马上返回ErrShutdown，之后的请求也返回ErrShutdown
+func TestClientCloseFailsPendingCalls(t *testing.T) {
+	c := newTestClient(t, startArithServer(t))
+
+	call := c.Go(context.Background(), "Arith", "Slow", &ArithArgs{}, &ArithReply{}, nil)
+	time.Sleep(20 * time.Millisecond) // 等请求发出去
+	c.Close()
+
+	select {
+	case call = <-call.Done:
+		if call.Error != ErrShutdown {
+			t.Fatalf("关闭之后等待中的请求应该返回ErrShutdown，实际为%v", call.Error)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("关闭之后等待中的请求没有马上返回")
+	}
+
+	if err := c.Call(context.Background(), "Arith", "Mul", &ArithArgs{}, &ArithReply{}); err != ErrShutdown {
+		t.Fatalf("关闭之后的请求应该返回ErrShutdown，实际为%v", err)
+	}
+}
+
+// 请求元数据带到服务端，服务端返回的元数据写回ctx中的ResMetaDataKey
+func TestClientMetadata(t *testing.T) {
+	c := newTestClient(t, startArithServer(t))
+
+	resMeta := make(map[string]string)
+	ctx := context.WithValue(context.Background(), share.ReqMetaDataKey, map[string]string{"key": "value"})
+	ctx = context.WithValue(ctx, share.ResMetaDataKey, resMeta)
+	if err := c.Call(ctx, "Arith", "Meta", &ArithArgs{}, &ArithReply{}); err != nil {
+		t.Fatal(err)
+	}
+	if resMeta["key"] != "value" {
+		t.Fatalf("返回的元数据不正确: %v", resMeta)
+	}
+}
+
+// 记录服务端收到的请求是否为单向请求
+type onewayRecorder struct {
+	oneway chan bool
+}
+
+func (p *onewayRecorder) PostReadRequest(ctx context.Context, message *protocol.Message, e error) error {
+	if e == nil && !message.IsHeartbeat() {
+		p.oneway <- message.IsOneway()
+	}
+	return nil
+}
+
+// 不需要返回值的请求以单向请求发出，服务端不会回复
+func TestClientNilResponseIsOneway(t *testing.T) {
+	s := server.NewServer()
+	if err := s.RegisterName("Arith", new(Arith), ""); err != nil {
+		t.Fatal(err)
+	}
+	recorder := &onewayRecorder{oneway: make(chan bool, 2)}
+	s.Plugins.Add(recorder)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.ServeListener("tcp", ln)
+	t.Cleanup(func() { s.Close() })
+	c := newTestClient(t, ln.Addr().String())
+
+	if err := c.Call(context.Background(), "Arith", "Mul", &ArithArgs{A: 2, B: 3}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Call(context.Background(), "Arith", "Mul", &ArithArgs{A: 2, B: 3}, &ArithReply{}); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, want := range []bool{true, false} {
+		select {
+		case oneway := <-recorder.oneway:
+			if oneway != want {
+				t.Fatalf("第%d个请求的单向标记为%v，期望为%v", i+1, oneway, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("服务端没有收到请求")
+		}
+	}
+}
+
+// ctx设置了截止时间时把剩余的超时时间放到元数据中，不修改调用方的map，已经超时直接返回错误
+func TestMetadataWithTimeout(t *testing.T) {
+	meta := map[string]string{"key": "value"}
+
+	got, err := metadataWithTimeout(context.Background(), meta)
+	if err != nil || len(got) != 1 {
+		t.Fatalf("没有截止时间时不应该带超时时间: %v %v", got, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	got, err = metadataWithTimeout(ctx, meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	timeout, err := strconv.ParseInt(got[share.TimeoutKey], 10, 64)
+	if err != nil || timeout <= 0 || time.Duration(timeout) > time.Second || got["key"] != "value" {
+		t.Fatalf("元数据中的超时时间不正确: %v", got)
+	}
+	if _, ok := meta[share.TimeoutKey]; ok {
+		t.Fatal("不应该修改调用方的元数据")
+	}
+
+	expired, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	if _, err = metadataWithTimeout(expired, meta); err != context.DeadlineExceeded {
+		t.Fatalf("已经超时应该返回context.DeadlineExceeded，实际为%v", err)
+	}
+}
+
+// 超时时间带到服务端，服务端处理请求的ctx设置了同样的截止时间
+func TestClientTimeoutPropagation(t *testing.T) {
+	c := newTestClient(t, startArithServer(t))
+
+	reply := &ArithReply{}
+	if err := c.Call(context.Background(), "Arith", "Remaining", &ArithArgs{}, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.C != -1 {
+		t.Fatalf("没有设置超时时间时服务端不应该有截止时间，实际剩余%dms", reply.C)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := c.Call(ctx, "Arith", "Remaining", &ArithArgs{}, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.C <= 0 || reply.C > 1000 {
+		t.Fatalf("服务端处理请求的ctx应该在1s之内到期，实际剩余%dms", reply.C)
+	}
+}
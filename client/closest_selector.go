@@ -0,0 +1,127 @@
+package client
+
+import (
+	"context"
+	"github.com/valyala/fastrand"
+	"sync"
+	"time"
+)
+
+const (
+	latencyDecay   = 0.3         // 指数加权移动平均中新样本的权重
+	latencyPenalty = time.Second // 调用失败时按这个延迟记录，让出错的服务器排到后面
+)
+
+// 延迟观察者，负载均衡算法实现了这个接口时，每次调用完成和收到心跳响应都会上报服务器的延迟
+type LatencyObserver interface {
+	ObserveLatency(server string, rtt time.Duration, err error) // err不为空说明调用失败（连接失败、超时等）
+}
+
+// 选择延迟最低的服务器，延迟为往返时间的指数加权移动平均（EWMA）
+// p2c为true时随机挑两台服务器选延迟低的那台，避免所有请求都压到延迟最低的服务器上
+type closestSelector struct {
+	mu      sync.RWMutex
+	servers []string
+	online  map[string]bool    // 当前的服务器，下线的服务器上报的延迟直接忽略
+	latency map[string]float64 // 服务器 => 延迟的EWMA（纳秒），没有记录说明还没有测量过
+	p2c     bool
+}
+
+func newClosestSelector(servers map[string]string, p2c bool) Selector {
+	s := &closestSelector{
+		latency: make(map[string]float64),
+		p2c:     p2c,
+	}
+	s.UpdateServer(servers)
+	return s
+}
+
+func (s *closestSelector) Select(ctx context.Context, servicePath, serviceMethod string, args interface{}) string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	ss := s.servers
+	if len(ss) == 0 {
+		return ""
+	}
+
+	if s.p2c {
+		if len(ss) == 1 {
+			return ss[0]
+		}
+		i := fastrand.Uint32n(uint32(len(ss)))
+		j := fastrand.Uint32n(uint32(len(ss) - 1))
+		if j >= i { // 保证两次挑中的不是同一台
+			j++
+		}
+		if s.lessLatency(ss[j], ss[i]) {
+			return ss[j]
+		}
+		return ss[i]
+	}
+
+	// 还没有测量过的服务器优先（随机选一台），这样新加入的服务器也能测量到延迟
+	var unmeasured []string
+	best := ""
+	for _, server := range ss {
+		if _, ok := s.latency[server]; !ok {
+			unmeasured = append(unmeasured, server)
+			continue
+		}
+		if best == "" || s.lessLatency(server, best) {
+			best = server
+		}
+	}
+	if len(unmeasured) > 0 {
+		return unmeasured[fastrand.Uint32n(uint32(len(unmeasured)))]
+	}
+	return best
+}
+
+// a的延迟是否比b低（没有测量过的当作最低）
+func (s *closestSelector) lessLatency(a, b string) bool {
+	la, okA := s.latency[a]
+	lb, okB := s.latency[b]
+	if !okA || !okB {
+		return !okA && okB
+	}
+	return la < lb
+}
+
+func (s *closestSelector) UpdateServer(servers map[string]string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ss := make([]string, 0, len(servers))
+	online := make(map[string]bool, len(servers))
+	for k := range servers {
+		ss = append(ss, k)
+		online[k] = true
+	}
+	for k := range s.latency { // 下线的服务器不再保留延迟
+		if _, ok := servers[k]; !ok {
+			delete(s.latency, k)
+		}
+	}
+	s.servers = ss
+	s.online = online
+}
+
+func (s *closestSelector) ObserveLatency(server string, rtt time.Duration, err error) {
+	if err != nil && rtt < latencyPenalty {
+		rtt = latencyPenalty
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.online[server] { // 调用或者心跳结束之前服务器已经下线了，不能再把延迟加回去
+		return
+	}
+	old, ok := s.latency[server]
+	if !ok {
+		s.latency[server] = float64(rtt)
+		return
+	}
+	s.latency[server] = old*(1-latencyDecay) + float64(rtt)*latencyDecay
+}
@@ -0,0 +1,97 @@
+package client
+
+import (
+	"avrilko-rpc/log"
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+var makeConnections = make(map[string]MakeConnection)
+
+func init() {
+	makeConnections["tcp"] = newDirectConn
+	makeConnections["tcp4"] = newDirectConn
+	makeConnections["tcp6"] = newDirectConn
+	makeConnections["unix"] = newDirectConn
+}
+
+type MakeConnection func(c *Client, network, address string) (net.Conn, error)
+
+// 注册连接生成者
+func RegisterMakeConnection(network string, connection MakeConnection) {
+	makeConnections[network] = connection
+}
+
+// 连接服务端并开启读协程
+func (c *Client) Connect(network, address string) error {
+	mc, ok := makeConnections[network]
+	if !ok {
+		return errors.New("暂不支持该网络类型建立连接" + network)
+	}
+
+	conn, err := mc(c, network, address)
+	if err != nil {
+		return err
+	}
+
+	if tc, ok := conn.(*net.TCPConn); ok { // tcp连接需要设置keepAlive保证链接的稳定性能
+		tc.SetKeepAlive(true)
+		tc.SetKeepAlivePeriod(time.Minute * 5)
+	}
+
+	if c.Plugins != nil {
+		conn, err = c.Plugins.DoClientConnected(conn)
+		if err != nil {
+			if conn != nil {
+				conn.Close()
+			}
+			return err
+		}
+	}
+
+	c.Conn = conn
+	c.r = bufio.NewReaderSize(conn, ReadBuffSize)
+
+	atomic.StoreInt64(&c.lastRead, time.Now().UnixNano())
+	go c.input()
+
+	if c.option.Heartbeat && c.option.HeartbeatInterval > 0 {
+		go c.heartbeat()
+	}
+
+	return nil
+}
+
+// 直接建立连接（配置了证书则使用tls）
+func newDirectConn(c *Client, network, address string) (net.Conn, error) {
+	var conn net.Conn
+	var err error
+
+	if c.option.TLSConfig != nil {
+		dialer := &net.Dialer{Timeout: c.option.ConnectTimeout}
+		conn, err = tls.DialWithDialer(dialer, network, address, c.option.TLSConfig)
+	} else {
+		conn, err = net.DialTimeout(network, address, c.option.ConnectTimeout)
+	}
+
+	if err != nil {
+		log.WarnF("连接服务端%s失败，错误原因%v", address, err)
+		return nil, err
+	}
+
+	if c.Plugins != nil {
+		conn, err = c.Plugins.DoConnCreated(conn)
+		if err != nil {
+			if conn != nil {
+				conn.Close()
+			}
+			return nil, err
+		}
+	}
+
+	return conn, nil
+}
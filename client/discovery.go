@@ -0,0 +1,115 @@
+package client
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// 定时刷新的服务发现（文件、dns）没有指定间隔时间时使用的默认值
+const DefaultDiscoveryInterval = 30 * time.Second
+
+// 服务发现的通用部分：保存服务器列表，维护监听通道和过滤器，列表变动时推送给所有监听者
+type discoveryWatchers struct {
+	mu     sync.RWMutex
+	all    []*KVPair              // 过滤之前的服务器列表
+	pairs  []*KVPair              // 过滤之后的服务器列表
+	filter ServiceDiscoveryFilter // 过滤器
+	chans  []chan []*KVPair       // 监听变动的通道
+}
+
+func (d *discoveryWatchers) GetServices() []*KVPair {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.pairs
+}
+
+func (d *discoveryWatchers) WatchService() chan []*KVPair {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	ch := make(chan []*KVPair, 10)
+	d.chans = append(d.chans, ch)
+	return ch
+}
+
+func (d *discoveryWatchers) RemoveService(ch chan []*KVPair) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	chans := make([]chan []*KVPair, 0, len(d.chans))
+	for _, c := range d.chans {
+		if c != ch {
+			chans = append(chans, c)
+		}
+	}
+	d.chans = chans
+}
+
+func (d *discoveryWatchers) SetFilter(filter ServiceDiscoveryFilter) {
+	d.mu.Lock()
+	d.filter = filter
+	all := d.all
+	d.mu.Unlock()
+
+	d.update(all)
+}
+
+// 更新服务器列表并推送给所有监听者（列表没有变化不推送）
+func (d *discoveryWatchers) update(all []*KVPair) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	pairs := make([]*KVPair, 0, len(all))
+	for _, p := range all {
+		if d.filter == nil || d.filter(p) {
+			pairs = append(pairs, p)
+		}
+	}
+	d.all = all
+	if equalKVPairs(d.pairs, pairs) {
+		return
+	}
+	d.pairs = pairs
+
+	// 持有锁的时候推送，RemoveService之后不会再往通道中写数据
+	for _, ch := range d.chans {
+		select {
+		case ch <- pairs:
+		default: // 监听者处理不过来，丢掉最旧的一次变动，只要最新的列表送到就行
+			select {
+			case <-ch:
+			default:
+			}
+			select {
+			case ch <- pairs:
+			default:
+			}
+		}
+	}
+}
+
+// 判断两个服务器列表是否相同（不考虑顺序）
+func equalKVPairs(a, b []*KVPair) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	am := make(map[string]string, len(a))
+	for _, p := range a {
+		am[p.Key] = p.Value
+	}
+	for _, p := range b {
+		if v, ok := am[p.Key]; !ok || v != p.Value {
+			return false
+		}
+	}
+	return true
+}
+
+// 按key排序，保证每次解析出来的列表顺序一致
+func sortKVPairs(pairs []*KVPair) {
+	sort.Slice(pairs, func(i, j int) bool {
+		return pairs[i].Key < pairs[j].Key
+	})
+}
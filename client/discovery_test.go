@@ -0,0 +1,145 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDiscoveryDefaultInterval(t *testing.T) {
+	fileName := filepath.Join(tempDir(t), "servers.json")
+	if err := ioutil.WriteFile(fileName, []byte(`[{"key": "tcp@127.0.0.1:8972"}]`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fd, err := NewFileDiscovery(fileName, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fd.Close()
+	if fd.interval != DefaultDiscoveryInterval {
+		t.Fatalf("间隔时间不大于0时应该使用默认值，实际为%v", fd.interval)
+	}
+
+	dd, err := newDNSDiscovery(-1, func(ctx context.Context) ([]*KVPair, error) {
+		return []*KVPair{{Key: "127.0.0.1:8972"}}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dd.Close()
+	if dd.interval != DefaultDiscoveryInterval {
+		t.Fatalf("间隔时间不大于0时应该使用默认值，实际为%v", dd.interval)
+	}
+}
+
+func TestFileDiscoveryYAML(t *testing.T) {
+	fileName := filepath.Join(tempDir(t), "servers.yaml")
+	data := "- key: tcp@127.0.0.1:8972\n  value: weight=10\n- key: tcp@127.0.0.1:8973\n"
+	if err := ioutil.WriteFile(fileName, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fd, err := NewFileDiscovery(fileName, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fd.Close()
+
+	pairs := fd.GetServices()
+	if len(pairs) != 2 || pairs[0].Key != "tcp@127.0.0.1:8972" || pairs[0].Value != "weight=10" || pairs[1].Key != "tcp@127.0.0.1:8973" {
+		t.Fatalf("yaml文件解析结果不正确: %v", pairs)
+	}
+}
+
+// 等待监听通道推送新的服务器列表
+func waitPairs(t *testing.T, ch chan []*KVPair) []*KVPair {
+	t.Helper()
+	select {
+	case pairs := <-ch:
+		return pairs
+	case <-time.After(2 * time.Second):
+		t.Fatal("没有推送新的服务器列表")
+		return nil
+	}
+}
+
+// 一段时间内没有推送
+func expectNoPush(t *testing.T, ch chan []*KVPair, wait time.Duration) {
+	t.Helper()
+	select {
+	case pairs := <-ch:
+		t.Fatalf("服务器列表没有变化不应该推送: %v", pairs)
+	case <-time.After(wait):
+	}
+}
+
+// 文件被修改之后重新加载并推送，加载失败继续使用旧的列表
+func TestFileDiscoveryWatch(t *testing.T) {
+	fileName := filepath.Join(tempDir(t), "servers.json")
+	if err := ioutil.WriteFile(fileName, []byte(`[{"key": "tcp@127.0.0.1:8972"}]`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fd, err := NewFileDiscovery(fileName, 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fd.Close()
+	ch := fd.WatchService()
+
+	data := `[{"key": "tcp@127.0.0.1:8972"}, {"key": "tcp@127.0.0.1:8973", "value": "weight=5"}]`
+	if err = ioutil.WriteFile(fileName, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	pairs := waitPairs(t, ch)
+	if len(pairs) != 2 || pairs[1].Key != "tcp@127.0.0.1:8973" || pairs[1].Value != "weight=5" {
+		t.Fatalf("修改之后的服务器列表不正确: %v", pairs)
+	}
+
+	if err = ioutil.WriteFile(fileName, []byte(`[{"key": `), 0644); err != nil {
+		t.Fatal(err)
+	}
+	expectNoPush(t, ch, 50*time.Millisecond)
+	if pairs = fd.GetServices(); len(pairs) != 2 {
+		t.Fatalf("加载失败应该继续使用旧的列表: %v", pairs)
+	}
+}
+
+// 定时重新解析，解析结果有变化才推送，解析失败继续使用旧的列表
+func TestDNSDiscoveryReresolve(t *testing.T) {
+	var mu sync.Mutex
+	result := []*KVPair{{Key: "10.0.0.1:8972"}}
+	var lookupErr error
+	set := func(pairs []*KVPair, err error) {
+		mu.Lock()
+		result, lookupErr = pairs, err
+		mu.Unlock()
+	}
+
+	dd, err := newDNSDiscovery(10*time.Millisecond, func(ctx context.Context) ([]*KVPair, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return result, lookupErr
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dd.Close()
+	ch := dd.WatchService()
+
+	// 新增一台服务器（解析结果的顺序不固定，推送的列表是排好序的）
+	set([]*KVPair{{Key: "10.0.0.2:8972"}, {Key: "10.0.0.1:8972"}}, nil)
+	pairs := waitPairs(t, ch)
+	if len(pairs) != 2 || pairs[0].Key != "10.0.0.1:8972" || pairs[1].Key != "10.0.0.2:8972" {
+		t.Fatalf("重新解析之后的服务器列表不正确: %v", pairs)
+	}
+	expectNoPush(t, ch, 50*time.Millisecond)
+
+	set(nil, errors.New("解析失败"))
+	expectNoPush(t, ch, 50*time.Millisecond)
+	if pairs = dd.GetServices(); len(pairs) != 2 {
+		t.Fatalf("解析失败应该继续使用旧的列表: %v", pairs)
+	}
+}
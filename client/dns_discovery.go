@@ -0,0 +1,123 @@
+package client
+
+import (
+	"avrilko-rpc/log"
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 基于dns的服务发现，定时重新解析域名，解析结果有变化就推送给监听者
+type DNSDiscovery struct {
+	discoveryWatchers
+
+	lookup   func(ctx context.Context) ([]*KVPair, error) // 解析出服务器列表
+	interval time.Duration                                // 重新解析的间隔时间
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+// 通过A/AAAA记录发现服务器，所有服务器使用同一个端口
+func NewDNSDiscovery(domain string, port int, interval time.Duration) (*DNSDiscovery, error) {
+	return newDNSDiscovery(interval, func(ctx context.Context) ([]*KVPair, error) {
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, domain)
+		if err != nil {
+			return nil, err
+		}
+
+		pairs := make([]*KVPair, 0, len(addrs))
+		for _, addr := range addrs {
+			pairs = append(pairs, &KVPair{Key: net.JoinHostPort(addr.IP.String(), strconv.Itoa(port))})
+		}
+		return pairs, nil
+	})
+}
+
+// 通过SRV记录发现服务器（_service._proto.name），记录的权重会放到元数据的weight中
+func NewDNSSRVDiscovery(service, proto, name string, interval time.Duration) (*DNSDiscovery, error) {
+	return newDNSDiscovery(interval, func(ctx context.Context) ([]*KVPair, error) {
+		_, srvs, err := net.DefaultResolver.LookupSRV(ctx, service, proto, name)
+		if err != nil {
+			return nil, err
+		}
+
+		pairs := make([]*KVPair, 0, len(srvs))
+		for _, srv := range srvs {
+			pairs = append(pairs, &KVPair{
+				Key:   net.JoinHostPort(strings.TrimSuffix(srv.Target, "."), strconv.Itoa(int(srv.Port))),
+				Value: "weight=" + strconv.Itoa(int(srv.Weight)),
+			})
+		}
+		return pairs, nil
+	})
+}
+
+// 第一次解析失败直接返回错误，interval不大于0时使用DefaultDiscoveryInterval
+func newDNSDiscovery(interval time.Duration, lookup func(ctx context.Context) ([]*KVPair, error)) (*DNSDiscovery, error) {
+	if interval <= 0 {
+		interval = DefaultDiscoveryInterval
+	}
+	d := &DNSDiscovery{
+		lookup:   lookup,
+		interval: interval,
+		done:     make(chan struct{}),
+	}
+
+	if err := d.resolve(); err != nil {
+		return nil, err
+	}
+
+	go d.watch()
+	return d, nil
+}
+
+// 解析一次域名（超时时间不超过解析间隔）
+func (d *DNSDiscovery) resolve() error {
+	timeout := d.interval
+	if timeout > 10*time.Second {
+		timeout = 10 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	pairs, err := d.lookup(ctx)
+	if err != nil {
+		return err
+	}
+	sortKVPairs(pairs)
+	d.update(pairs)
+	return nil
+}
+
+// 定时重新解析（解析失败继续使用旧的服务器列表）
+func (d *DNSDiscovery) watch() {
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-d.done:
+			return
+		case <-ticker.C:
+		}
+
+		if err := d.resolve(); err != nil {
+			log.WarnF("dns服务发现解析失败，继续使用旧的服务器列表，错误原因%v", err)
+		}
+	}
+}
+
+func (d *DNSDiscovery) Clone(servicePath string) ServiceDiscovery {
+	return d
+}
+
+// 停止重新解析
+func (d *DNSDiscovery) Close() {
+	d.closeOnce.Do(func() {
+		close(d.done)
+	})
+}
@@ -0,0 +1,117 @@
+package client
+
+import (
+	"avrilko-rpc/log"
+	"encoding/json"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 基于文件的服务发现，定时检查文件是否被修改，修改了就重新加载并推送给监听者
+// 文件内容为json数组：[{"key": "tcp@127.0.0.1:8972", "value": "weight=10"}]
+// 扩展名为.yaml或者.yml时按yaml解析：
+//   - key: tcp@127.0.0.1:8972
+//     value: weight=10
+type FileDiscovery struct {
+	discoveryWatchers
+
+	fileName string
+	interval time.Duration // 检查文件的间隔时间
+	modTime  time.Time     // 最后一次加载时文件的修改时间
+	size     int64         // 最后一次加载时文件的大小
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+// 新建一个基于文件的服务发现，文件第一次加载失败直接返回错误，interval不大于0时使用DefaultDiscoveryInterval
+func NewFileDiscovery(fileName string, interval time.Duration) (*FileDiscovery, error) {
+	if interval <= 0 {
+		interval = DefaultDiscoveryInterval
+	}
+	d := &FileDiscovery{
+		fileName: fileName,
+		interval: interval,
+		done:     make(chan struct{}),
+	}
+
+	if err := d.load(); err != nil {
+		return nil, err
+	}
+
+	go d.watch()
+	return d, nil
+}
+
+// 读取并解析文件
+func (d *FileDiscovery) load() error {
+	fi, err := os.Stat(d.fileName)
+	if err != nil {
+		return err
+	}
+
+	data, err := ioutil.ReadFile(d.fileName)
+	if err != nil {
+		return err
+	}
+
+	var pairs []*KVPair
+	switch strings.ToLower(filepath.Ext(d.fileName)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &pairs)
+	default:
+		err = json.Unmarshal(data, &pairs)
+	}
+	if err != nil {
+		return err
+	}
+	sortKVPairs(pairs)
+
+	d.modTime = fi.ModTime()
+	d.size = fi.Size()
+	d.update(pairs)
+	return nil
+}
+
+// 定时检查文件的修改时间和大小，有变化就重新加载（加载失败继续使用旧的服务器列表）
+func (d *FileDiscovery) watch() {
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-d.done:
+			return
+		case <-ticker.C:
+		}
+
+		fi, err := os.Stat(d.fileName)
+		if err != nil {
+			log.WarnF("服务发现文件%s读取失败，错误原因%v", d.fileName, err)
+			continue
+		}
+		if fi.ModTime().Equal(d.modTime) && fi.Size() == d.size {
+			continue
+		}
+
+		if err = d.load(); err != nil {
+			log.WarnF("服务发现文件%s加载失败，继续使用旧的服务器列表，错误原因%v", d.fileName, err)
+		}
+	}
+}
+
+func (d *FileDiscovery) Clone(servicePath string) ServiceDiscovery {
+	return d
+}
+
+// 停止检查文件
+func (d *FileDiscovery) Close() {
+	d.closeOnce.Do(func() {
+		close(d.done)
+	})
+}
@@ -0,0 +1,200 @@
+package client
+
+import (
+	"avrilko-rpc/share"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var ErrFileTransferFailed = errors.New("服务端保存文件失败")
+
+// 上传文件，rateInBytesPerSecond大于0时限制上传速度（字节/秒）
+// 先通过rpc和服务端协商拿到凭证，再单独建立一条连接传输文件数据
+func (c *xClient) SendFile(ctx context.Context, fileName string, rateInBytesPerSecond int64) error {
+	if c.closed() {
+		return ErrXClientShutdown
+	}
+
+	file, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	fi, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	args := &share.FileTransferArgs{
+		FileName: filepath.Base(fileName),
+		FileSize: fi.Size(),
+	}
+	if meta, ok := ctx.Value(share.ReqMetaDataKey).(map[string]string); ok {
+		args.Meta = meta
+	}
+
+	reply := &share.FileTransferReply{}
+	k, err := c.negotiateFileTransfer(ctx, "TransferFile", args, reply)
+	if err != nil {
+		return err
+	}
+
+	return c.transferFile(ctx, k, reply, func(conn net.Conn) error {
+		var w io.Writer = conn
+		if rateInBytesPerSecond > 0 {
+			w = &rateLimitedWriter{ctx: ctx, w: conn, rate: rateInBytesPerSecond, start: time.Now()}
+		}
+		if _, err := io.CopyN(w, file, fi.Size()); err != nil {
+			return err
+		}
+
+		// 等待服务端确认文件已经保存
+		ack := make([]byte, 1)
+		if _, err := io.ReadFull(conn, ack); err != nil {
+			return err
+		}
+		if ack[0] != 0 {
+			return ErrFileTransferFailed
+		}
+		return nil
+	})
+}
+
+// 下载文件，文件数据写入saveTo中
+func (c *xClient) DownloadFile(ctx context.Context, requestFileName string, saveTo io.Writer) error {
+	if c.closed() {
+		return ErrXClientShutdown
+	}
+
+	args := &share.DownloadFileArgs{FileName: requestFileName}
+	if meta, ok := ctx.Value(share.ReqMetaDataKey).(map[string]string); ok {
+		args.Meta = meta
+	}
+
+	reply := &share.FileTransferReply{}
+	k, err := c.negotiateFileTransfer(ctx, "DownloadFile", args, reply)
+	if err != nil {
+		return err
+	}
+
+	return c.transferFile(ctx, k, reply, func(conn net.Conn) error {
+		_, err := io.CopyN(saveTo, conn, reply.FileSize)
+		return err
+	})
+}
+
+// 调用服务端的文件传输服务拿到凭证，返回协商的服务器
+func (c *xClient) negotiateFileTransfer(ctx context.Context, serviceMethod string, args, reply interface{}) (string, error) {
+	ctx = c.prepareContext(ctx)
+	k, client, err := c.selectClient(ctx, serviceMethod, args, nil)
+	if err != nil {
+		return "", err
+	}
+
+	serviceName := c.option.FileTransferServiceName
+	if serviceName == "" {
+		serviceName = share.SendFileServiceName
+	}
+
+	start := c.callStart(k)
+	err = client.Call(ctx, serviceName, serviceMethod, args, reply)
+	c.callDone(k, start, err)
+	return k, err
+}
+
+// 连接服务端的文件传输地址，发送凭证之后交给fn传输数据，ctx结束时会关闭连接
+func (c *xClient) transferFile(ctx context.Context, k string, reply *share.FileTransferReply, fn func(conn net.Conn) error) error {
+	_, serverAddr := splitNetworkAndAddress(k)
+	addr := reply.Addr
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) { // 服务端监听的是所有地址，使用rpc服务端的主机
+		if serverHost, _, err := net.SplitHostPort(serverAddr); err == nil {
+			addr = net.JoinHostPort(serverHost, port)
+		}
+	}
+
+	var conn net.Conn
+	if c.option.TLSConfig != nil {
+		dialer := &net.Dialer{Timeout: c.option.ConnectTimeout}
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, c.option.TLSConfig)
+	} else {
+		conn, err = net.DialTimeout("tcp", addr, c.option.ConnectTimeout)
+	}
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done(): // 调用方不等了，关闭连接中断传输
+			conn.Close()
+		case <-stop:
+		}
+	}()
+
+	if _, err = conn.Write(reply.Token); err == nil {
+		err = fn(conn)
+	}
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// 限速写入，写得比rate快就等一等
+type rateLimitedWriter struct {
+	ctx     context.Context
+	w       io.Writer
+	rate    int64 // 字节/秒
+	start   time.Time
+	written int64
+}
+
+func (w *rateLimitedWriter) Write(p []byte) (int, error) {
+	// 每次最多写入100ms的数据量，避免一次写太多造成突发流量
+	chunk := int(w.rate / 10)
+	if chunk < 1 {
+		chunk = 1
+	}
+
+	n := 0
+	for len(p) > 0 {
+		size := len(p)
+		if size > chunk {
+			size = chunk
+		}
+
+		m, err := w.w.Write(p[:size])
+		n += m
+		w.written += int64(m)
+		if err != nil {
+			return n, err
+		}
+		p = p[m:]
+
+		expect := time.Duration(float64(w.written) / float64(w.rate) * float64(time.Second))
+		if d := expect - time.Since(w.start); d > 0 {
+			timer := time.NewTimer(d)
+			select {
+			case <-w.ctx.Done():
+				timer.Stop()
+				return n, w.ctx.Err()
+			case <-timer.C:
+			}
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,60 @@
+package client
+
+import (
+	"avrilko-rpc/server"
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// 启动开启了文件传输服务的服务端，上传的文件保存在dir下
+func startFileTransferServer(t *testing.T, serviceName, dir string) string {
+	t.Helper()
+	s := server.NewServer()
+	if err := s.EnableFileTransfer(serviceName, server.NewFileTransfer("127.0.0.1:0", server.NewDirFileTransferHandler(dir))); err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.ServeListener("tcp", ln)
+	t.Cleanup(func() { s.Close() })
+	return ln.Addr().String()
+}
+
+func tempDir(t *testing.T) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "avrilko-rpc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+func TestSendFileWithCustomServiceName(t *testing.T) {
+	dir := tempDir(t)
+	addr := startFileTransferServer(t, "files", filepath.Join(dir, "server"))
+
+	src := filepath.Join(dir, "hello.txt")
+	if err := ioutil.WriteFile(src, []byte("hello world"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	option := DefaultOption
+	option.FileTransferServiceName = "files"
+	xc := NewXClient("files", Failfast, RandomSelect, NewPeer2PeerDiscovery("tcp@"+addr, ""), option)
+	defer xc.Close()
+
+	if err := xc.SendFile(context.Background(), src, 0); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, "server", "hello.txt"))
+	if err != nil || string(data) != "hello world" {
+		t.Fatalf("服务端保存的文件不正确: %q %v", data, err)
+	}
+}
@@ -1,16 +1,43 @@
 package client
 
 import (
+	"avrilko-rpc/share"
+	"context"
 	"fmt"
 	"hash/fnv"
 )
 
+var hashKeyContextKey = share.ContextKey("__hash_key")
+
+// 请求参数实现了这个接口时，一致性hash使用HashKey()的返回值作为key
+type Hashable interface {
+	HashKey() string
+}
+
+// 设置本次调用一致性hash的key，相同key的请求会被发到同一台服务器（比如按租户、用户路由）
+func WithHashKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, hashKeyContextKey, key)
+}
+
 func HashString(s string) uint64 {
 	h := fnv.New64a()
 	h.Write([]byte(s))
 	return h.Sum64()
 }
 
+// 一致性hash的key：优先使用WithHashKey设置的key，其次是实现了Hashable的请求参数，最后使用服务名、方法名和请求参数
+func hashKey(ctx context.Context, servicePath, serviceMethod string, args interface{}) uint64 {
+	if ctx != nil {
+		if key, ok := ctx.Value(hashKeyContextKey).(string); ok {
+			return HashString(key)
+		}
+	}
+	if h, ok := args.(Hashable); ok {
+		return HashString(h.HashKey())
+	}
+	return genKey(servicePath, serviceMethod, args)
+}
+
 // 生成key
 func genKey(options ...interface{}) uint64 {
 	keyString := ""
@@ -0,0 +1,162 @@
+package client
+
+import (
+	"avrilko-rpc/share"
+	"bufio"
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var callStartKey = share.ContextKey("__metrics_call_start") // 调用开始的时间（纳秒）
+
+// 默认的调用耗时分桶（秒），和服务端指标插件的默认值一致
+var DefaultLatencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+var labelReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`) // 标签值中需要转义的字符
+
+// 一个方法的调用指标（都是原子操作，不需要加锁）
+type callMetrics struct {
+	requests      uint64
+	errors        uint64
+	latencySum    uint64   // 耗时的总和（纳秒）
+	latencyCounts []uint64 // 每个分桶的数量（不是累计的，输出的时候再累加）
+}
+
+type callKey struct {
+	service string
+	method  string
+}
+
+// 客户端指标插件，统计每个服务每个方法的调用数、错误数和耗时分布，以prometheus文本格式输出
+// 实现了http.Handler，需要自己挂载到http服务上；只统计经过XClient的调用（会执行PreCall/PostCall），重试和广播时每次发送都单独计数
+// 服务名和方法名由调用方决定，不会像服务端一样限制在注册过的方法中
+type MetricsPlugin struct {
+	Namespace string    // 指标名的前缀
+	Buckets   []float64 // 调用耗时的分桶（秒），需要从小到大排列，开始记录指标之后不能再修改
+
+	mu      sync.RWMutex
+	methods map[callKey]*callMetrics
+}
+
+func NewMetricsPlugin() *MetricsPlugin {
+	return &MetricsPlugin{
+		Namespace: "avrilko_rpc",
+		Buckets:   DefaultLatencyBuckets,
+		methods:   make(map[callKey]*callMetrics),
+	}
+}
+
+// 调用前记下开始时间
+func (p *MetricsPlugin) PreCall(ctx context.Context, servicePath, serviceMethod string, request interface{}) error {
+	if sctx, ok := ctx.(*share.Context); ok {
+		share.WithLocalValue(sctx, callStartKey, time.Now().UnixNano())
+	}
+	return nil
+}
+
+// 调用后记录指标，失败的调用也计入调用数
+func (p *MetricsPlugin) PostCall(ctx context.Context, servicePath, serviceMethod string, request, response interface{}, err error) error {
+	m := p.method(servicePath, serviceMethod)
+
+	atomic.AddUint64(&m.requests, 1)
+	if err != nil {
+		atomic.AddUint64(&m.errors, 1)
+	}
+
+	if start, ok := ctx.Value(callStartKey).(int64); ok {
+		latency := time.Duration(time.Now().UnixNano() - start)
+		atomic.AddUint64(&m.latencySum, uint64(latency))
+		seconds := latency.Seconds()
+		for i, bound := range p.Buckets {
+			if seconds <= bound {
+				atomic.AddUint64(&m.latencyCounts[i], 1)
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// 方法对应的指标，没有就创建
+func (p *MetricsPlugin) method(service, method string) *callMetrics {
+	key := callKey{service: service, method: method}
+
+	p.mu.RLock()
+	m, ok := p.methods[key]
+	p.mu.RUnlock()
+	if ok {
+		return m
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if m, ok = p.methods[key]; !ok {
+		m = &callMetrics{latencyCounts: make([]uint64, len(p.Buckets))}
+		p.methods[key] = m
+	}
+	return m
+}
+
+// 以prometheus文本格式输出所有指标
+func (p *MetricsPlugin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	bw := bufio.NewWriter(w)
+	p.writeMetrics(bw)
+	bw.Flush()
+}
+
+// 按prometheus文本格式写入所有指标
+func (p *MetricsPlugin) writeMetrics(w *bufio.Writer) {
+	p.mu.RLock()
+	keys := make([]callKey, 0, len(p.methods))
+	for k := range p.methods {
+		keys = append(keys, k)
+	}
+	methods := make([]*callMetrics, len(keys))
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].service != keys[j].service {
+			return keys[i].service < keys[j].service
+		}
+		return keys[i].method < keys[j].method
+	})
+	for i, k := range keys {
+		methods[i] = p.methods[k]
+	}
+	p.mu.RUnlock()
+
+	ns := p.Namespace
+	labels := func(k callKey) string {
+		return fmt.Sprintf(`service="%s",method="%s"`, labelReplacer.Replace(k.service), labelReplacer.Replace(k.method))
+	}
+	counter := func(name, help string, value func(m *callMetrics) uint64) {
+		fmt.Fprintf(w, "# HELP %s_%s %s\n# TYPE %s_%s counter\n", ns, name, help, ns, name)
+		for i, k := range keys {
+			fmt.Fprintf(w, "%s_%s{%s} %d\n", ns, name, labels(k), value(methods[i]))
+		}
+	}
+
+	counter("client_requests_total", "发起的调用数", func(m *callMetrics) uint64 { return atomic.LoadUint64(&m.requests) })
+	counter("client_errors_total", "返回错误的调用数", func(m *callMetrics) uint64 { return atomic.LoadUint64(&m.errors) })
+
+	name := ns + "_client_request_duration_seconds"
+	fmt.Fprintf(w, "# HELP %s 调用的耗时（从发送请求到收到响应）\n# TYPE %s histogram\n", name, name)
+	for i, k := range keys {
+		m := methods[i]
+		var cumulative uint64
+		for j, bound := range p.Buckets {
+			cumulative += atomic.LoadUint64(&m.latencyCounts[j])
+			fmt.Fprintf(w, "%s_bucket{%s,le=\"%s\"} %d\n", name, labels(k), strconv.FormatFloat(bound, 'g', -1, 64), cumulative)
+		}
+		count := atomic.LoadUint64(&m.requests)
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, labels(k), count)
+		fmt.Fprintf(w, "%s_sum{%s} %s\n", name, labels(k), strconv.FormatFloat(time.Duration(atomic.LoadUint64(&m.latencySum)).Seconds(), 'g', -1, 64))
+		fmt.Fprintf(w, "%s_count{%s} %d\n", name, labels(k), count)
+	}
+}
@@ -0,0 +1,45 @@
+package client
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// 经过XClient的调用按服务和方法记录调用数、错误数和耗时
+func TestMetricsPlugin(t *testing.T) {
+	addr := startArithServer(t)
+	option := DefaultOption
+	option.Heartbeat = false
+	xc := newTestXClient(t, Failfast, option, addr)
+	p := NewMetricsPlugin()
+	plugins := NewPluginContainer()
+	plugins.Add(p)
+	xc.SetPlugins(plugins)
+
+	for i := 0; i < 2; i++ {
+		if err := xc.Call(context.Background(), "Mul", &ArithArgs{A: 2, B: 3}, &ArithReply{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := xc.Call(context.Background(), "Nope", &ArithArgs{}, &ArithReply{}); err == nil {
+		t.Fatal("调用不存在的方法应该返回错误")
+	}
+
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+	for _, line := range []string{
+		`avrilko_rpc_client_requests_total{service="Arith",method="Mul"} 2`,
+		`avrilko_rpc_client_errors_total{service="Arith",method="Mul"} 0`,
+		`avrilko_rpc_client_requests_total{service="Arith",method="Nope"} 1`,
+		`avrilko_rpc_client_errors_total{service="Arith",method="Nope"} 1`,
+		`avrilko_rpc_client_request_duration_seconds_count{service="Arith",method="Mul"} 2`,
+		`avrilko_rpc_client_request_duration_seconds_bucket{service="Arith",method="Mul",le="+Inf"} 2`,
+	} {
+		if !strings.Contains(body, line) {
+			t.Fatalf("输出的指标中没有%s\n%s", line, body)
+		}
+	}
+}
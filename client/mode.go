@@ -12,11 +12,13 @@ const (
 type SelectMode int
 
 const (
-	RandomSelect       SelectMode = iota // 随机算法
-	RoundRobin                           // 轮询
-	WeightedRoundRobin                   // 加权轮询
-	ConsistentHash                       // 一致性hash
-	Closest                              // 选择最近的服务器
+	RandomSelect              SelectMode = iota // 随机算法
+	RoundRobin                                  // 轮询
+	WeightedRoundRobin                          // 加权轮询
+	ConsistentHash                              // 一致性hash
+	Closest                                     // 选择最近的服务器（延迟最低）
+	ClosestP2C                                  // 随机挑两台服务器，选择延迟低的那台（避免所有请求都压到同一台服务器）
+	BoundedLoadConsistentHash                   // 有负载上限的一致性hash（热点key会溢出到其他服务器）
 
 	SelectByUser = 1000 // 这个由用户自己指定
 )
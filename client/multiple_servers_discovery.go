@@ -0,0 +1,26 @@
+package client
+
+// 多台固定服务器的服务发现，可以通过Update手动更新服务器列表
+type MultipleServersDiscovery struct {
+	discoveryWatchers
+}
+
+// 新建一个多台固定服务器的服务发现（KVPair的Key为服务器地址，Value为元数据）
+func NewMultipleServersDiscovery(pairs []*KVPair) *MultipleServersDiscovery {
+	d := &MultipleServersDiscovery{}
+	d.update(pairs)
+	return d
+}
+
+// 更新服务器列表，变动会推送给所有的监听者
+func (d *MultipleServersDiscovery) Update(pairs []*KVPair) {
+	d.update(pairs)
+}
+
+func (d *MultipleServersDiscovery) Clone(servicePath string) ServiceDiscovery {
+	return d
+}
+
+func (d *MultipleServersDiscovery) Close() {
+
+}
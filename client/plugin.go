@@ -4,75 +4,200 @@ import (
 	"avrilko-rpc/protocol"
 	"context"
 	"net"
+	"sync"
 )
 
-// 插件容器默认实现
-type pluginContainer struct {
-	plugins []Plugin
+type Plugin interface {
 }
 
-func (p pluginContainer) Add(plugin Plugin) {
-	panic("implement me")
-}
+// 客户端插件容器
+type PluginContainer interface {
+	Add(plugin Plugin)    // 添加一个插件
+	Remove(plugin Plugin) // 移除一个插件
+	All() []Plugin        // 获取所有插件
 
-func (p pluginContainer) Remove(plugin Plugin) {
-	panic("implement me")
-}
+	DoConnCreated(conn net.Conn) (net.Conn, error)     // 在conn 创建之后执行
+	DoClientConnected(conn net.Conn) (net.Conn, error) // 在客户端链接之后执行
+	DoClientConnectClose(conn net.Conn) error          // 在客户端链接被关闭后执行
 
-func (p pluginContainer) All() []Plugin {
-	panic("implement me")
-}
+	DoPreCall(ctx context.Context, servicePath, serviceMethod string, request interface{}) error                       // 在执行调用前执行
+	DoPostCall(ctx context.Context, servicePath, serviceMethod string, request, response interface{}, err error) error // 在执行调用后执行
 
-func (p pluginContainer) DoConnCreated(conn net.Conn) (net.Conn, error) {
-	panic("implement me")
+	DoClientBeforeEncode(message *protocol.Message) error // 在客户端打包数据前调用
+	DoClientAfterDecode(message *protocol.Message) error  // 在客户端调用解包数据后调用
+
+	DoWrapSelect(selectFunc SelectFunc) SelectFunc // 包装客户端负载均衡算法
 }
 
-func (p pluginContainer) DoClientConnected(conn net.Conn) (net.Conn, error) {
-	panic("implement me")
+type (
+	// conn 创建之后执行，可以替换conn
+	ConnCreatedPlugin interface {
+		ConnCreated(conn net.Conn) (net.Conn, error)
+	}
+
+	// 客户端链接之后执行
+	ClientConnectedPlugin interface {
+		ClientConnected(conn net.Conn) (net.Conn, error)
+	}
+
+	// 客户端链接被关闭后执行
+	ClientConnectionClosePlugin interface {
+		ClientConnectionClose(conn net.Conn) error
+	}
+
+	// 执行调用前执行，返回错误则不再发起调用
+	PreCallPlugin interface {
+		PreCall(ctx context.Context, servicePath, serviceMethod string, request interface{}) error
+	}
+
+	// 执行调用后执行
+	PostCallPlugin interface {
+		PostCall(ctx context.Context, servicePath, serviceMethod string, request, response interface{}, err error) error
+	}
+
+	// 打包数据前调用，可以修改要发送的消息（比如加上元数据）
+	ClientBeforeEncodePlugin interface {
+		ClientBeforeEncode(message *protocol.Message) error
+	}
+
+	// 解包数据后调用
+	ClientAfterDecodePlugin interface {
+		ClientAfterDecode(message *protocol.Message) error
+	}
+
+	// 包装负载均衡选择函数
+	SelectWrapPlugin interface {
+		WrapSelect(selectFunc SelectFunc) SelectFunc
+	}
+)
+
+// 插件容器默认实现
+// 插件按添加的顺序执行，任何一个插件返回错误都会中断后面的插件
+type pluginContainer struct {
+	mu      sync.RWMutex
+	plugins []Plugin // 写时复制，读的时候不需要一直持有锁
 }
 
-func (p pluginContainer) DoClientConnectClose(conn net.Conn) error {
-	panic("implement me")
+// 创建默认的插件容器，通过XClient.SetPlugins设置到客户端上
+func NewPluginContainer() PluginContainer {
+	return &pluginContainer{}
 }
 
-func (p pluginContainer) DoPreCall(ctx context.Context, servicePath, serviceMethod string, request interface{}) error {
-	panic("implement me")
+func (p *pluginContainer) Add(plugin Plugin) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	plugins := make([]Plugin, 0, len(p.plugins)+1)
+	plugins = append(plugins, p.plugins...)
+	p.plugins = append(plugins, plugin)
 }
 
-func (p pluginContainer) DoPostCall(ctx context.Context, servicePath, serviceMethod string, request, response interface{}, err error) error {
-	panic("implement me")
+func (p *pluginContainer) Remove(plugin Plugin) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	plugins := make([]Plugin, 0, len(p.plugins))
+	for _, pp := range p.plugins {
+		if pp != plugin {
+			plugins = append(plugins, pp)
+		}
+	}
+	p.plugins = plugins
 }
 
-func (p pluginContainer) DoClientBeforeEncode(message *protocol.Message) error {
-	panic("implement me")
+func (p *pluginContainer) All() []Plugin {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.plugins
 }
 
-func (p pluginContainer) DoClientAfterDecode(message protocol.Message) error {
-	panic("implement me")
+func (p *pluginContainer) DoConnCreated(conn net.Conn) (net.Conn, error) {
+	var err error
+	for _, plugin := range p.All() {
+		if plugin, ok := plugin.(ConnCreatedPlugin); ok {
+			conn, err = plugin.ConnCreated(conn)
+			if err != nil {
+				return conn, err
+			}
+		}
+	}
+	return conn, nil
 }
 
-func (p pluginContainer) DoWrapSelect(selectFunc SelectFunc) SelectFunc {
-	panic("implement me")
+func (p *pluginContainer) DoClientConnected(conn net.Conn) (net.Conn, error) {
+	var err error
+	for _, plugin := range p.All() {
+		if plugin, ok := plugin.(ClientConnectedPlugin); ok {
+			conn, err = plugin.ClientConnected(conn)
+			if err != nil {
+				return conn, err
+			}
+		}
+	}
+	return conn, nil
 }
 
-type Plugin interface {
+func (p *pluginContainer) DoClientConnectClose(conn net.Conn) error {
+	for _, plugin := range p.All() {
+		if plugin, ok := plugin.(ClientConnectionClosePlugin); ok {
+			if err := plugin.ClientConnectionClose(conn); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
 }
 
-// 客户端插件容器
-type PluginContainer interface {
-	Add(plugin Plugin)    // 添加一个插件
-	Remove(plugin Plugin) // 移除一个插件
-	All() []Plugin        // 获取所有插件
+func (p *pluginContainer) DoPreCall(ctx context.Context, servicePath, serviceMethod string, request interface{}) error {
+	for _, plugin := range p.All() {
+		if plugin, ok := plugin.(PreCallPlugin); ok {
+			if err := plugin.PreCall(ctx, servicePath, serviceMethod, request); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
 
-	DoConnCreated(conn net.Conn) (net.Conn, error)     // 在conn 创建之后执行
-	DoClientConnected(conn net.Conn) (net.Conn, error) // 在客户端链接之后执行
-	DoClientConnectClose(conn net.Conn) error          // 在客户端链接被关闭后执行
+func (p *pluginContainer) DoPostCall(ctx context.Context, servicePath, serviceMethod string, request, response interface{}, err error) error {
+	for _, plugin := range p.All() {
+		if plugin, ok := plugin.(PostCallPlugin); ok {
+			if e := plugin.PostCall(ctx, servicePath, serviceMethod, request, response, err); e != nil {
+				return e
+			}
+		}
+	}
+	return nil
+}
 
-	DoPreCall(ctx context.Context, servicePath, serviceMethod string, request interface{}) error                       // 在执行调用前执行
-	DoPostCall(ctx context.Context, servicePath, serviceMethod string, request, response interface{}, err error) error // 在执行调用后执行
+func (p *pluginContainer) DoClientBeforeEncode(message *protocol.Message) error {
+	for _, plugin := range p.All() {
+		if plugin, ok := plugin.(ClientBeforeEncodePlugin); ok {
+			if err := plugin.ClientBeforeEncode(message); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
 
-	DoClientBeforeEncode(message *protocol.Message) error // 在客户端打包数据前调用
-	DoClientAfterDecode(message protocol.Message) error   // 在客户端调用解包数据后调用
+func (p *pluginContainer) DoClientAfterDecode(message *protocol.Message) error {
+	for _, plugin := range p.All() {
+		if plugin, ok := plugin.(ClientAfterDecodePlugin); ok {
+			if err := plugin.ClientAfterDecode(message); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
 
-	DoWrapSelect(selectFunc SelectFunc) SelectFunc // 包装客户端负载均衡算法
+// 按添加顺序一层层包装，最后添加的插件在最外层
+func (p *pluginContainer) DoWrapSelect(selectFunc SelectFunc) SelectFunc {
+	for _, plugin := range p.All() {
+		if plugin, ok := plugin.(SelectWrapPlugin); ok {
+			selectFunc = plugin.WrapSelect(selectFunc)
+		}
+	}
+	return selectFunc
 }
@@ -4,9 +4,11 @@ import (
 	"context"
 	"github.com/edwingeng/doublejump"
 	"github.com/valyala/fastrand"
+	"math"
 	"net/url"
 	"sort"
 	"strconv"
+	"sync"
 )
 
 type SelectFunc func(ctx context.Context, servicePath, serviceMethod string, args interface{}) string // 负载均衡函数
@@ -17,6 +19,12 @@ type Selector interface {
 	UpdateServer(servers map[string]string)                                                 // 更新服务列表
 }
 
+// 负载观察者，负载均衡算法实现了这个接口时，每次调用开始和结束都会通知（用来统计每台服务器正在处理的请求数）
+type LoadObserver interface {
+	CallStart(server string)
+	CallDone(server string)
+}
+
 func newSelector(selectMode SelectMode, servers map[string]string) Selector {
 	switch selectMode {
 	case RandomSelect: // 随机算法
@@ -26,7 +34,13 @@ func newSelector(selectMode SelectMode, servers map[string]string) Selector {
 	case WeightedRoundRobin:
 		return newWeightRoundRobinSelector(servers)
 	case ConsistentHash:
-		return newConsistentHashSelector(servers)
+		return newConsistentHashSelector(servers, false)
+	case BoundedLoadConsistentHash:
+		return newConsistentHashSelector(servers, true)
+	case Closest:
+		return newClosestSelector(servers, false)
+	case ClosestP2C:
+		return newClosestSelector(servers, true)
 	case SelectByUser:
 		return nil
 	default: // 默认也是使用随机
@@ -36,6 +50,7 @@ func newSelector(selectMode SelectMode, servers map[string]string) Selector {
 
 // 随机负载均衡算法
 type randomSelector struct {
+	mu      sync.RWMutex
 	servers []string
 }
 
@@ -48,7 +63,9 @@ func newRandomSelector(servers map[string]string) Selector {
 }
 
 func (r *randomSelector) Select(ctx context.Context, servicePath, serviceMethod string, args interface{}) string {
+	r.mu.RLock()
 	ss := r.servers
+	r.mu.RUnlock()
 	if len(ss) == 0 {
 		return ""
 	}
@@ -63,24 +80,29 @@ func (r *randomSelector) UpdateServer(servers map[string]string) {
 	for k, _ := range servers {
 		ss = append(ss, k)
 	}
+
+	r.mu.Lock()
 	r.servers = ss
+	r.mu.Unlock()
 }
 
 // 轮询
 type roundRobinSelector struct {
+	mu      sync.Mutex
 	servers []string
 	i       int
 }
 
 func newRoundRobinSelector(servers map[string]string) Selector {
-	ss := make([]string, 0, len(servers))
-	for k, _ := range servers {
-		ss = append(ss, k)
-	}
-	return &roundRobinSelector{servers: ss}
+	r := &roundRobinSelector{}
+	r.UpdateServer(servers) // 和更新服务器一样排好序
+	return r
 }
 
 func (r *roundRobinSelector) Select(ctx context.Context, servicePath, serviceMethod string, args interface{}) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
 	ss := r.servers
 	if len(ss) == 0 {
 		return ""
@@ -97,33 +119,44 @@ func (r *roundRobinSelector) UpdateServer(servers map[string]string) {
 	for k, _ := range servers {
 		ss = append(ss, k)
 	}
+	sort.Strings(ss) // 顺序固定，更新服务器之后轮询的位置才有意义
+
+	r.mu.Lock()
 	r.servers = ss
+	r.mu.Unlock()
 }
 
 // 加权轮询
 type weightRoundRobinSelector struct {
+	mu      sync.Mutex
 	servers []*Weighted
 }
 
 func newWeightRoundRobinSelector(servers map[string]string) Selector {
 	return &weightRoundRobinSelector{
-		servers: createdWeighted(servers),
+		servers: createdWeighted(servers, nil),
 	}
 }
 
-// 创建权重
-func createdWeighted(servers map[string]string) []*Weighted {
+// 创建权重，已经存在的服务器保留当前权重，这样更新服务器列表之后轮询仍然是平滑的
+func createdWeighted(servers map[string]string, old []*Weighted) []*Weighted {
+	current := make(map[string]int, len(old))
+	for _, w := range old {
+		current[w.Server] = w.CurrentWeight
+	}
+
 	ss := make([]*Weighted, 0, len(servers))
 	for k, metadata := range servers {
 		w := &Weighted{
 			Server:          k,
 			Weight:          1,
+			CurrentWeight:   current[k],
 			EffectiveWeight: 1,
 		}
 		if v, err := url.ParseQuery(metadata); err == nil {
 			ww := v.Get("weight")
 			if ww != "" {
-				if weight, err := strconv.Atoi(ww); err == nil {
+				if weight, err := strconv.Atoi(ww); err == nil && weight > 0 {
 					w.Weight = weight
 					w.EffectiveWeight = weight
 				}
@@ -131,12 +164,17 @@ func createdWeighted(servers map[string]string) []*Weighted {
 		}
 		ss = append(ss, w)
 	}
+	sort.Slice(ss, func(i, j int) bool {
+		return ss[i].Server < ss[j].Server
+	})
 	return ss
 }
 
 func (w *weightRoundRobinSelector) Select(ctx context.Context, servicePath, serviceMethod string, args interface{}) string {
-	ss := w.servers
+	w.mu.Lock()
+	defer w.mu.Unlock()
 
+	ss := w.servers
 	if len(ss) == 0 {
 		return ""
 	}
@@ -149,56 +187,120 @@ func (w *weightRoundRobinSelector) Select(ctx context.Context, servicePath, serv
 }
 
 func (w *weightRoundRobinSelector) UpdateServer(servers map[string]string) {
-	s := createdWeighted(servers)
-	w.servers = s
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.servers = createdWeighted(servers, w.servers)
 }
 
 // 一致性hash
+// bounded为true时是有负载上限的一致性hash：每台服务器正在处理的请求数不能超过平均值的boundedLoadFactor倍，
+// 超过了就重新hash找下一台，这样热点key不会把一台服务器压垮
+// 负载上限是近似的：Select只读取负载，请求数在CallStart时才增加，并发的调用在这之间可能选中同一台服务器，
+// 最多超出上限并发调用的数量（在Select中预占会在选中之后没有发出请求时泄漏负载，比如熔断器打开或者连接失败）
 type consistentHashSelector struct {
+	mu      sync.RWMutex
 	servers []string
 	h       *doublejump.Hash
+
+	bounded bool
+	loads   map[string]int64 // 每台服务器正在处理的请求数
+	total   int64            // 所有服务器正在处理的请求数
 }
 
-func newConsistentHashSelector(servers map[string]string) Selector {
-	ss := make([]string, 0, len(servers))
-	for k := range servers {
-		ss = append(ss, k)
-	}
-	sort.Slice(ss, func(i, j int) bool { // 进行从小到大排序
-		return ss[i] < ss[j]
-	})
+const boundedLoadFactor = 1.25
 
-	return &consistentHashSelector{
-		servers: ss,
+func newConsistentHashSelector(servers map[string]string, bounded bool) Selector {
+	c := &consistentHashSelector{
 		h:       doublejump.NewHash(),
+		bounded: bounded,
+		loads:   make(map[string]int64),
 	}
+	c.UpdateServer(servers)
+	return c
 }
 
 func (c *consistentHashSelector) Select(ctx context.Context, servicePath, serviceMethod string, args interface{}) string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
 	ss := c.servers
 	if len(ss) == 0 {
 		return ""
 	}
 
-	key := genKey(servicePath, serviceMethod, args)
+	key := hashKey(ctx, servicePath, serviceMethod, args)
 	selected, _ := c.h.Get(key).(string)
+	if !c.bounded {
+		return selected
+	}
+
+	// 算上这次请求之后的负载上限
+	capacity := int64(math.Ceil(float64(c.total+1) * boundedLoadFactor / float64(len(ss))))
+	for i := 1; c.loads[selected] >= capacity; i++ {
+		if i > len(ss) { // 重新hash了这么多次还是满的，直接选负载最小的
+			return c.leastLoaded()
+		}
+		selected, _ = c.h.Get(HashString(strconv.FormatUint(key, 10) + "/" + strconv.Itoa(i))).(string)
+	}
+	return selected
+}
+
+// 负载最小的服务器
+func (c *consistentHashSelector) leastLoaded() string {
+	selected := ""
+	for _, server := range c.servers {
+		if selected == "" || c.loads[server] < c.loads[selected] {
+			selected = server
+		}
+	}
 	return selected
 }
 
+func (c *consistentHashSelector) CallStart(server string) {
+	if !c.bounded {
+		return
+	}
+
+	c.mu.Lock()
+	c.loads[server]++
+	c.total++
+	c.mu.Unlock()
+}
+
+func (c *consistentHashSelector) CallDone(server string) {
+	if !c.bounded {
+		return
+	}
+
+	c.mu.Lock()
+	if c.loads[server] > 0 { // 服务器可能已经下线，负载被清理掉了
+		c.loads[server]--
+		c.total--
+	}
+	c.mu.Unlock()
+}
+
 func (c *consistentHashSelector) UpdateServer(servers map[string]string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, k := range c.servers { // 先移除下线的服务器
+		if _, ok := servers[k]; !ok {
+			c.h.Remove(k)
+			c.total -= c.loads[k]
+			delete(c.loads, k)
+		}
+	}
+
 	ss := make([]string, 0, len(servers))
 	for k := range servers {
-		c.h.Add(k)
 		ss = append(ss, k)
 	}
-
-	sort.Slice(ss, func(i, j int) bool { // 进行从小到大排序
+	sort.Slice(ss, func(i, j int) bool { // 进行从小到大排序，按固定的顺序加入，不同客户端的hash结果才一致
 		return ss[i] < ss[j]
 	})
-	for _, k := range c.servers {
-		if servers[k] == "" {
-			c.h.Remove(k)
-		}
+	for _, k := range ss {
+		c.h.Add(k) // 已经存在的服务器不会重复添加
 	}
 	c.servers = ss
 }
@@ -0,0 +1,341 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var selectModes = map[string]SelectMode{
+	"Random":                    RandomSelect,
+	"RoundRobin":                RoundRobin,
+	"WeightedRoundRobin":        WeightedRoundRobin,
+	"ConsistentHash":            ConsistentHash,
+	"BoundedLoadConsistentHash": BoundedLoadConsistentHash,
+	"Closest":                   Closest,
+	"ClosestP2C":                ClosestP2C,
+}
+
+// n台服务器，元数据中带上权重
+func testServers(n int) map[string]string {
+	servers := make(map[string]string, n)
+	for i := 0; i < n; i++ {
+		servers["tcp@127.0.0.1:"+strconv.Itoa(8000+i)] = "weight=" + strconv.Itoa(i+1)
+	}
+	return servers
+}
+
+// 并发选择服务器的同时不停地更新服务器列表，选出来的服务器必须是某一次列表中的（配合-race检查数据竞争）
+func TestSelectorsConcurrentSelectAndUpdate(t *testing.T) {
+	small, large := testServers(3), testServers(10)
+
+	for name, mode := range selectModes {
+		mode := mode
+		t.Run(name, func(t *testing.T) {
+			s := newSelector(mode, small)
+			stop := make(chan struct{})
+			var wg sync.WaitGroup
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; ; i++ {
+					select {
+					case <-stop:
+						return
+					default:
+					}
+					if i%2 == 0 {
+						s.UpdateServer(large)
+					} else {
+						s.UpdateServer(small)
+					}
+				}
+			}()
+
+			errs := make(chan string, 8)
+			for g := 0; g < 8; g++ {
+				wg.Add(1)
+				go func(g int) {
+					defer wg.Done()
+					for i := 0; i < 1000; i++ {
+						ctx := WithHashKey(context.Background(), fmt.Sprintf("%d-%d", g, i))
+						server := s.Select(ctx, "Arith", "Mul", nil)
+						if observer, ok := s.(LoadObserver); ok {
+							observer.CallStart(server)
+							observer.CallDone(server)
+						}
+						if observer, ok := s.(LatencyObserver); ok {
+							observer.ObserveLatency(server, time.Duration(i)*time.Microsecond, nil)
+						}
+						if _, ok := large[server]; !ok {
+							errs <- server
+							return
+						}
+					}
+				}(g)
+			}
+
+			time.Sleep(10 * time.Millisecond)
+			close(stop)
+			wg.Wait()
+			close(errs)
+			for server := range errs {
+				t.Fatalf("选出了不存在的服务器: %q", server)
+			}
+		})
+	}
+}
+
+// nginx的平滑加权轮询：权重5、1、1时每7次的顺序是a a b a c a a
+func TestWeightedRoundRobinSmooth(t *testing.T) {
+	s := newSelector(WeightedRoundRobin, map[string]string{
+		"a": "weight=5",
+		"b": "weight=1",
+		"c": "weight=1",
+	})
+
+	var seq []string
+	for i := 0; i < 14; i++ {
+		seq = append(seq, s.Select(context.Background(), "Arith", "Mul", nil))
+	}
+	if got, want := strings.Join(seq, " "), "a a b a c a a a a b a c a a"; got != want {
+		t.Fatalf("平滑加权轮询的顺序不正确\n实际: %s\n期望: %s", got, want)
+	}
+}
+
+// 选中的次数严格按照权重的比例
+func TestWeightedRoundRobinDistribution(t *testing.T) {
+	servers := testServers(5)
+	s := newSelector(WeightedRoundRobin, servers)
+
+	totalWeight := 0
+	for i := 1; i <= len(servers); i++ {
+		totalWeight += i
+	}
+	rounds := 100
+	counts := make(map[string]int)
+	for i := 0; i < totalWeight*rounds; i++ {
+		counts[s.Select(context.Background(), "Arith", "Mul", nil)]++
+	}
+
+	for server, meta := range servers {
+		weight, _ := strconv.Atoi(strings.TrimPrefix(meta, "weight="))
+		if counts[server] != weight*rounds {
+			t.Fatalf("服务器%s权重为%d，应该被选中%d次，实际为%d次", server, weight, weight*rounds, counts[server])
+		}
+	}
+
+	// 更新服务器列表之后仍然按照新的权重分配
+	s.UpdateServer(map[string]string{"a": "weight=3", "b": "weight=1"})
+	counts = make(map[string]int)
+	for i := 0; i < 400; i++ {
+		counts[s.Select(context.Background(), "Arith", "Mul", nil)]++
+	}
+	if counts["a"] != 300 || counts["b"] != 100 {
+		t.Fatalf("更新服务器列表之后的分配不正确: %v", counts)
+	}
+}
+
+// 一致性hash：同样的key总是选到同一台服务器，不同的客户端结果一致，增减服务器只影响少部分key
+func TestConsistentHashStability(t *testing.T) {
+	servers := testServers(10)
+	s1 := newSelector(ConsistentHash, servers)
+	s2 := newSelector(ConsistentHash, servers)
+
+	keys := 1000
+	selected := make(map[string]string, keys)
+	for i := 0; i < keys; i++ {
+		key := "user-" + strconv.Itoa(i)
+		ctx := WithHashKey(context.Background(), key)
+		server := s1.Select(ctx, "Arith", "Mul", nil)
+		if again := s1.Select(ctx, "Arith", "Mul", nil); again != server {
+			t.Fatalf("同一个key选到了不同的服务器: %s %s", server, again)
+		}
+		if other := s2.Select(ctx, "Arith", "Mul", nil); other != server {
+			t.Fatalf("不同的客户端对同一个key选到了不同的服务器: %s %s", server, other)
+		}
+		selected[key] = server
+	}
+
+	// 下线一台服务器，只有原来在这台服务器上的key会换服务器
+	removed := "tcp@127.0.0.1:8003"
+	fewer := testServers(10)
+	delete(fewer, removed)
+	s1.UpdateServer(fewer)
+	for key, server := range selected {
+		now := s1.Select(WithHashKey(context.Background(), key), "Arith", "Mul", nil)
+		if server != removed && now != server {
+			t.Fatalf("下线其他服务器之后key %s从%s换到了%s", key, server, now)
+		}
+		if now == removed {
+			t.Fatalf("key %s还是选到了下线的服务器", key)
+		}
+	}
+
+	// 增加一台服务器，换服务器的key只能换到新的服务器上，并且数量在1/11左右
+	more := testServers(11)
+	s2.UpdateServer(more)
+	added := "tcp@127.0.0.1:8010"
+	moved := 0
+	for key, server := range selected {
+		now := s2.Select(WithHashKey(context.Background(), key), "Arith", "Mul", nil)
+		if now == server {
+			continue
+		}
+		if now != added {
+			t.Fatalf("增加服务器之后key %s从%s换到了%s", key, server, now)
+		}
+		moved++
+	}
+	if expect := keys / 11; moved == 0 || math.Abs(float64(moved-expect)) > float64(expect) {
+		t.Fatalf("增加服务器之后换服务器的key数量为%d，期望在%d左右", moved, expect)
+	}
+}
+
+// 有负载上限的一致性hash：热点key的请求不会超过平均负载的boundedLoadFactor倍
+func TestBoundedLoadConsistentHash(t *testing.T) {
+	servers := testServers(4)
+	s := newSelector(BoundedLoadConsistentHash, servers)
+	observer := s.(LoadObserver)
+
+	ctx := WithHashKey(context.Background(), "hot")
+	loads := make(map[string]int)
+	total := 100
+	for i := 0; i < total; i++ { // 请求一直不结束，负载不断累加
+		server := s.Select(ctx, "Arith", "Mul", nil)
+		observer.CallStart(server)
+		loads[server]++
+	}
+
+	capacity := int(math.Ceil(float64(total) * boundedLoadFactor / float64(len(servers))))
+	for server, load := range loads {
+		if load > capacity {
+			t.Fatalf("服务器%s的负载%d超过了上限%d", server, load, capacity)
+		}
+	}
+	if len(loads) < 2 {
+		t.Fatalf("热点key应该溢出到其他服务器: %v", loads)
+	}
+}
+
+// 轮询的顺序固定，新建和更新服务器列表之后都按服务器排序
+func TestRoundRobinOrder(t *testing.T) {
+	s := newSelector(RoundRobin, map[string]string{"c": "", "a": "", "b": ""})
+	var seq []string
+	for i := 0; i < 6; i++ {
+		seq = append(seq, s.Select(context.Background(), "Arith", "Mul", nil))
+	}
+	if got, want := strings.Join(seq, " "), "a b c a b c"; got != want {
+		t.Fatalf("轮询的顺序不正确\n实际: %s\n期望: %s", got, want)
+	}
+
+	s.UpdateServer(map[string]string{"e": "", "d": ""})
+	seq = seq[:0]
+	for i := 0; i < 4; i++ {
+		seq = append(seq, s.Select(context.Background(), "Arith", "Mul", nil))
+	}
+	if got := strings.Join(seq, " "); got != "d e d e" && got != "e d e d" { // 轮询的位置接着更新之前的
+		t.Fatalf("更新服务器列表之后轮询的顺序不正确: %s", got)
+	}
+}
+
+// 下线的服务器上报的延迟直接忽略，不会重新出现在延迟记录中
+func TestClosestIgnoresRemovedServers(t *testing.T) {
+	s := newSelector(Closest, map[string]string{"a": "", "b": ""}).(*closestSelector)
+	s.ObserveLatency("a", time.Millisecond, nil)
+	s.ObserveLatency("b", time.Millisecond, nil)
+
+	s.UpdateServer(map[string]string{"a": ""})
+	s.ObserveLatency("b", time.Millisecond, nil) // 下线之前发出的调用结束了
+	s.ObserveLatency("c", time.Millisecond, nil) // 从来没有上线过的服务器
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if len(s.latency) != 1 {
+		t.Fatalf("只应该保留在线服务器的延迟: %v", s.latency)
+	}
+}
+
+// 按租户路由的请求参数
+type tenantArgs struct {
+	Tenant string
+	N      int
+}
+
+func (a *tenantArgs) HashKey() string {
+	return a.Tenant
+}
+
+// WithHashKey和Hashable决定一致性hash的key：同一个key总是选到同一台服务器，和请求参数的其他内容无关
+func TestConsistentHashKey(t *testing.T) {
+	s := newSelector(ConsistentHash, testServers(10))
+	selectWith := func(ctx context.Context, args interface{}) string {
+		return s.Select(ctx, "Arith", "Mul", args)
+	}
+
+	spread := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		tenant := "tenant-" + strconv.Itoa(i)
+		ctx := WithHashKey(context.Background(), tenant)
+		server := selectWith(ctx, &ArithArgs{A: i})
+		spread[server] = true
+
+		// WithHashKey优先于请求参数
+		if other := selectWith(ctx, &tenantArgs{Tenant: "other", N: i}); other != server {
+			t.Fatalf("设置了WithHashKey时应该忽略请求参数: %s %s", server, other)
+		}
+		// Hashable只使用HashKey()，和用同样的值调用WithHashKey结果一致
+		if other := selectWith(context.Background(), &tenantArgs{Tenant: tenant, N: i + 1}); other != server {
+			t.Fatalf("Hashable的key相同时应该选到同一台服务器: %s %s", server, other)
+		}
+	}
+	if len(spread) < 2 {
+		t.Fatalf("不同的key应该分散到不同的服务器: %v", spread)
+	}
+}
+
+func benchmarkSelector(b *testing.B, mode SelectMode) {
+	s := newSelector(mode, testServers(10))
+	ctx := WithHashKey(context.Background(), "user-1")
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			s.Select(ctx, "Arith", "Mul", nil)
+		}
+	})
+}
+
+func BenchmarkRandomSelector(b *testing.B) {
+	benchmarkSelector(b, RandomSelect)
+}
+
+func BenchmarkRoundRobinSelector(b *testing.B) {
+	benchmarkSelector(b, RoundRobin)
+}
+
+func BenchmarkWeightedRoundRobinSelector(b *testing.B) {
+	benchmarkSelector(b, WeightedRoundRobin)
+}
+
+func BenchmarkConsistentHashSelector(b *testing.B) {
+	benchmarkSelector(b, ConsistentHash)
+}
+
+func BenchmarkBoundedLoadConsistentHashSelector(b *testing.B) {
+	benchmarkSelector(b, BoundedLoadConsistentHash)
+}
+
+func BenchmarkClosestSelector(b *testing.B) {
+	benchmarkSelector(b, Closest)
+}
+
+func BenchmarkClosestP2CSelector(b *testing.B) {
+	benchmarkSelector(b, ClosestP2C)
+}
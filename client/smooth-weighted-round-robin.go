@@ -2,7 +2,7 @@ package client
 
 type Weighted struct {
 	Server          string // 服务地址
-	Weight          int    // todo 权重(暂时无用)
+	Weight          int    // 权重（来自服务发现元数据中的weight）
 	CurrentWeight   int    // 当前权重
 	EffectiveWeight int    // 有效权重
 }
@@ -17,7 +17,7 @@ func nextWeighted(servers []*Weighted) *Weighted {
 		}
 
 		w.CurrentWeight += w.EffectiveWeight
-		total += w.CurrentWeight
+		total += w.EffectiveWeight
 
 		if best == nil || w.CurrentWeight > best.CurrentWeight {
 			best = w
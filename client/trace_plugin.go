@@ -0,0 +1,200 @@
+package client
+
+import (
+	"avrilko-rpc/protocol"
+	"avrilko-rpc/share"
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const traceCallKey = "__trace_call" // PreCall写到请求元数据中的调用编号，打包数据前通过它找到调用的父span，发送之前会删掉
+
+var traceCallIDKey = share.ContextKey("__trace_call_id")
+
+var errNoResponse = errors.New("没有收到响应")
+
+// 一次XClient调用（包括重试）发出的请求的span
+type traceCall struct {
+	parent share.SpanContext
+	start  time.Time
+	spans  []*share.Span
+}
+
+// 直接使用Client（或者SendRaw）发出的请求，收到响应时通过它找到对应的span
+type traceRequest struct {
+	seq           uint64
+	servicePath   string
+	serviceMethod string
+}
+
+// 链路追踪插件，打包数据前开始客户端span并把W3C的traceparent/tracestate写入请求元数据，每个发出的请求都会带上
+// XClient的调用在PreCall中从上下文的share.SpanContextKey取父span（服务端的链路追踪插件处理请求时会放进去），调用结束后（PostCall）结束span；
+// 直接使用Client时父span从请求元数据的traceparent中取，没有则开始新的trace，收到响应后结束span
+// 只导出被采样的span，采样标记跟着父span传递
+type TracePlugin struct {
+	Exporter share.SpanExporter
+	Timeout  time.Duration // 超过这个时间还没有结束的span（比如没有收到响应）以错误结束，默认一分钟
+
+	callID uint64
+
+	mu        sync.Mutex
+	calls     map[string]*traceCall
+	requests  map[traceRequest]*share.Span
+	lastSweep time.Time
+}
+
+func NewTracePlugin(exporter share.SpanExporter) *TracePlugin {
+	return &TracePlugin{
+		Exporter:  exporter,
+		Timeout:   time.Minute,
+		calls:     make(map[string]*traceCall),
+		requests:  make(map[traceRequest]*share.Span),
+		lastSweep: time.Now(),
+	}
+}
+
+// 记下调用的父span，并把调用编号写到请求元数据中
+func (p *TracePlugin) PreCall(ctx context.Context, servicePath, serviceMethod string, request interface{}) error {
+	sctx, ok := ctx.(*share.Context)
+	if !ok {
+		return nil
+	}
+
+	id := strconv.FormatUint(atomic.AddUint64(&p.callID, 1), 10)
+	parent, _ := ctx.Value(share.SpanContextKey).(share.SpanContext)
+
+	// 不能修改调用方的元数据，复制一份再写入
+	meta := make(map[string]string)
+	if reqMeta, ok := ctx.Value(share.ReqMetaDataKey).(map[string]string); ok {
+		for k, v := range reqMeta {
+			meta[k] = v
+		}
+	}
+	meta[traceCallKey] = id
+	share.WithLocalValue(sctx, share.ReqMetaDataKey, meta)
+	share.WithLocalValue(sctx, traceCallIDKey, id)
+
+	p.mu.Lock()
+	p.calls[id] = &traceCall{parent: parent, start: time.Now()}
+	p.mu.Unlock()
+	return nil
+}
+
+// 调用结束，结束调用发出的所有请求的span
+func (p *TracePlugin) PostCall(ctx context.Context, servicePath, serviceMethod string, request, response interface{}, err error) error {
+	id, ok := ctx.Value(traceCallIDKey).(string)
+	if !ok {
+		return nil
+	}
+
+	p.mu.Lock()
+	call := p.calls[id]
+	delete(p.calls, id)
+	p.mu.Unlock()
+	if call != nil {
+		p.export(err, call.spans...)
+	}
+	return nil
+}
+
+// 开始客户端span，把span写入请求元数据
+func (p *TracePlugin) ClientBeforeEncode(message *protocol.Message) error {
+	// 元数据可能是调用方的，复制一份再写入
+	meta := make(map[string]string, len(message.Metadata)+2)
+	for k, v := range message.Metadata {
+		meta[k] = v
+	}
+	id, fromCall := meta[traceCallKey]
+	delete(meta, traceCallKey)
+
+	now := time.Now()
+	p.mu.Lock()
+	expired := p.sweep(now)
+	var call *traceCall
+	if fromCall {
+		call = p.calls[id]
+	}
+
+	parent, _ := share.ExtractSpanContext(meta)
+	if call != nil && call.parent.IsValid() {
+		parent = call.parent
+	}
+	span := share.StartSpan(message.ServicePath+"."+message.ServiceMethod, share.SpanKindClient, parent)
+	share.InjectSpanContext(meta, span.SpanContext)
+	message.Metadata = meta
+
+	finished := false
+	if span.SpanContext.IsSampled() {
+		switch {
+		case call != nil:
+			call.spans = append(call.spans, span)
+		case message.IsOneway(): // 服务端不会回复，发出去就结束
+			finished = true
+		default:
+			p.requests[traceRequest{seq: message.Seq(), servicePath: message.ServicePath, serviceMethod: message.ServiceMethod}] = span
+		}
+	}
+	p.mu.Unlock()
+
+	p.export(errNoResponse, expired...)
+	if finished {
+		p.export(nil, span)
+	}
+	return nil
+}
+
+// 收到直接使用Client发出的请求的响应，结束span
+func (p *TracePlugin) ClientAfterDecode(message *protocol.Message) error {
+	key := traceRequest{seq: message.Seq(), servicePath: message.ServicePath, serviceMethod: message.ServiceMethod}
+	p.mu.Lock()
+	span, ok := p.requests[key]
+	delete(p.requests, key)
+	p.mu.Unlock()
+	if !ok {
+		return nil
+	}
+
+	var err error
+	if message.MessageStatusType() == protocol.Error {
+		err = errors.New(message.Metadata[protocol.ServiceError])
+	}
+	p.export(err, span)
+	return nil
+}
+
+// 移除超时没有结束的span（需要持有锁），最多每Timeout检查一次
+func (p *TracePlugin) sweep(now time.Time) []*share.Span {
+	if now.Sub(p.lastSweep) < p.Timeout {
+		return nil
+	}
+	p.lastSweep = now
+
+	var expired []*share.Span
+	for k, span := range p.requests {
+		if now.Sub(span.Start) >= p.Timeout {
+			expired = append(expired, span)
+			delete(p.requests, k)
+		}
+	}
+	for id, call := range p.calls {
+		if now.Sub(call.start) >= p.Timeout {
+			expired = append(expired, call.spans...)
+			delete(p.calls, id)
+		}
+	}
+	return expired
+}
+
+// 结束span并交给导出者
+func (p *TracePlugin) export(err error, spans ...*share.Span) {
+	for _, span := range spans {
+		span.Finish(err)
+		if p.Exporter != nil {
+			p.Exporter.ExportSpan(span)
+		}
+	}
+}
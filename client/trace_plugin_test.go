@@ -0,0 +1,43 @@
+package client
+
+import (
+	"avrilko-rpc/protocol"
+	"avrilko-rpc/share"
+	"testing"
+	"time"
+)
+
+// 没有收到响应的span超时后以错误结束，不会一直留在插件里
+func TestTracePluginTimeout(t *testing.T) {
+	exporter := share.NewMemoryExporter()
+	p := NewTracePlugin(exporter)
+	p.Timeout = 20 * time.Millisecond
+
+	send := func(seq uint64) {
+		request := protocol.GetPooledMsg()
+		defer protocol.FreeMsg(request)
+		request.SetMessageType(protocol.Request)
+		request.SetSeq(seq)
+		request.ServicePath, request.ServiceMethod = "Arith", "Mul"
+		if err := p.ClientBeforeEncode(request); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := share.ExtractSpanContext(request.Metadata); !ok {
+			t.Fatal("请求没有带上traceparent")
+		}
+	}
+
+	send(1)
+	time.Sleep(2 * p.Timeout)
+	send(2)
+
+	spans := exporter.Spans()
+	if len(spans) != 1 || spans[0].Err != errNoResponse.Error() {
+		t.Fatalf("超时的span应该以错误结束并导出，实际为%v", spans)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.requests) != 1 {
+		t.Fatalf("只应该剩下没有超时的请求，实际为%d个", len(p.requests))
+	}
+}
@@ -1,14 +1,41 @@
 package client
 
 import (
+	"avrilko-rpc/log"
 	"avrilko-rpc/protocol"
+	"avrilko-rpc/share"
 	"context"
+	"errors"
+	"fmt"
 	"golang.org/x/sync/singleflight"
 	"io"
+	"net"
 	"net/url"
+	"reflect"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 )
 
+var (
+	ErrXClientShutdown = errors.New("xClient已经关闭")
+	ErrXClientNoServer = errors.New("没有可用的服务器")
+)
+
+// 多个错误合并在一起（同时操作多个服务器时使用）
+type MultiError struct {
+	Errors []error
+}
+
+func (e *MultiError) Error() string {
+	errs := make([]string, 0, len(e.Errors))
+	for _, err := range e.Errors {
+		errs = append(errs, err.Error())
+	}
+	return strings.Join(errs, "; ")
+}
+
 // key value 键值对
 type KVPair struct {
 	Key   string
@@ -64,52 +91,732 @@ type xClient struct {
 	serverMessageChan chan<- *protocol.Message // 消息通道
 }
 
+// 设置插件容器（之后新建的连接也会使用这个容器）
 func (c *xClient) SetPlugins(plugins PluginContainer) {
-	panic("implement me")
+	c.Plugins = plugins
 }
 
 func (c *xClient) GetPlugin() PluginContainer {
-	panic("implement me")
+	return c.Plugins
 }
 
+// 设置自定义的负载均衡算法（SelectByUser模式下必须调用）
 func (c *xClient) SetSelector(s Selector) {
-	panic("implement me")
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s.UpdateServer(c.servers)
+	c.selector = s
 }
 
+// 设置鉴权信息，每次调用都会放到元数据中带给服务端
 func (c *xClient) Auth(auth string) {
-	panic("implement me")
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.auth = auth
 }
 
+// 选一台服务器异步调用（不会重试），和Call一样调用前后执行插件并上报调用结果，都完成之后才通知done
 func (c *xClient) Go(ctx context.Context, serviceMethod string, request interface{}, response interface{}, done chan *Call) (*Call, error) {
-	panic("implement me")
+	if c.closed() {
+		return nil, ErrXClientShutdown
+	}
+
+	ctx = c.prepareContext(ctx)
+	k, client, err := c.selectClient(ctx, serviceMethod, request, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.Plugins != nil {
+		ctx = share.NewContext(ctx) // 每次调用使用单独的上下文，插件往里面放值不会影响并发的其他调用
+		if err := c.Plugins.DoPreCall(ctx, c.servicePath, serviceMethod, request); err != nil {
+			return nil, err
+		}
+	}
+
+	if done == nil {
+		done = make(chan *Call, 10)
+	} else if cap(done) == 0 { // 无缓冲的通道会阻塞通知协程
+		log.Panic("rpc: done通道必须是有缓冲的")
+	}
+	call := &Call{
+		ServicePath:   c.servicePath,
+		ServiceMethod: serviceMethod,
+		request:       request,
+		response:      response,
+		Done:          done,
+	}
+	if meta, ok := ctx.Value(share.ReqMetaDataKey).(map[string]string); ok {
+		call.Metadata = meta
+	}
+
+	// 底层客户端完成之后先上报结果、执行插件，再把结果交给调用方
+	start := c.callStart(k)
+	inner := client.Go(ctx, c.servicePath, serviceMethod, request, response, make(chan *Call, 1))
+	go func() {
+		<-inner.Done
+		c.callDone(k, start, inner.Error)
+		call.Error = inner.Error
+		call.ResMetadata = inner.ResMetadata
+		if c.Plugins != nil {
+			if pErr := c.Plugins.DoPostCall(ctx, c.servicePath, serviceMethod, request, response, call.Error); pErr != nil && call.Error == nil {
+				call.Error = pErr
+			}
+		}
+		call.done()
+	}()
+	return call, nil
 }
 
+// 同步调用，失败之后按照failMode处理
 func (c *xClient) Call(ctx context.Context, serviceMethod string, request interface{}, response interface{}) error {
-	panic("implement me")
+	if c.closed() {
+		return ErrXClientShutdown
+	}
+
+	ctx = c.prepareContext(ctx)
+	k, client, err := c.selectClient(ctx, serviceMethod, request, nil)
+	if err != nil && c.failMode == Failfast {
+		return err
+	}
+
+	switch c.failMode {
+	case Failtry: // 一直使用当前的服务器重试
+		retries := c.option.Retries
+		for retries >= 0 {
+			retries--
+			if client != nil {
+				err = c.wrapCall(ctx, k, client, serviceMethod, request, response)
+				if err == nil || !canRetry(err) {
+					return err
+				}
+				if isConnError(client, err) {
+					c.removeClient(k, client)
+				}
+			}
+			if k == "" {
+				return err
+			}
+			var connErr error // 重试次数用完时返回最后一次调用的错误，不能被重新获取客户端的结果覆盖
+			if client, connErr = c.getCachedClient(k); connErr != nil {
+				err = connErr
+			}
+		}
+		return err
+
+	case Failover: // 换一台服务器重试（这次调用已经试过的服务器不会再选）
+		retries := c.option.Retries
+		tried := make(map[string]bool)
+		for retries >= 0 {
+			retries--
+			if client != nil {
+				err = c.wrapCall(ctx, k, client, serviceMethod, request, response)
+				if err == nil || !canRetry(err) {
+					return err
+				}
+				if isConnError(client, err) {
+					c.removeClient(k, client)
+				}
+			}
+			if k != "" {
+				tried[k] = true
+			}
+
+			var selectErr error
+			k, client, selectErr = c.selectClient(ctx, serviceMethod, request, tried)
+			if selectErr != nil {
+				if k == "" && err != nil { // 没有其他服务器可以试了，返回上一次调用的错误
+					return err
+				}
+				err = selectErr
+			}
+		}
+		return err
+
+	case Failbackup: // 一段时间没有返回就再找一台服务器，谁先返回用谁的
+		if err != nil {
+			return err
+		}
+		return c.backupCall(ctx, k, client, serviceMethod, request, response)
+
+	default: // Failfast
+		err = c.wrapCall(ctx, k, client, serviceMethod, request, response)
+		if err != nil && isConnError(client, err) {
+			c.removeClient(k, client)
+		}
+		return err
+	}
+}
+
+// Failbackup模式：先发给一台服务器，BackupLatency之后还没有返回（或者在这之前就失败了）就再发给另外一台，取先成功的返回
+func (c *xClient) backupCall(ctx context.Context, k string, client RPCClient, serviceMethod string, request, response interface{}) error {
+	if c.Plugins != nil {
+		ctx = share.NewContext(ctx) // 每次调用使用单独的上下文，插件往里面放值不会影响并发的其他调用
+		if err := c.Plugins.DoPreCall(ctx, c.servicePath, serviceMethod, request); err != nil {
+			return err
+		}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		response interface{}
+		err      error
+	}
+	done := make(chan result, 2)
+	send := func(k string, client RPCClient) {
+		// 两次请求不能共用同一个response，否则会相互覆盖
+		var r interface{}
+		if response != nil {
+			r = reflect.New(reflect.ValueOf(response).Elem().Type()).Interface()
+		}
+		start := c.callStart(k)
+		err := client.Call(ctx, c.servicePath, serviceMethod, request, r)
+		c.callDone(k, start, err)
+		done <- result{response: r, err: err}
+	}
+
+	go send(k, client)
+	sent := 1
+
+	timer := time.NewTimer(c.option.BackupLatency)
+	defer timer.Stop()
+
+	// 备份请求只发一次，发给第一台以外的服务器
+	backupSent := false
+	sendBackup := func() {
+		backupSent = true
+		timer.Stop()
+		if backupK, backupClient, e := c.selectClient(ctx, serviceMethod, request, map[string]bool{k: true}); e == nil {
+			go send(backupK, backupClient)
+			sent++
+		}
+	}
+
+	var err error
+	for sent > 0 {
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+			sent = 0
+		case <-timer.C: // 到时间了还没有返回，再找一台服务器
+			if !backupSent {
+				sendBackup()
+			}
+		case res := <-done:
+			sent--
+			err = res.err
+			if err == nil {
+				if response != nil {
+					reflect.ValueOf(response).Elem().Set(reflect.ValueOf(res.response).Elem())
+				}
+				sent = 0
+			} else if !backupSent && canRetry(err) { // 第一台在BackupLatency之前就失败了，不用等直接发备份请求
+				sendBackup()
+			}
+		}
+	}
+
+	if c.Plugins != nil {
+		if pErr := c.Plugins.DoPostCall(ctx, c.servicePath, serviceMethod, request, response, err); pErr != nil && err == nil {
+			err = pErr
+		}
+	}
+	return err
 }
 
+// 并发调用所有的服务器，全部成功才返回nil，否则返回所有失败的错误
+// response为第一个成功返回的数据
 func (c *xClient) Broadcast(ctx context.Context, serviceMethod string, request interface{}, response interface{}) error {
-	panic("implement me")
+	return c.fanOut(ctx, serviceMethod, request, response, false)
 }
 
+// 并发调用所有的服务器，有一台成功就返回并取消其它调用，全部失败才返回错误
 func (c *xClient) Fork(ctx context.Context, serviceMethod string, request interface{}, response interface{}) error {
-	panic("implement me")
+	return c.fanOut(ctx, serviceMethod, request, response, true)
 }
 
-func (c *xClient) SendRaw(ctx context.Context, r *protocol.Message) (map[string]string, []byte, error) {
-	panic("implement me")
+// 并发调用所有的服务器，returnOnFirst为true时第一个成功的返回就结束
+func (c *xClient) fanOut(ctx context.Context, serviceMethod string, request interface{}, response interface{}, returnOnFirst bool) error {
+	if c.closed() {
+		return ErrXClientShutdown
+	}
+
+	ctx = c.prepareContext(ctx)
+	clients, errs := c.allClients()
+	if len(clients) == 0 {
+		if len(errs) > 0 {
+			return &MultiError{Errors: errs}
+		}
+		return ErrXClientNoServer
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel() // 返回之后取消还没有完成的调用
+
+	var mu sync.Mutex
+	replied := false
+	done := make(chan error, len(clients))
+	for k, client := range clients {
+		go func(k string, client RPCClient) {
+			// 每台服务器使用单独的response，成功之后再拷贝给调用方
+			var r interface{}
+			if response != nil {
+				r = reflect.New(reflect.ValueOf(response).Elem().Type()).Interface()
+			}
+
+			err := c.wrapCall(ctx, k, client, serviceMethod, request, r)
+			if err != nil {
+				if isConnError(client, err) && ctx.Err() == nil {
+					c.removeClient(k, client)
+				}
+				done <- fmt.Errorf("%s: %w", k, err)
+				return
+			}
+
+			mu.Lock()
+			if !replied && response != nil {
+				reflect.ValueOf(response).Elem().Set(reflect.ValueOf(r).Elem())
+			}
+			replied = true
+			mu.Unlock()
+			done <- nil
+		}(k, client)
+	}
+
+	for i := 0; i < len(clients); i++ {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case err := <-done:
+			if err == nil {
+				if returnOnFirst {
+					return nil
+				}
+				continue
+			}
+			errs = append(errs, err)
+		}
+	}
+
+	if len(errs) > 0 {
+		return &MultiError{Errors: errs}
+	}
+	return nil
 }
 
-func (c *xClient) SendFile(ctx context.Context, fileName string, rateInBytesPerSecond int64) error {
-	panic("implement me")
+// 发送原始数据，Failfast以外的模式都会换一台服务器重试
+func (c *xClient) SendRaw(ctx context.Context, r *protocol.Message) (map[string]string, []byte, error) {
+	if c.closed() {
+		return nil, nil, ErrXClientShutdown
+	}
+
+	if auth := c.getAuth(); auth != "" { // 不能修改调用方的元数据
+		meta := make(map[string]string, len(r.Metadata)+1)
+		for k, v := range r.Metadata {
+			meta[k] = v
+		}
+		meta[share.AuthKey] = auth
+		r.Metadata = meta
+	}
+
+	// 和Call一样调用前后执行插件（重试不会重复执行），请求和返回值是原始的payload
+	if c.Plugins != nil {
+		ctx = share.NewContext(ctx)
+		if err := c.Plugins.DoPreCall(ctx, r.ServicePath, r.ServiceMethod, r.Payload); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	meta, payload, err := c.sendRaw(ctx, r)
+
+	if c.Plugins != nil {
+		if pErr := c.Plugins.DoPostCall(ctx, r.ServicePath, r.ServiceMethod, r.Payload, payload, err); pErr != nil && err == nil {
+			err = pErr
+		}
+	}
+	return meta, payload, err
 }
 
-func (c *xClient) DownloadFile(ctx context.Context, requestFileName string, saveTo io.Writer) error {
-	panic("implement me")
+// 发送原始数据，失败之后按照failMode重试
+func (c *xClient) sendRaw(ctx context.Context, r *protocol.Message) (map[string]string, []byte, error) {
+	retries := c.option.Retries
+	if c.failMode == Failfast {
+		retries = 0
+	}
+
+	var err error
+	for retries >= 0 {
+		retries--
+		var k string
+		var client RPCClient
+		k, client, err = c.selectClient(ctx, r.ServiceMethod, r.Payload, nil)
+		if err != nil {
+			continue
+		}
+
+		var meta map[string]string
+		var payload []byte
+		start := c.callStart(k)
+		meta, payload, err = client.SendRaw(ctx, r)
+		c.callDone(k, start, err)
+		if err == nil || !canRetry(err) {
+			return meta, payload, err
+		}
+		if isConnError(client, err) {
+			c.removeClient(k, client)
+		}
+	}
+	return nil, nil, err
 }
 
+// 关闭所有连接，并停止监听服务发现
 func (c *xClient) Close() error {
-	panic("implement me")
+	c.mu.Lock()
+	if c.isShutdown {
+		c.mu.Unlock()
+		return ErrXClientShutdown
+	}
+	c.isShutdown = true
+
+	var errs []error
+	for k, client := range c.cachedClient {
+		if err := client.Close(); err != nil && err != ErrShutdown {
+			errs = append(errs, err)
+		}
+		delete(c.cachedClient, k)
+	}
+	c.mu.Unlock()
+
+	if c.ch != nil { // 先从服务发现中移除再关闭，防止往关闭的通道中写数据
+		c.discovery.RemoveService(c.ch)
+		close(c.ch)
+	}
+
+	if len(errs) > 0 {
+		return &MultiError{Errors: errs}
+	}
+	return nil
+}
+
+// 是否已经关闭
+func (c *xClient) closed() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.isShutdown
+}
+
+// 获取鉴权信息（Auth可能和调用并发执行）
+func (c *xClient) getAuth() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.auth
+}
+
+// 调用前处理上下文：插件需要往上下文里写数据，统一转换为share.Context，并带上鉴权信息
+func (c *xClient) prepareContext(ctx context.Context) context.Context {
+	if auth := c.getAuth(); auth != "" { // 不能修改调用方的元数据
+		meta := make(map[string]string)
+		if reqMeta, ok := ctx.Value(share.ReqMetaDataKey).(map[string]string); ok {
+			for k, v := range reqMeta {
+				meta[k] = v
+			}
+		}
+		meta[share.AuthKey] = auth
+		return share.WithValue(ctx, share.ReqMetaDataKey, meta)
+	}
+
+	if _, ok := ctx.(*share.Context); !ok {
+		return share.NewContext(ctx)
+	}
+	return ctx
+}
+
+// 获取所有服务器的客户端，连接失败的服务器返回对应的错误
+func (c *xClient) allClients() (map[string]RPCClient, []error) {
+	c.mu.RLock()
+	servers := make([]string, 0, len(c.servers))
+	for k := range c.servers {
+		servers = append(servers, k)
+	}
+	c.mu.RUnlock()
+
+	clients := make(map[string]RPCClient, len(servers))
+	var errs []error
+	for _, k := range servers {
+		if breaker := c.getBreaker(k); breaker != nil && !breaker.Ready() {
+			errs = append(errs, fmt.Errorf("%s: %w", k, ErrBreakerOpen))
+			continue
+		}
+
+		client, err := c.getCachedClient(k)
+		if err != nil { // 只上报连接失败，连接成功不代表调用成功，也没有测量到延迟
+			c.report(k, 0, err)
+			errs = append(errs, fmt.Errorf("%s: %w", k, err))
+			continue
+		}
+		clients[k] = client
+	}
+	return clients, errs
+}
+
+// 选出一台服务器并拿到它的客户端，熔断器打开的服务器和exclude中的服务器会被跳过（最多重新选服务器数量次）
+func (c *xClient) selectClient(ctx context.Context, serviceMethod string, request interface{}, exclude map[string]bool) (string, RPCClient, error) {
+	c.mu.RLock()
+	n := len(c.servers)
+	c.mu.RUnlock()
+
+	breakerOpen := false
+	for i := 0; i <= n; i++ {
+		k := c.selectServer(ctx, serviceMethod, request)
+		if k == "" {
+			return "", nil, ErrXClientNoServer
+		}
+		if exclude[k] {
+			continue
+		}
+
+		if breaker := c.getBreaker(k); breaker != nil && !breaker.Ready() {
+			breakerOpen = true
+			continue
+		}
+
+		return c.connectServer(k)
+	}
+
+	if len(exclude) > 0 { // 负载均衡算法一直选到排除掉的服务器（比如一致性哈希），从剩下的服务器中找一台
+		c.mu.RLock()
+		servers := make([]string, 0, len(c.servers))
+		for k := range c.servers {
+			servers = append(servers, k)
+		}
+		c.mu.RUnlock()
+		sort.Strings(servers)
+
+		for _, k := range servers {
+			if exclude[k] {
+				continue
+			}
+			if breaker := c.getBreaker(k); breaker != nil && !breaker.Ready() {
+				breakerOpen = true
+				continue
+			}
+			return c.connectServer(k)
+		}
+	}
+
+	if breakerOpen {
+		return "", nil, ErrBreakerOpen
+	}
+	return "", nil, ErrXClientNoServer
+}
+
+// 拿到选中的服务器的客户端，连接失败上报给熔断器
+func (c *xClient) connectServer(k string) (string, RPCClient, error) {
+	client, err := c.getCachedClient(k)
+	if err != nil {
+		c.report(k, 0, err)
+	}
+	return k, client, err
+}
+
+// 获取服务器对应的熔断器，没有配置GenBreaker返回nil
+func (c *xClient) getBreaker(k string) Breaker {
+	if c.option.GenBreaker == nil {
+		return nil
+	}
+
+	if breaker, ok := c.breakers.Load(k); ok {
+		return breaker.(Breaker)
+	}
+	breaker, _ := c.breakers.LoadOrStore(k, c.option.GenBreaker())
+	return breaker.(Breaker)
+}
+
+// 调用开始，负载均衡算法实现了LoadObserver时通知它
+func (c *xClient) callStart(k string) time.Time {
+	c.mu.RLock()
+	observer, ok := c.selector.(LoadObserver)
+	c.mu.RUnlock()
+	if ok {
+		observer.CallStart(k)
+	}
+	return time.Now()
+}
+
+// 调用结束，通知LoadObserver并上报调用结果
+func (c *xClient) callDone(k string, start time.Time, err error) {
+	c.mu.RLock()
+	observer, ok := c.selector.(LoadObserver)
+	c.mu.RUnlock()
+	if ok {
+		observer.CallDone(k)
+	}
+	c.report(k, time.Since(start), err)
+}
+
+// 上报一次调用的结果：熔断器记录成功或者失败，负载均衡算法实现了LatencyObserver时记录延迟
+// 业务错误和调用方主动取消不算服务器的问题
+func (c *xClient) report(k string, rtt time.Duration, err error) {
+	if err == context.Canceled { // 调用方不等了（比如Fork中其他服务器已经返回），既不算成功也不算失败，延迟也没有参考价值
+		return
+	}
+
+	_, isServiceError := err.(ServiceError)
+	if breaker := c.getBreaker(k); breaker != nil {
+		if err == nil || isServiceError {
+			breaker.Success()
+		} else {
+			breaker.Fail()
+		}
+	}
+
+	if isServiceError {
+		err = nil
+	}
+	c.observeLatency(k, rtt, err)
+}
+
+// 负载均衡算法实现了LatencyObserver时记录延迟（心跳只记录延迟，不影响熔断器）
+func (c *xClient) observeLatency(k string, rtt time.Duration, err error) {
+	c.mu.RLock()
+	observer, ok := c.selector.(LatencyObserver)
+	c.mu.RUnlock()
+	if ok {
+		observer.ObserveLatency(k, rtt, err)
+	}
+}
+
+// 获取缓存中的客户端，没有或者已经关闭则新建连接（singleflight防止同一个地址同时建立多个连接）
+func (c *xClient) getCachedClient(k string) (RPCClient, error) {
+	c.mu.RLock()
+	client := c.cachedClient[k]
+	c.mu.RUnlock()
+	if client != nil && !client.IsClosing() && !client.IsShutDown() {
+		return client, nil
+	}
+
+	generatedClient, err, _ := c.slGroup.Do(k, func() (interface{}, error) {
+		c.mu.Lock()
+		client := c.cachedClient[k]
+		if client != nil {
+			if !client.IsClosing() && !client.IsShutDown() {
+				c.mu.Unlock()
+				return client, nil
+			}
+			delete(c.cachedClient, k) // 已经断开的连接移除掉
+			client.Close()
+		}
+		c.mu.Unlock()
+
+		network, address := splitNetworkAndAddress(k)
+		newClient := NewClient(c.option)
+		newClient.Plugins = c.Plugins
+		if c.serverMessageChan != nil {
+			newClient.RegisterServerMessageChan(c.serverMessageChan)
+		}
+		newClient.onBroken = func() { // 心跳检测失败，从缓存中移除，下次调用重新建立连接
+			c.removeClient(k, newClient)
+		}
+		newClient.onHeartbeat = func(rtt time.Duration) { // 心跳的延迟也交给负载均衡算法，心跳成功不代表调用成功，不上报给熔断器
+			c.observeLatency(k, rtt, nil)
+		}
+		if err := newClient.Connect(network, address); err != nil {
+			return nil, err
+		}
+
+		c.mu.Lock()
+		c.cachedClient[k] = newClient
+		c.mu.Unlock()
+		return newClient, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return generatedClient.(RPCClient), nil
+}
+
+// 移除并关闭出错的客户端，下次调用会重新建立连接
+func (c *xClient) removeClient(k string, client RPCClient) {
+	c.mu.Lock()
+	if c.cachedClient[k] == client {
+		delete(c.cachedClient, k)
+	}
+	c.mu.Unlock()
+
+	if client != nil {
+		client.Close()
+	}
+}
+
+// 通过负载均衡算法选出一台服务器，插件可以包装选择函数
+func (c *xClient) selectServer(ctx context.Context, serviceMethod string, request interface{}) string {
+	c.mu.RLock()
+	selector := c.selector
+	c.mu.RUnlock()
+	if selector == nil {
+		return ""
+	}
+
+	selectFunc := selector.Select
+	if c.Plugins != nil {
+		selectFunc = c.Plugins.DoWrapSelect(selectFunc)
+	}
+	return selectFunc(ctx, c.servicePath, serviceMethod, request)
+}
+
+// 在单个客户端上发起调用，调用前后执行插件，并将结果上报给熔断器
+func (c *xClient) wrapCall(ctx context.Context, k string, client RPCClient, serviceMethod string, request, response interface{}) error {
+	if c.Plugins != nil {
+		ctx = share.NewContext(ctx) // 每次调用使用单独的上下文，插件往里面放值不会影响并发的其他调用
+		if err := c.Plugins.DoPreCall(ctx, c.servicePath, serviceMethod, request); err != nil {
+			return err
+		}
+	}
+
+	start := c.callStart(k)
+	err := client.Call(ctx, c.servicePath, serviceMethod, request, response)
+	c.callDone(k, start, err)
+
+	if c.Plugins != nil {
+		if pErr := c.Plugins.DoPostCall(ctx, c.servicePath, serviceMethod, request, response, err); pErr != nil && err == nil {
+			err = pErr
+		}
+	}
+	return err
+}
+
+// 服务端返回的业务错误和上下文的错误重试也没有用
+func canRetry(err error) bool {
+	if _, ok := err.(ServiceError); ok {
+		return false
+	}
+	return err != context.Canceled && err != context.DeadlineExceeded
+}
+
+// 连接层面的错误说明客户端已经不能用了，需要移除之后重新建立连接
+// 插件拒绝、编解码失败、熔断器打开之类的错误和连接无关，不能因此断开一个好的连接
+func isConnError(client RPCClient, err error) bool {
+	if client != nil && (client.IsClosing() || client.IsShutDown()) {
+		return true
+	}
+	if errors.Is(err, ErrShutdown) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// 服务地址可以是 network@address 的格式，没有指定网络类型默认使用tcp
+func splitNetworkAndAddress(server string) (string, string) {
+	ss := strings.SplitN(server, "@", 2)
+	if len(ss) == 1 {
+		return "tcp", server
+	}
+
+	return ss[0], ss[1]
 }
 
 func (c *xClient) watch(ch chan []*KVPair) {
@@ -131,6 +838,7 @@ func (c *xClient) watch(ch chan []*KVPair) {
 
 func NewXClient(servicePath string, failMode FailMode, selectMode SelectMode, discovery ServiceDiscovery, option Option) XClient {
 	client := &xClient{
+		servicePath:  servicePath,
 		failMode:     failMode,
 		selectMode:   selectMode,
 		cachedClient: make(map[string]RPCClient),
@@ -146,7 +854,7 @@ func NewXClient(servicePath string, failMode FailMode, selectMode SelectMode, di
 	}
 
 	client.servers = servers
-	if selectMode != Closest && selectMode != SelectByUser {
+	if selectMode != SelectByUser {
 		client.selector = newSelector(selectMode, servers)
 	}
 
@@ -161,6 +869,13 @@ func NewXClient(servicePath string, failMode FailMode, selectMode SelectMode, di
 	return client
 }
 
+// 新建一个双向的XClient，服务端主动推送的消息会塞到serverMessageChan中
+func NewBidirectionalXClient(servicePath string, failMode FailMode, selectMode SelectMode, discovery ServiceDiscovery, option Option, serverMessageChan chan<- *protocol.Message) XClient {
+	client := NewXClient(servicePath, failMode, selectMode, discovery, option).(*xClient)
+	client.serverMessageChan = serverMessageChan
+	return client
+}
+
 // 过滤掉指定的servers
 func filterByStateAndGroup(group string, servers map[string]string) {
 	for k, v := range servers {
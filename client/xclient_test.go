@@ -0,0 +1,615 @@
+package client
+
+import (
+	"avrilko-rpc/protocol"
+	"avrilko-rpc/server"
+	"avrilko-rpc/share"
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type ArithArgs struct {
+	A int
+	B int
+}
+
+type ArithReply struct {
+	C int
+}
+
+type Arith struct{}
+
+func (t *Arith) Mul(ctx context.Context, args *ArithArgs, reply *ArithReply) error {
+	reply.C = args.A * args.B
+	return nil
+}
+
+// 把请求元数据中的key原样放到返回的元数据中
+func (t *Arith) Meta(ctx context.Context, args *ArithArgs, reply *ArithReply) error {
+	reqMeta := ctx.Value(share.ReqMetaDataKey).(map[string]string)
+	resMeta := ctx.Value(share.ResMetaDataKey).(map[string]string)
+	resMeta["key"] = reqMeta["key"]
+	return nil
+}
+
+// 返回处理请求时ctx剩余的超时时间（毫秒，没有截止时间返回-1）
+func (t *Arith) Remaining(ctx context.Context, args *ArithArgs, reply *ArithReply) error {
+	reply.C = -1
+	if deadline, ok := ctx.Deadline(); ok {
+		reply.C = int(time.Until(deadline) / time.Millisecond)
+	}
+	return nil
+}
+
+// 一直等到调用方取消
+func (t *Arith) Slow(ctx context.Context, args *ArithArgs, reply *ArithReply) error {
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+	}
+	return nil
+}
+
+// 在随机端口上启动一个注册了Arith的服务，返回监听地址
+func startArithServer(t *testing.T) string {
+	t.Helper()
+	s := server.NewServer()
+	if err := s.RegisterName("Arith", new(Arith), ""); err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.ServeListener("tcp", ln)
+	t.Cleanup(func() { s.Close() })
+	return ln.Addr().String()
+}
+
+// 接受连接之后马上关闭的服务器，在上面的调用都会失败
+func startBrokenServer(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	t.Cleanup(func() { ln.Close() })
+	return ln.Addr().String()
+}
+
+// 总是选同一台服务器的负载均衡算法（和一致性哈希一样，同样的请求总是选到同一台）
+type fixedSelector struct {
+	server string
+}
+
+func (s *fixedSelector) Select(ctx context.Context, servicePath, serviceMethod string, args interface{}) string {
+	return s.server
+}
+
+func (s *fixedSelector) UpdateServer(servers map[string]string) {}
+
+func newTestXClient(t *testing.T, failMode FailMode, option Option, first string, others ...string) XClient {
+	t.Helper()
+	pairs := []*KVPair{{Key: first}}
+	for _, k := range others {
+		pairs = append(pairs, &KVPair{Key: k})
+	}
+	xc := NewXClient("Arith", failMode, SelectByUser, NewMultipleServersDiscovery(pairs), option)
+	xc.SetSelector(&fixedSelector{server: first})
+	t.Cleanup(func() { xc.Close() })
+	return xc
+}
+
+func TestFailoverSkipsTriedServers(t *testing.T) {
+	broken := startBrokenServer(t)
+	good := startArithServer(t)
+	xc := newTestXClient(t, Failover, DefaultOption, broken, good)
+
+	reply := &ArithReply{}
+	if err := xc.Call(context.Background(), "Mul", &ArithArgs{A: 2, B: 3}, reply); err != nil {
+		t.Fatalf("失败之后应该换到没有试过的服务器: %v", err)
+	}
+	if reply.C != 6 {
+		t.Fatalf("返回结果不正确: %d", reply.C)
+	}
+}
+
+func TestFailbackupSendsBackupOnPrimaryFailure(t *testing.T) {
+	broken := startBrokenServer(t)
+	good := startArithServer(t)
+	option := DefaultOption
+	option.BackupLatency = 10 * time.Second
+	xc := newTestXClient(t, Failbackup, option, broken, good)
+
+	start := time.Now()
+	reply := &ArithReply{}
+	if err := xc.Call(context.Background(), "Mul", &ArithArgs{A: 2, B: 3}, reply); err != nil {
+		t.Fatalf("第一台失败之后应该使用备份请求的结果: %v", err)
+	}
+	if reply.C != 6 {
+		t.Fatalf("返回结果不正确: %d", reply.C)
+	}
+	if elapsed := time.Since(start); elapsed >= option.BackupLatency {
+		t.Fatalf("第一台失败之后应该马上发备份请求，实际等待了%v", elapsed)
+	}
+}
+
+// 记录所有上报延迟的负载均衡算法
+type recordingSelector struct {
+	fixedSelector
+	mu      sync.Mutex
+	samples []time.Duration
+	errs    []error
+}
+
+func (s *recordingSelector) ObserveLatency(server string, rtt time.Duration, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.samples = append(s.samples, rtt)
+	s.errs = append(s.errs, err)
+}
+
+func TestBroadcastOnlyObservesMeasuredLatency(t *testing.T) {
+	good := startArithServer(t)
+	option := DefaultOption
+	option.Heartbeat = false
+	xc := newTestXClient(t, Failfast, option, good)
+	selector := &recordingSelector{fixedSelector: fixedSelector{server: good}}
+	xc.SetSelector(selector)
+
+	if err := xc.Broadcast(context.Background(), "Mul", &ArithArgs{A: 2, B: 3}, &ArithReply{}); err != nil {
+		t.Fatal(err)
+	}
+
+	selector.mu.Lock()
+	defer selector.mu.Unlock()
+	if len(selector.samples) != 1 || selector.samples[0] <= 0 || selector.errs[0] != nil {
+		t.Fatalf("一次成功的调用应该只上报一次测量到的延迟，实际为%v %v", selector.samples, selector.errs)
+	}
+}
+
+// 记录成功和失败次数的熔断器
+type countingBreaker struct {
+	mu       sync.Mutex
+	success  int
+	failures int
+}
+
+func (b *countingBreaker) Call(f func() error, timeout time.Duration) error { return f() }
+
+func (b *countingBreaker) Fail() {
+	b.mu.Lock()
+	b.failures++
+	b.mu.Unlock()
+}
+
+func (b *countingBreaker) Success() {
+	b.mu.Lock()
+	b.success++
+	b.mu.Unlock()
+}
+
+func (b *countingBreaker) Ready() bool { return true }
+
+func (b *countingBreaker) counts() (int, int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.success, b.failures
+}
+
+func TestCanceledCallLeavesBreakerUntouched(t *testing.T) {
+	addr := startArithServer(t)
+	option := DefaultOption
+	option.Heartbeat = false
+	breaker := &countingBreaker{}
+	option.GenBreaker = func() Breaker { return breaker }
+	xc := newTestXClient(t, Failfast, option, addr)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	if err := xc.Call(ctx, "Slow", &ArithArgs{}, &ArithReply{}); err != context.Canceled {
+		t.Fatalf("调用应该被取消，实际为%v", err)
+	}
+	if success, failures := breaker.counts(); success != 0 || failures != 0 {
+		t.Fatalf("取消的调用不应该改变熔断器的状态，实际成功%d次失败%d次", success, failures)
+	}
+
+	if err := xc.Call(context.Background(), "Mul", &ArithArgs{A: 2, B: 3}, &ArithReply{}); err != nil {
+		t.Fatal(err)
+	}
+	if success, failures := breaker.counts(); success != 1 || failures != 0 {
+		t.Fatalf("成功的调用应该记录一次成功，实际成功%d次失败%d次", success, failures)
+	}
+}
+
+func TestHeartbeatOnlyObservesLatency(t *testing.T) {
+	addr := startArithServer(t)
+	option := DefaultOption
+	option.Heartbeat = true
+	option.HeartbeatInterval = 10 * time.Millisecond
+	breaker := &countingBreaker{}
+	option.GenBreaker = func() Breaker { return breaker }
+	xc := newTestXClient(t, Failfast, option, addr)
+	selector := &recordingSelector{fixedSelector: fixedSelector{server: addr}}
+	xc.SetSelector(selector)
+
+	if err := xc.Call(context.Background(), "Mul", &ArithArgs{A: 2, B: 3}, &ArithReply{}); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		selector.mu.Lock()
+		n := len(selector.samples)
+		selector.mu.Unlock()
+		if n > 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("心跳的延迟没有上报给负载均衡算法")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if success, failures := breaker.counts(); success != 1 || failures != 0 {
+		t.Fatalf("心跳不应该上报给熔断器，实际成功%d次失败%d次", success, failures)
+	}
+}
+
+// 记录调用前后插件执行情况的插件
+type callCountPlugin struct {
+	mu       sync.Mutex
+	preCall  []string
+	postCall []error
+}
+
+func (p *callCountPlugin) PreCall(ctx context.Context, servicePath, serviceMethod string, request interface{}) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.preCall = append(p.preCall, servicePath+"."+serviceMethod)
+	return nil
+}
+
+func (p *callCountPlugin) PostCall(ctx context.Context, servicePath, serviceMethod string, request, response interface{}, err error) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.postCall = append(p.postCall, err)
+	return nil
+}
+
+func (p *callCountPlugin) counts() (int, int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.preCall), len(p.postCall)
+}
+
+// Go和SendRaw和Call一样执行调用前后的插件
+func TestGoAndSendRawRunCallPlugins(t *testing.T) {
+	addr := startArithServer(t)
+	option := DefaultOption
+	option.Heartbeat = false
+	xc := newTestXClient(t, Failfast, option, addr)
+	plugin := &callCountPlugin{}
+	plugins := NewPluginContainer()
+	plugins.Add(plugin)
+	xc.SetPlugins(plugins)
+
+	reply := &ArithReply{}
+	call, err := xc.Go(context.Background(), "Mul", &ArithArgs{A: 2, B: 3}, reply, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if call = <-call.Done; call.Error != nil {
+		t.Fatal(call.Error)
+	}
+	if reply.C != 6 {
+		t.Fatalf("返回结果不正确: %d", reply.C)
+	}
+	// done通知之前PostCall已经执行完了
+	if pre, post := plugin.counts(); pre != 1 || post != 1 {
+		t.Fatalf("Go应该执行一次PreCall和PostCall，实际为%d次和%d次", pre, post)
+	}
+
+	payload, err := share.Codecs[protocol.MsgPack].Encode(&ArithArgs{A: 3, B: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := protocol.GetPooledMsg()
+	defer protocol.FreeMsg(r)
+	r.SetMessageType(protocol.Request)
+	r.SetSerializeType(protocol.MsgPack)
+	r.ServicePath = "Arith"
+	r.ServiceMethod = "Mul"
+	r.Payload = payload
+	if _, _, err := xc.SendRaw(context.Background(), r); err != nil {
+		t.Fatal(err)
+	}
+	if pre, post := plugin.counts(); pre != 2 || post != 2 {
+		t.Fatalf("SendRaw应该执行一次PreCall和PostCall，实际为%d次和%d次", pre-1, post-1)
+	}
+	if plugin.preCall[1] != "Arith.Mul" {
+		t.Fatalf("SendRaw的PreCall拿到的服务不正确: %s", plugin.preCall[1])
+	}
+}
+
+// Go的调用结果和Call一样上报给熔断器和负载均衡算法
+func TestGoReportsResult(t *testing.T) {
+	addr := startArithServer(t)
+	option := DefaultOption
+	option.Heartbeat = false
+	breaker := &countingBreaker{}
+	option.GenBreaker = func() Breaker { return breaker }
+	xc := newTestXClient(t, Failfast, option, addr)
+	selector := &recordingSelector{fixedSelector: fixedSelector{server: addr}}
+	xc.SetSelector(selector)
+
+	call, err := xc.Go(context.Background(), "Mul", &ArithArgs{A: 2, B: 3}, &ArithReply{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if call = <-call.Done; call.Error != nil {
+		t.Fatal(call.Error)
+	}
+
+	if success, failures := breaker.counts(); success != 1 || failures != 0 {
+		t.Fatalf("成功的调用应该记录一次成功，实际成功%d次失败%d次", success, failures)
+	}
+	selector.mu.Lock()
+	defer selector.mu.Unlock()
+	if len(selector.samples) != 1 || selector.samples[0] <= 0 {
+		t.Fatalf("Go应该上报一次延迟，实际为%v", selector.samples)
+	}
+}
+
+// 拒绝所有调用的插件
+type rejectPlugin struct{}
+
+func (p *rejectPlugin) PreCall(ctx context.Context, servicePath, serviceMethod string, request interface{}) error {
+	return errors.New("插件拒绝了调用")
+}
+
+func cachedClient(xc XClient, k string) RPCClient {
+	c := xc.(*xClient)
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cachedClient[k]
+}
+
+// 插件拒绝调用和连接无关，不能断开缓存的连接；连接出错才移除
+func TestOnlyConnErrorEvictsClient(t *testing.T) {
+	addr := startArithServer(t)
+	option := DefaultOption
+	option.Heartbeat = false
+	xc := newTestXClient(t, Failtry, option, addr)
+
+	if err := xc.Call(context.Background(), "Mul", &ArithArgs{A: 2, B: 3}, &ArithReply{}); err != nil {
+		t.Fatal(err)
+	}
+	client := cachedClient(xc, addr)
+	if client == nil {
+		t.Fatal("调用成功之后应该缓存客户端")
+	}
+
+	plugins := NewPluginContainer()
+	plugins.Add(&rejectPlugin{})
+	xc.SetPlugins(plugins)
+	if err := xc.Call(context.Background(), "Mul", &ArithArgs{A: 2, B: 3}, &ArithReply{}); err == nil {
+		t.Fatal("插件拒绝之后调用应该失败")
+	}
+	if cachedClient(xc, addr) != client || client.IsClosing() || client.IsShutDown() {
+		t.Fatal("插件拒绝调用不应该断开缓存的连接")
+	}
+
+	broken := startBrokenServer(t)
+	xc = newTestXClient(t, Failfast, option, broken)
+	if err := xc.Call(context.Background(), "Mul", &ArithArgs{A: 2, B: 3}, &ArithReply{}); err == nil {
+		t.Fatal("在断开的连接上调用应该失败")
+	}
+	if cachedClient(xc, broken) != nil {
+		t.Fatal("连接出错之后应该从缓存中移除")
+	}
+}
+
+// 调用的同时修改鉴权信息（配合-race检查数据竞争）
+func TestAuthConcurrentWithCall(t *testing.T) {
+	addr := startArithServer(t)
+	option := DefaultOption
+	option.Heartbeat = false
+	xc := newTestXClient(t, Failfast, option, addr)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			xc.Auth("token")
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		if err := xc.Call(context.Background(), "Mul", &ArithArgs{A: 2, B: 3}, &ArithReply{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wg.Wait()
+}
+
+// 处理请求时通过RemoteConn拿到客户端的连接，给客户端推送一条消息
+type Pusher struct {
+	s *server.Server
+}
+
+func (p *Pusher) Push(ctx context.Context, args *ArithArgs, reply *ArithReply) error {
+	conn := server.RemoteConn(ctx)
+	if conn == nil {
+		return errors.New("上下文中没有客户端的连接")
+	}
+	return p.s.SendMessage(conn, "Pusher", "Notify", map[string]string{"n": strconv.Itoa(args.A)}, []byte("hello"))
+}
+
+func startPushServer(t *testing.T) string {
+	t.Helper()
+	s := server.NewServer()
+	if err := s.RegisterName("Pusher", &Pusher{s: s}, ""); err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.ServeListener("tcp", ln)
+	t.Cleanup(func() { s.Close() })
+	return ln.Addr().String()
+}
+
+func expectPush(t *testing.T, ch <-chan *protocol.Message, n string) {
+	t.Helper()
+	select {
+	case msg := <-ch:
+		defer protocol.FreeMsg(msg)
+		if msg.ServicePath != "Pusher" || msg.ServiceMethod != "Notify" || msg.Metadata["n"] != n || string(msg.Payload) != "hello" {
+			t.Fatalf("收到的推送消息不正确: %s.%s %v %q", msg.ServicePath, msg.ServiceMethod, msg.Metadata, msg.Payload)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("没有收到服务端推送的消息")
+	}
+}
+
+// 服务端在业务方法中推送的消息，客户端从注册的通道中收到
+func TestServerPush(t *testing.T) {
+	addr := startPushServer(t)
+	option := DefaultOption
+	option.Heartbeat = false
+
+	t.Run("BidirectionalXClient", func(t *testing.T) {
+		ch := make(chan *protocol.Message, 1)
+		xc := NewBidirectionalXClient("Pusher", Failfast, RandomSelect, NewPeer2PeerDiscovery("tcp@"+addr, ""), option, ch)
+		defer xc.Close()
+
+		if err := xc.Call(context.Background(), "Push", &ArithArgs{A: 1}, &ArithReply{}); err != nil {
+			t.Fatal(err)
+		}
+		expectPush(t, ch, "1")
+	})
+
+	t.Run("Client", func(t *testing.T) {
+		ch := make(chan *protocol.Message, 1)
+		c := newTestClient(t, addr)
+		c.RegisterServerMessageChan(ch)
+
+		if err := c.Call(context.Background(), "Pusher", "Push", &ArithArgs{A: 2}, &ArithReply{}); err != nil {
+			t.Fatal(err)
+		}
+		expectPush(t, ch, "2")
+	})
+}
+
+// 直接使用协议的服务端，所有请求都原样返回，muted之后不再回复心跳（模拟连接还在但是服务端已经没有响应了）
+type muteServer struct {
+	addr       string
+	muted      int32
+	heartbeats int32 // muted之后收到的心跳数
+}
+
+func startMuteServer(t *testing.T) *muteServer {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	s := &muteServer{addr: ln.Addr().String()}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *muteServer) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		msg := protocol.GetPooledMsg()
+		if err := msg.Decode(r); err != nil {
+			protocol.FreeMsg(msg)
+			return
+		}
+		if msg.IsHeartbeat() && atomic.LoadInt32(&s.muted) == 1 {
+			atomic.AddInt32(&s.heartbeats, 1)
+			protocol.FreeMsg(msg)
+			continue
+		}
+
+		res := msg.Clone()
+		res.SetMessageType(protocol.Response)
+		res.Payload = nil
+		data := res.EncodeSlicePointer()
+		conn.Write(*data)
+		protocol.PutData(data)
+		protocol.FreeMsg(res)
+		protocol.FreeMsg(msg)
+	}
+}
+
+// 服务端不再回复心跳，连续MaxMissedHeartbeats次之后客户端判定连接断开并从缓存中移除，下次调用重新建立连接
+func TestMissedHeartbeatsEvictClient(t *testing.T) {
+	s := startMuteServer(t)
+	option := DefaultOption
+	option.Heartbeat = true
+	option.HeartbeatInterval = 20 * time.Millisecond
+	option.MaxMissedHeartbeats = 3
+	xc := newTestXClient(t, Failfast, option, s.addr)
+
+	if err := xc.Call(context.Background(), "Mul", &ArithArgs{}, &ArithReply{}); err != nil {
+		t.Fatal(err)
+	}
+	client := cachedClient(xc, s.addr)
+	if client == nil {
+		t.Fatal("调用成功之后应该缓存客户端")
+	}
+
+	atomic.StoreInt32(&s.muted, 1)
+	deadline := time.Now().Add(3 * time.Second)
+	for cachedClient(xc, s.addr) != nil {
+		if time.Now().After(deadline) {
+			t.Fatal("心跳一直没有响应，客户端应该从缓存中移除")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if n := atomic.LoadInt32(&s.heartbeats); n < int32(option.MaxMissedHeartbeats) {
+		t.Fatalf("连续%d次心跳没有响应才能判定断开，实际只发了%d次", option.MaxMissedHeartbeats, n)
+	}
+	if !client.IsShutDown() {
+		t.Fatal("判定断开的客户端应该被关闭")
+	}
+
+	atomic.StoreInt32(&s.muted, 0)
+	if err := xc.Call(context.Background(), "Mul", &ArithArgs{}, &ArithReply{}); err != nil {
+		t.Fatalf("移除之后应该重新建立连接: %v", err)
+	}
+	if c := cachedClient(xc, s.addr); c == nil || c == client {
+		t.Fatal("重新建立连接之后应该缓存新的客户端")
+	}
+}
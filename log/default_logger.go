@@ -16,7 +16,7 @@ func (d *defaultLogger) Debug(v ...interface{}) {
 }
 
 func (d *defaultLogger) DebugF(format string, v ...interface{}) {
-	d.Output(CallDepth, wrapperMsg("[DEBUG]", fmt.Sprintf(format, v)))
+	d.Output(CallDepth, wrapperMsg("[DEBUG]", fmt.Sprintf(format, v...)))
 }
 
 func (d *defaultLogger) Info(v ...interface{}) {
@@ -24,7 +24,7 @@ func (d *defaultLogger) Info(v ...interface{}) {
 }
 
 func (d *defaultLogger) InfoF(format string, v ...interface{}) {
-	d.Output(CallDepth, wrapperMsg(color.GreenString("[INFO]"), fmt.Sprintf(format, v)))
+	d.Output(CallDepth, wrapperMsg(color.GreenString("[INFO]"), fmt.Sprintf(format, v...)))
 }
 
 func (d *defaultLogger) Warn(v ...interface{}) {
@@ -32,7 +32,7 @@ func (d *defaultLogger) Warn(v ...interface{}) {
 }
 
 func (d *defaultLogger) WarnF(format string, v ...interface{}) {
-	d.Output(CallDepth, wrapperMsg(color.YellowString("[WARN]"), fmt.Sprintf(format, v)))
+	d.Output(CallDepth, wrapperMsg(color.YellowString("[WARN]"), fmt.Sprintf(format, v...)))
 }
 
 func (d *defaultLogger) Error(v ...interface{}) {
@@ -40,14 +40,14 @@ func (d *defaultLogger) Error(v ...interface{}) {
 }
 
 func (d *defaultLogger) ErrorF(format string, v ...interface{}) {
-	d.Output(CallDepth, wrapperMsg(color.RedString("[ERROR]"), fmt.Sprintf(format, v)))
+	d.Output(CallDepth, wrapperMsg(color.RedString("[ERROR]"), fmt.Sprintf(format, v...)))
 }
 
 func (d *defaultLogger) Fatal(v ...interface{}) {
 	d.Output(CallDepth, wrapperMsg(color.MagentaString("[FATAL]"), fmt.Sprint(v...)))
 }
 func (d *defaultLogger) FatalF(format string, v ...interface{}) {
-	d.Output(CallDepth, wrapperMsg(color.MagentaString("[FATAL]"), fmt.Sprintf(format, v)))
+	d.Output(CallDepth, wrapperMsg(color.MagentaString("[FATAL]"), fmt.Sprintf(format, v...)))
 }
 
 func (d *defaultLogger) Panic(v ...interface{}) {
@@ -58,7 +58,7 @@ func (d *defaultLogger) PanicF(format string, v ...interface{}) {
 }
 
 func (d *defaultLogger) Handle(v ...interface{}) {
-	d.Error(v)
+	d.Error(v...)
 }
 
 func wrapperMsg(level, msg string) string {
@@ -88,6 +88,6 @@ func PanicF(format string, v ...interface{}) {
 
 func Handle(v ...interface{}) {
 	if handle, ok := l.(Handler); ok {
-		handle.Handle(v)
+		handle.Handle(v...)
 	}
 }
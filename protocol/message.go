@@ -11,7 +11,8 @@ import (
 )
 
 const (
-	ServiceError = "__rpcx_error__"
+	ServiceError     = "__rpcx_error__"
+	ServiceErrorCode = "__rpcx_error_code__" // 错误码，服务端返回的错误带有错误码时才有
 )
 
 const (
@@ -124,6 +125,19 @@ func (h *Header) SetOneway(one bool) {
 	}
 }
 
+// 是否是取消请求的消息（客户端不再等待seq对应的请求，服务端取消正在处理的请求）
+func (h Header) IsCancel() bool {
+	return h[3]&0x01 == 0x01
+}
+
+func (h *Header) SetCancel(cancel bool) {
+	if cancel {
+		h[3] = h[3] | 0x01
+	} else {
+		h[3] = h[3] &^ 0x01
+	}
+}
+
 // 获取压缩类型 (***xxx** & 00011100) => (xxx00) >> 2 => (xxx) （蛋疼的算法）
 func (h Header) CompressType() CompressType {
 	// 这里不用引用（使用值拷贝）
@@ -146,6 +160,16 @@ func (h *Header) SetSerializeType(s SerializeType) {
 	h[3] = (h[3] &^ 0xf0) | (byte(s) << 4)
 }
 
+// 获取消息序号（客户端通过序号将响应和请求对应起来）
+func (h Header) Seq() uint64 {
+	return binary.BigEndian.Uint64(h[4:])
+}
+
+// 设置消息序号
+func (h *Header) SetSeq(seq uint64) {
+	binary.BigEndian.PutUint64(h[4:], seq)
+}
+
 // rpc 标准的请求和响应格式
 type Message struct {
 	*Header                         // 头部信息（包括魔数 + 版本号 + 消息类型 + 是否是心跳 + 是否是上报服务 + 是否压缩 + 单个请求是否是成功 + 序列化方式）
@@ -250,7 +274,8 @@ func (m *Message) Decode(rBuff io.Reader) (err error) {
 	return nil
 }
 
-// 拷贝一个message对象
+// 拷贝一个message对象（服务端用它来生成响应）
+// 头部会原样拷贝，保证响应和请求的seq、序列化方式一致，只有压缩方式会被重置
 func (m Message) Clone() *Message {
 	header := *m.Header
 	c := GetPooledMsg()
@@ -339,17 +364,20 @@ func decodeMetaData(l int, data []byte) (map[string]string, error) {
 	value := ""
 	for n < l {
 		// 每个key和value的长度都是4个字节的字符串
-		lenKV = int(binary.BigEndian.Uint32(data[n:4]))
+		if n+4 > l { // 连key的长度都读不出来了
+			return m, ErrMetaKVMissing
+		}
+		lenKV = int(binary.BigEndian.Uint32(data[n : n+4]))
 		n += 4
-		if n+lenKV < l-4 { // 没法解析了
+		if n+lenKV > l-4 { // key后面至少还要有value的长度，没法解析了
 			return m, ErrMetaKVMissing
 		}
 		key = util.SliceByteToString(data[n : n+lenKV])
 		n += lenKV
 
-		lenKV = int(binary.BigEndian.Uint32(data[n:4]))
+		lenKV = int(binary.BigEndian.Uint32(data[n : n+4]))
 		n += 4
-		if n < l-4 { // 没法解析了
+		if n+lenKV > l { // 没法解析了
 			return m, ErrMetaKVMissing
 		}
 		value = util.SliceByteToString(data[n : n+lenKV])
@@ -0,0 +1,68 @@
+package protocol
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSeqSurvivesEncodeDecode(t *testing.T) {
+	req := GetPooledMsg()
+	defer FreeMsg(req)
+	req.SetMessageType(Request)
+	req.SetSerializeType(JSON)
+	req.SetSeq(0x0102030405060708)
+	req.ServicePath = "Arith"
+	req.ServiceMethod = "Mul"
+	req.Metadata = map[string]string{"a": "1", "bb": "22"}
+	req.Payload = []byte(`{"A":1}`)
+
+	data := req.EncodeSlicePointer()
+	defer PutData(data)
+
+	got := GetPooledMsg()
+	defer FreeMsg(got)
+	if err := got.Decode(bytes.NewReader(*data)); err != nil {
+		t.Fatalf("解码失败: %v", err)
+	}
+
+	if got.Seq() != req.Seq() {
+		t.Errorf("seq = %x, 期望 %x", got.Seq(), req.Seq())
+	}
+	if got.ServicePath != "Arith" || got.ServiceMethod != "Mul" {
+		t.Errorf("服务名和方法名不一致: %s.%s", got.ServicePath, got.ServiceMethod)
+	}
+	if got.SerializeType() != JSON || got.MessageType() != Request {
+		t.Errorf("头部不一致: %v", got.Header)
+	}
+	if len(got.Metadata) != 2 || got.Metadata["a"] != "1" || got.Metadata["bb"] != "22" {
+		t.Errorf("元数据不一致: %v", got.Metadata)
+	}
+	if string(got.Payload) != `{"A":1}` {
+		t.Errorf("payload不一致: %s", got.Payload)
+	}
+}
+
+func TestCloneKeepsSeq(t *testing.T) {
+	req := GetPooledMsg()
+	defer FreeMsg(req)
+	req.SetSeq(42)
+	req.SetSerializeType(MsgPack)
+	req.SetCompressType(Gzip)
+
+	res := req.Clone()
+	defer FreeMsg(res)
+	if res.Seq() != 42 {
+		t.Errorf("seq = %d, 期望 42", res.Seq())
+	}
+	if res.SerializeType() != MsgPack {
+		t.Errorf("序列化方式 = %d, 期望 %d", res.SerializeType(), MsgPack)
+	}
+	if res.CompressType() != None {
+		t.Errorf("压缩方式应该被重置, 实际 %d", res.CompressType())
+	}
+
+	res.SetSeq(43) // 修改响应不影响请求
+	if req.Seq() != 42 {
+		t.Errorf("修改响应的seq影响到了请求")
+	}
+}
@@ -0,0 +1,72 @@
+package server
+
+import (
+	"bufio"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	WriteBuffSize = 4096 // 写入消息时候缓冲区大小
+)
+
+// 连接的写入者，一个连接上的所有写入都经过它
+// 加锁保证一个消息的数据不会和别的消息交错，同时有多个消息等待写入时合并到缓冲区中一起刷到连接上，减少系统调用
+type connWriter struct {
+	conn         net.Conn
+	writeTimeout time.Duration
+
+	mu      sync.Mutex
+	w       *bufio.Writer
+	batch   *writeBatch // 写到缓冲区里还没有刷到连接上的这一批消息
+	waiting int32       // 等待写入的消息数量
+}
+
+// 一起刷到连接上的一批消息，刷完之后关闭done，所有消息都拿到刷的结果
+type writeBatch struct {
+	done chan struct{}
+	err  error
+}
+
+func newWriteBatch() *writeBatch {
+	return &writeBatch{done: make(chan struct{})}
+}
+
+func newConnWriter(conn net.Conn, writeTimeout time.Duration) *connWriter {
+	return &connWriter{
+		conn:         conn,
+		writeTimeout: writeTimeout,
+		w:            bufio.NewWriterSize(conn, WriteBuffSize),
+		batch:        newWriteBatch(),
+	}
+}
+
+// 写入一个完整的消息，等到消息真正刷到连接上才返回，返回写入的错误（包括写超时）
+func (cw *connWriter) write(data []byte) error {
+	atomic.AddInt32(&cw.waiting, 1)
+	cw.mu.Lock()
+
+	if cw.writeTimeout != 0 { // 写入的超时时间从拿到锁开始算（请求处理的时间不算在里面）
+		cw.conn.SetWriteDeadline(time.Now().Add(cw.writeTimeout))
+	}
+	_, err := cw.w.Write(data)
+	batch := cw.batch
+
+	// 后面还有消息在等待就先不刷，由最后一个消息一起刷到连接上（缓冲区里积攒得太多也直接刷，不让前面的消息一直等）
+	if atomic.AddInt32(&cw.waiting, -1) == 0 || cw.w.Buffered() >= WriteBuffSize/2 {
+		batch.err = cw.w.Flush() // bufio.Writer出错之后一直返回同一个错误，前面写入失败这里也能拿到
+		close(batch.done)
+		cw.batch = newWriteBatch()
+		cw.mu.Unlock()
+		return batch.err
+	}
+	cw.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+	<-batch.done
+	return batch.err
+}
@@ -0,0 +1,41 @@
+package server
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// 合并在一起刷的消息都要拿到刷到连接上的结果，不能在数据还在缓冲区里的时候就返回成功
+func TestConnWriterBatchGetsFlushError(t *testing.T) {
+	conn, peer := net.Pipe()
+	peer.Close() // 对端关闭，刷到连接上一定失败
+	defer conn.Close()
+	cw := newConnWriter(conn, 0)
+
+	// 假装后面还有一个消息在等待，第一个消息只会写到缓冲区里
+	atomic.AddInt32(&cw.waiting, 1)
+	first := make(chan error, 1)
+	go func() { first <- cw.write([]byte("first")) }()
+
+	select {
+	case err := <-first:
+		t.Fatalf("消息还没有刷到连接上就返回了: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// 最后一个消息刷缓冲区
+	atomic.AddInt32(&cw.waiting, -1)
+	if err := cw.write([]byte("second")); err == nil {
+		t.Fatal("刷到连接上失败时应该返回错误")
+	}
+	select {
+	case err := <-first:
+		if err == nil {
+			t.Fatal("同一批的消息也应该拿到刷到连接上的错误")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("刷完之后同一批的消息没有返回")
+	}
+}
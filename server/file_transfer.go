@@ -0,0 +1,400 @@
+package server
+
+import (
+	"avrilko-rpc/log"
+	"avrilko-rpc/share"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrInvalidFileName = errors.New("文件名不合法")
+	ErrIsDirectory     = errors.New("不能下载目录")
+	ErrFileNotFound    = errors.New("文件不存在")
+)
+
+// 文件传输处理者，决定上传的文件存到哪里、哪些文件可以被下载
+type FileTransferHandler interface {
+	Upload(ctx context.Context, args *share.FileTransferArgs) (io.WriteCloser, error)         // 返回上传文件的写入位置，返回错误则拒绝上传
+	Download(ctx context.Context, args *share.DownloadFileArgs) (io.ReadCloser, int64, error) // 返回要下载的文件和文件大小，返回错误则拒绝下载
+}
+
+// 默认的文件传输处理者，上传的文件保存在dir目录下，也只允许下载dir目录下的文件
+type dirFileTransferHandler struct {
+	dir string
+}
+
+func NewDirFileTransferHandler(dir string) FileTransferHandler {
+	return &dirFileTransferHandler{dir: dir}
+}
+
+// 文件名转换为dir下面的路径（去掉..之类的路径，防止访问到dir之外的文件）
+func (h *dirFileTransferHandler) path(name string) (string, error) {
+	name = path.Clean("/" + filepath.ToSlash(name))
+	if name == "/" {
+		return "", ErrInvalidFileName
+	}
+	return filepath.Join(h.dir, filepath.FromSlash(name)), nil
+}
+
+func (h *dirFileTransferHandler) Upload(ctx context.Context, args *share.FileTransferArgs) (io.WriteCloser, error) {
+	p, err := h.path(args.FileName)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return nil, err
+	}
+
+	// 先写到同目录下的临时文件，传输完成之后再改名，失败时不会留下不完整的文件
+	file, err := ioutil.TempFile(filepath.Dir(p), "."+filepath.Base(p)+".*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	if err = file.Chmod(0644); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, err
+	}
+	return &uploadFile{File: file, path: p}, nil
+}
+
+// 上传的写入位置实现了这个接口时，传输失败或者凭证过期会调用Abort而不是Close，丢弃已经写入的数据
+type UploadAborter interface {
+	Abort() error
+}
+
+// 丢弃没有上传完成的写入位置，没有实现UploadAborter的直接关闭
+func abortUpload(w io.WriteCloser) {
+	if aborter, ok := w.(UploadAborter); ok {
+		aborter.Abort()
+		return
+	}
+	w.Close()
+}
+
+// 正在上传的文件，Close时把临时文件改名为最终的文件名
+type uploadFile struct {
+	*os.File
+	path string
+}
+
+func (f *uploadFile) Close() error {
+	if err := f.File.Close(); err != nil {
+		os.Remove(f.File.Name())
+		return err
+	}
+	if err := os.Rename(f.File.Name(), f.path); err != nil {
+		os.Remove(f.File.Name())
+		return err
+	}
+	return nil
+}
+
+func (f *uploadFile) Abort() error {
+	f.File.Close()
+	return os.Remove(f.File.Name())
+}
+
+func (h *dirFileTransferHandler) Download(ctx context.Context, args *share.DownloadFileArgs) (io.ReadCloser, int64, error) {
+	p, err := h.path(args.FileName)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	file, err := os.Open(p)
+	if err != nil {
+		if os.IsNotExist(err) { // 不把服务端的路径暴露给客户端
+			return nil, 0, ErrFileNotFound
+		}
+		return nil, 0, err
+	}
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, 0, err
+	}
+	if fi.IsDir() {
+		file.Close()
+		return nil, 0, ErrIsDirectory
+	}
+	return file, fi.Size(), nil
+}
+
+// 一次待传输的文件（客户端拿到凭证之后连接过来传输数据）
+type fileTransferTask struct {
+	upload bool
+	size   int64
+	writer io.WriteCloser // 上传时写入的位置
+	reader io.ReadCloser  // 下载时读取的文件
+	timer  *time.Timer    // 凭证过期之后释放资源
+}
+
+// 释放资源，上传还没有完成的写入位置会被丢弃
+func (t *fileTransferTask) close() {
+	if t.writer != nil {
+		abortUpload(t.writer)
+	}
+	if t.reader != nil {
+		t.reader.Close()
+	}
+}
+
+// 文件传输服务
+// 客户端先通过rpc调用协商拿到凭证和地址，再单独建立一条连接传输文件数据，不会阻塞rpc连接上的其他请求
+type FileTransfer struct {
+	Addr          string        // 传输文件数据的监听地址
+	AdvertiseAddr string        // 告诉客户端连接的地址，为空则使用监听的地址（主机为空时客户端会使用rpc服务端的主机）
+	Timeout       time.Duration // 凭证的有效期，客户端需要在这个时间内连接过来
+	ReadTimeout   time.Duration // 上传时超过这个时间没有读到数据就断开，为0不限制
+	WriteTimeout  time.Duration // 下载时超过这个时间没有写出数据就断开，为0不限制
+
+	handler FileTransferHandler
+
+	mu      sync.Mutex
+	pending map[string]*fileTransferTask // 凭证 => 待传输的文件
+	ln      net.Listener
+}
+
+func NewFileTransfer(addr string, handler FileTransferHandler) *FileTransfer {
+	return &FileTransfer{
+		Addr:         addr,
+		Timeout:      time.Minute,
+		ReadTimeout:  time.Minute,
+		WriteTimeout: time.Minute,
+		handler:      handler,
+		pending:      make(map[string]*fileTransferTask),
+	}
+}
+
+// 开启文件传输服务（服务端配置了证书时传输数据的连接也使用tls）
+// serviceName一般使用share.SendFileServiceName，使用其他名字时客户端需要设置相同的Option.FileTransferServiceName
+// 协商服务只是内部使用的，不通知注册插件，不会被发布到注册中心
+func (s *Server) EnableFileTransfer(serviceName string, ft *FileTransfer) error {
+	ln, err := net.Listen("tcp", ft.Addr)
+	if err != nil {
+		return err
+	}
+	if s.tlsConfig != nil {
+		ln = tls.NewListener(ln, s.tlsConfig)
+	}
+
+	if _, err = s.register(&fileTransferService{ft: ft}, serviceName, true); err != nil {
+		ln.Close()
+		return err
+	}
+
+	ft.mu.Lock()
+	ft.ln = ln
+	ft.mu.Unlock()
+
+	s.connMu.Lock()
+	s.fileTransfer = ft
+	s.connMu.Unlock()
+
+	go ft.serve(ln)
+	return nil
+}
+
+// 生成凭证并登记待传输的文件
+func (ft *FileTransfer) addTask(task *fileTransferTask) ([]byte, error) {
+	token := make([]byte, share.FileTransferTokenLen)
+	if _, err := rand.Read(token); err != nil {
+		return nil, err
+	}
+	key := string(token)
+
+	ft.mu.Lock()
+	task.timer = time.AfterFunc(ft.Timeout, func() { // 客户端一直没有连接过来
+		if task := ft.takeTask(key); task != nil {
+			task.close()
+		}
+	})
+	ft.pending[key] = task
+	ft.mu.Unlock()
+	return token, nil
+}
+
+// 取出凭证对应的文件，凭证只能使用一次
+func (ft *FileTransfer) takeTask(key string) *fileTransferTask {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+
+	task := ft.pending[key]
+	if task != nil {
+		delete(ft.pending, key)
+		task.timer.Stop()
+	}
+	return task
+}
+
+// 告诉客户端连接的地址
+func (ft *FileTransfer) advertiseAddr() string {
+	if ft.AdvertiseAddr != "" {
+		return ft.AdvertiseAddr
+	}
+
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	if ft.ln != nil {
+		return ft.ln.Addr().String()
+	}
+	return ft.Addr
+}
+
+func (ft *FileTransfer) serve(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if !strings.Contains(err.Error(), "use of closed network connection") {
+				log.WarnF("文件传输服务接受连接失败，错误原因%v", err)
+			}
+			return
+		}
+		go ft.handleConn(conn)
+	}
+}
+
+// 读取凭证，按凭证对应的任务接收或者发送文件数据
+func (ft *FileTransfer) handleConn(conn net.Conn) {
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(ft.Timeout))
+	token := make([]byte, share.FileTransferTokenLen)
+	if _, err := io.ReadFull(conn, token); err != nil {
+		log.WarnF("文件传输读取凭证失败，连接%s，错误原因%v", conn.RemoteAddr(), err)
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	task := ft.takeTask(string(token))
+	if task == nil {
+		log.WarnF("文件传输凭证不存在或者已经过期，连接%s", conn.RemoteAddr())
+		return
+	}
+	defer task.close()
+
+	if task.upload {
+		var r io.Reader = conn
+		if ft.ReadTimeout > 0 { // 客户端不发数据也不断开时，不能一直占着连接和文件
+			r = &deadlineReader{conn: conn, timeout: ft.ReadTimeout}
+		}
+		_, err := io.CopyN(task.writer, r, task.size)
+		if err == nil {
+			err = task.writer.Close()
+			task.writer = nil
+		}
+		// 告诉客户端文件是否保存成功
+		if err != nil {
+			log.WarnF("文件传输接收数据失败，连接%s，错误原因%v", conn.RemoteAddr(), err)
+			if task.writer != nil { // 先丢弃不完整的文件再告诉客户端
+				abortUpload(task.writer)
+				task.writer = nil
+			}
+			conn.Write([]byte{1})
+			return
+		}
+		conn.Write([]byte{0})
+		return
+	}
+
+	var w io.Writer = conn
+	if ft.WriteTimeout > 0 { // 客户端不读数据也不断开时，不能一直占着连接和文件
+		w = &deadlineWriter{conn: conn, timeout: ft.WriteTimeout}
+	}
+	if _, err := io.CopyN(w, task.reader, task.size); err != nil {
+		log.WarnF("文件传输发送数据失败，连接%s，错误原因%v", conn.RemoteAddr(), err)
+	}
+}
+
+// 每次读取之前重新设置读超时，只限制空闲的时间，不限制整个文件的传输时间
+type deadlineReader struct {
+	conn    net.Conn
+	timeout time.Duration
+}
+
+func (r *deadlineReader) Read(p []byte) (int, error) {
+	r.conn.SetReadDeadline(time.Now().Add(r.timeout))
+	return r.conn.Read(p)
+}
+
+// 每次写入之前重新设置写超时，和deadlineReader一样只限制空闲的时间
+type deadlineWriter struct {
+	conn    net.Conn
+	timeout time.Duration
+}
+
+func (w *deadlineWriter) Write(p []byte) (int, error) {
+	w.conn.SetWriteDeadline(time.Now().Add(w.timeout))
+	return w.conn.Write(p)
+}
+
+// 关闭监听，释放所有还没有传输的文件
+func (ft *FileTransfer) close() error {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+
+	for key, task := range ft.pending {
+		delete(ft.pending, key)
+		task.timer.Stop()
+		task.close()
+	}
+
+	if ft.ln != nil {
+		return ft.ln.Close()
+	}
+	return nil
+}
+
+// 注册到rpc服务中的文件传输协商服务
+type fileTransferService struct {
+	ft *FileTransfer
+}
+
+// 协商上传文件
+func (s *fileTransferService) TransferFile(ctx context.Context, args *share.FileTransferArgs, reply *share.FileTransferReply) error {
+	writer, err := s.ft.handler.Upload(ctx, args)
+	if err != nil {
+		return err
+	}
+
+	token, err := s.ft.addTask(&fileTransferTask{upload: true, size: args.FileSize, writer: writer})
+	if err != nil {
+		abortUpload(writer)
+		return err
+	}
+
+	reply.Token = token
+	reply.Addr = s.ft.advertiseAddr()
+	return nil
+}
+
+// 协商下载文件
+func (s *fileTransferService) DownloadFile(ctx context.Context, args *share.DownloadFileArgs, reply *share.FileTransferReply) error {
+	reader, size, err := s.ft.handler.Download(ctx, args)
+	if err != nil {
+		return err
+	}
+
+	token, err := s.ft.addTask(&fileTransferTask{size: size, reader: reader})
+	if err != nil {
+		reader.Close()
+		return err
+	}
+
+	reply.Token = token
+	reply.Addr = s.ft.advertiseAddr()
+	reply.FileSize = size
+	return nil
+}
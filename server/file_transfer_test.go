@@ -0,0 +1,218 @@
+package server
+
+import (
+	"avrilko-rpc/protocol"
+	"avrilko-rpc/share"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func tempDir(t *testing.T) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "avrilko-rpc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+// 目录下的所有文件名
+func listDir(t *testing.T, dir string) []string {
+	t.Helper()
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make([]string, 0, len(infos))
+	for _, info := range infos {
+		names = append(names, info.Name())
+	}
+	return names
+}
+
+func TestDirUploadRenamesOnlyOnSuccess(t *testing.T) {
+	dir := tempDir(t)
+	handler := NewDirFileTransferHandler(dir)
+	args := &share.FileTransferArgs{FileName: "a.txt", FileSize: 5}
+
+	w, err := handler.Upload(context.Background(), args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("he"))
+	abortUpload(w)
+	if names := listDir(t, dir); len(names) != 0 {
+		t.Fatalf("上传失败之后不应该留下任何文件，实际为%v", names)
+	}
+
+	w, err = handler.Upload(context.Background(), args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("hello"))
+	if names := listDir(t, dir); len(names) != 1 || names[0] == "a.txt" {
+		t.Fatalf("上传完成之前不应该出现最终的文件，实际为%v", names)
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, "a.txt"))
+	if err != nil || string(data) != "hello" {
+		t.Fatalf("上传的文件不正确: %q %v", data, err)
+	}
+	if names := listDir(t, dir); len(names) != 1 {
+		t.Fatalf("上传完成之后不应该留下临时文件，实际为%v", names)
+	}
+}
+
+func TestUploadReadTimeout(t *testing.T) {
+	dir := tempDir(t)
+	ft := NewFileTransfer("127.0.0.1:0", NewDirFileTransferHandler(dir))
+	ft.ReadTimeout = 50 * time.Millisecond
+	s := NewServer()
+	if err := s.EnableFileTransfer(share.SendFileServiceName, ft); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+
+	reply := &share.FileTransferReply{}
+	svc := &fileTransferService{ft: ft}
+	if err := svc.TransferFile(context.Background(), &share.FileTransferArgs{FileName: "a.txt", FileSize: 100}, reply); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.Dial("tcp", reply.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write(reply.Token)
+	conn.Write([]byte("only part of the file"))
+
+	// 客户端不再发送数据，服务端应该在读超时之后放弃并返回失败
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	ack := make([]byte, 1)
+	if _, err = io.ReadFull(conn, ack); err != nil {
+		t.Fatalf("服务端没有在读超时之后返回结果: %v", err)
+	}
+	if ack[0] != 1 {
+		t.Fatalf("读超时的上传应该返回失败，实际为%d", ack[0])
+	}
+	if names := listDir(t, dir); len(names) != 0 {
+		t.Fatalf("上传失败之后不应该留下任何文件，实际为%v", names)
+	}
+}
+
+// 关闭时通知closed的下载文件
+type notifyReadCloser struct {
+	io.Reader
+	closed chan struct{}
+}
+
+func (r *notifyReadCloser) Close() error {
+	close(r.closed)
+	return nil
+}
+
+// 下载一个很大的文件，关闭时通知
+type bigFileHandler struct {
+	size   int64
+	closed chan struct{}
+}
+
+func (h *bigFileHandler) Upload(ctx context.Context, args *share.FileTransferArgs) (io.WriteCloser, error) {
+	return nil, ErrInvalidFileName
+}
+
+func (h *bigFileHandler) Download(ctx context.Context, args *share.DownloadFileArgs) (io.ReadCloser, int64, error) {
+	return &notifyReadCloser{Reader: io.LimitReader(zeroReader{}, h.size), closed: h.closed}, h.size, nil
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+// 客户端拿到凭证连接过来之后不读数据，服务端在写超时之后断开并释放文件
+func TestDownloadWriteTimeout(t *testing.T) {
+	handler := &bigFileHandler{size: 1 << 30, closed: make(chan struct{})}
+	ft := NewFileTransfer("127.0.0.1:0", handler)
+	ft.WriteTimeout = 50 * time.Millisecond
+	s := NewServer()
+	if err := s.EnableFileTransfer(share.SendFileServiceName, ft); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+
+	reply := &share.FileTransferReply{}
+	svc := &fileTransferService{ft: ft}
+	if err := svc.DownloadFile(context.Background(), &share.DownloadFileArgs{FileName: "big"}, reply); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.Dial("tcp", reply.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write(reply.Token)
+
+	select {
+	case <-handler.closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("客户端不读数据时服务端应该在写超时之后释放文件")
+	}
+}
+
+// 记录注册和反注册的插件
+type registerRecorder struct {
+	registered   []string
+	unregistered []string
+}
+
+func (p *registerRecorder) Register(name string, object interface{}, metadata string) error {
+	p.registered = append(p.registered, name)
+	return nil
+}
+
+func (p *registerRecorder) Unregister(name string) error {
+	p.unregistered = append(p.unregistered, name)
+	return nil
+}
+
+// 文件传输的协商服务不通知注册插件，不会被发布到注册中心，但是可以正常调用
+func TestFileTransferNotPublished(t *testing.T) {
+	recorder := &registerRecorder{}
+	s := NewServer()
+	s.Plugins.Add(recorder)
+	if err := s.RegisterName("Arith", &Arith{}, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.EnableFileTransfer(share.SendFileServiceName, NewFileTransfer("127.0.0.1:0", NewDirFileTransferHandler(tempDir(t)))); err != nil {
+		t.Fatal(err)
+	}
+	c := dialTestServer(t, startTestServer(t, s))
+
+	if len(recorder.registered) != 1 || recorder.registered[0] != "Arith" {
+		t.Fatalf("只有业务服务应该通知注册插件，实际为%v", recorder.registered)
+	}
+	if !s.HasMethod(share.SendFileServiceName, "DownloadFile") {
+		t.Fatal("文件传输的协商服务应该已经注册")
+	}
+
+	c.send(1, share.SendFileServiceName, "DownloadFile", &share.DownloadFileArgs{FileName: "missing"}, nil)
+	if res := c.recv(); res.MessageStatusType() != protocol.Error || res.Metadata[protocol.ServiceError] != ErrFileNotFound.Error() {
+		t.Fatalf("协商服务应该可以正常调用: %v", res.Metadata)
+	}
+}
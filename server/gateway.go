@@ -1,11 +1,13 @@
 package server
 
 import (
+	"avrilko-rpc/log"
 	"avrilko-rpc/protocol"
 	"context"
 	"github.com/soheilhy/cmux"
 	"io"
 	"net"
+	"strings"
 )
 
 const (
@@ -18,7 +20,7 @@ func (s *Server) closeHTTP1APIGateway(ctx context.Context) error {
 	defer s.connMu.Unlock()
 
 	if s.gatewayHttpServer != nil {
-		return s.gatewayHttpServer.Shutdown(ctx)
+		return ignoreClosedErr(s.gatewayHttpServer.Shutdown(ctx))
 	}
 	return nil
 }
@@ -40,9 +42,23 @@ func (s *Server) startGateway(network string, ln net.Listener) net.Listener {
 		httpL := mu.Match(cmux.HTTP1Fast())
 		go s.startHTTP1APIGateway(httpL)
 	}
+
+	go func() {
+		if err := mu.Serve(); err != nil && !strings.Contains(err.Error(), "use of closed network connection") {
+			log.WarnF("多路复用服务退出，错误原因%v", err)
+		}
+	}()
 	return l
 }
 
+// 多路复用的listener共用同一个底层监听，关闭rpc监听之后网关再关闭会报已经关闭的错误，忽略掉
+func ignoreClosedErr(err error) error {
+	if err != nil && strings.Contains(err.Error(), "use of closed network connection") {
+		return nil
+	}
+	return err
+}
+
 // 根据协议来判断是不是自定义的tcp协议
 func matchIsAvrilkoRpc() cmux.Matcher {
 	return func(reader io.Reader) bool {
@@ -1,7 +1,230 @@
 package server
 
-import "net"
+import (
+	"avrilko-rpc/log"
+	"avrilko-rpc/protocol"
+	"avrilko-rpc/share"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
 
+// http网关请求和响应中使用的头部
+const (
+	XVersion           = "X-RPCX-Version"
+	XMessageType       = "X-RPCX-MessageType"
+	XHeartbeat         = "X-RPCX-Heartbeat"
+	XOneway            = "X-RPCX-Oneway"
+	XMessageStatusType = "X-RPCX-MessageStatusType"
+	XSerializeType     = "X-RPCX-SerializeType"
+	XMessageID         = "X-RPCX-MessageID"
+	XServicePath       = "X-RPCX-ServicePath"
+	XServiceMethod     = "X-RPCX-ServiceMethod"
+	XMeta              = "X-RPCX-Meta"
+	XErrorMessage      = "X-RPCX-ErrorMessage"
+)
+
+var ErrMissingServiceName = errors.New("http网关请求缺少服务提供者或者方法名")
+
+// 开启http网关，http请求会被转换成protocol.Message走和tcp一样的处理流程
 func (s *Server) startHTTP1APIGateway(ln net.Listener) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", s.handleGatewayRequest)
+	s.connMu.RLock()
+	for pattern, handler := range s.httpHandlers {
+		mux.Handle(pattern, handler)
+	}
+	s.connMu.RUnlock()
+
+	srv := &http.Server{
+		Handler:      mux,
+		ReadTimeout:  s.readTimeout,
+		WriteTimeout: s.writeTimeout,
+		ConnContext:  connContext,
+	}
+
+	s.connMu.Lock()
+	s.gatewayHttpServer = srv
+	s.connMu.Unlock()
+
+	if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed && !strings.Contains(err.Error(), "listener closed") {
+		log.ErrorF("http网关服务异常退出，错误原因%v", err)
+	}
+}
+
+// 在http网关上挂载其他的处理函数（需要在Serve之前调用，禁用了http网关则不会生效）
+func (s *Server) HandleHTTP(pattern string, handler http.Handler) {
+	s.connMu.Lock()
+	defer s.connMu.Unlock()
+	if s.httpHandlers == nil {
+		s.httpHandlers = make(map[string]http.Handler)
+	}
+	s.httpHandlers[pattern] = handler
+}
+
+// 将底层连接放到http请求的上下文中，让处理函数也能拿到
+func connContext(ctx context.Context, conn net.Conn) context.Context {
+	return context.WithValue(ctx, RemoteConnContextKey, conn)
+}
+
+// 处理http网关请求
+// 服务名和方法名可以放在X-RPCX-ServicePath和X-RPCX-ServiceMethod头部中，也可以使用 /服务名/方法名 这样的路径
+func (s *Server) handleGatewayRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx := share.WithValue(r.Context(), StartRequestContextKey, time.Now().UnixNano())
+	wh := w.Header()
+
+	if protocol.MaxMessageLength > 0 { // 和tcp一样限制消息体的长度，防止一个请求就把内存耗光
+		r.Body = http.MaxBytesReader(w, r.Body, int64(protocol.MaxMessageLength))
+	}
+	request, err := httpRequest2Message(r)
+	if err != nil {
+		wh.Set(XMessageStatusType, "Error")
+		wh.Set(XErrorMessage, err.Error())
+		if isBodyTooLarge(err) {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+		} else {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+		return
+	}
+	defer protocol.FreeMsg(request)
+
+	// 正在处理的消息数量+1（优雅关闭时需要等待网关请求也处理完）
+	atomic.AddInt32(&s.handlerMsgNum, 1)
+	defer atomic.AddInt32(&s.handlerMsgNum, -1)
+
+	wh.Set(XVersion, strconv.Itoa(int(request.Header[1])))
+	wh.Set(XMessageID, strconv.FormatUint(request.Seq(), 10))
+	wh.Set(XMessageType, strconv.Itoa(int(protocol.Response)))
+
+	if request.IsHeartbeat() { // 心跳直接返回
+		wh.Set(XHeartbeat, "true")
+		wh.Set(XMessageStatusType, "Normal")
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if err = s.auth(ctx, request); err != nil { // 鉴权失败
+		wh.Set(XMessageStatusType, "Error")
+		wh.Set(XErrorMessage, err.Error())
+		w.WriteHeader(http.StatusUnauthorized)
+		log.InfoF("http网关鉴权失败，%s,错误原因%v", r.RemoteAddr, err)
+		return
+	}
+
+	response, err := s.processRequest(ctx, request)
+	defer protocol.FreeMsg(response)
+
+	if err != nil { // 业务错误也返回200，错误信息放在头部中，和tcp的处理方式保持一致
+		wh.Set(XMessageStatusType, "Error")
+		wh.Set(XErrorMessage, err.Error())
+	} else {
+		wh.Set(XMessageStatusType, "Normal")
+	}
+
+	if len(response.Metadata) > 0 {
+		meta := url.Values{}
+		for k, v := range response.Metadata {
+			meta.Add(k, v)
+		}
+		wh.Set(XMeta, meta.Encode())
+	}
+	wh.Set(XSerializeType, strconv.Itoa(int(response.SerializeType())))
+	if response.SerializeType() == protocol.JSON {
+		wh.Set("Content-Type", "application/json")
+	}
+
+	if request.IsOneway() { // 单向请求不返回数据
+		w.WriteHeader(http.StatusNoContent)
+		s.Plugins.DoPostWriteResponse(ctx, request, response, nil)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	_, err = w.Write(response.Payload)
+	s.Plugins.DoPostWriteResponse(ctx, request, response, err)
+}
+
+// 请求体超过了http.MaxBytesReader的限制
+func isBodyTooLarge(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "request body too large")
+}
+
+// 将http请求转换为protocol.Message（没有指定序列化方式默认使用json，方便curl调试）
+func httpRequest2Message(r *http.Request) (*protocol.Message, error) {
+	request := protocol.GetPooledMsg()
+	request.SetMessageType(protocol.Request)
+
+	h := r.Header
+	if seq := h.Get(XMessageID); seq != "" {
+		id, err := strconv.ParseUint(seq, 10, 64)
+		if err != nil {
+			protocol.FreeMsg(request)
+			return nil, err
+		}
+		request.SetSeq(id)
+	}
+	request.SetHeartbeat(h.Get(XHeartbeat) == "true")
+	request.SetOneway(h.Get(XOneway) == "true")
+
+	request.SetSerializeType(protocol.JSON)
+	if st := h.Get(XSerializeType); st != "" {
+		serializeType, err := strconv.Atoi(st)
+		if err != nil {
+			protocol.FreeMsg(request)
+			return nil, err
+		}
+		request.SetSerializeType(protocol.SerializeType(serializeType))
+	}
+
+	request.Metadata = make(map[string]string)
+	if meta := h.Get(XMeta); meta != "" {
+		values, err := url.ParseQuery(meta)
+		if err != nil {
+			protocol.FreeMsg(request)
+			return nil, err
+		}
+		for k, v := range values {
+			if len(v) > 0 {
+				request.Metadata[k] = v[0]
+			}
+		}
+	}
+	if auth := h.Get("Authorization"); auth != "" {
+		request.Metadata[share.AuthKey] = auth
+	}
+
+	request.ServicePath = h.Get(XServicePath)
+	request.ServiceMethod = h.Get(XServiceMethod)
+	if request.ServicePath == "" && request.ServiceMethod == "" { // 头部没有则从路径中取 /服务名/方法名
+		paths := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		if len(paths) == 2 {
+			request.ServicePath, request.ServiceMethod = paths[0], paths[1]
+		}
+	}
+	if !request.IsHeartbeat() && (request.ServicePath == "" || request.ServiceMethod == "") {
+		protocol.FreeMsg(request)
+		return nil, ErrMissingServiceName
+	}
+
+	payload, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		protocol.FreeMsg(request)
+		return nil, err
+	}
+	request.Payload = payload
 
+	return request, nil
 }
@@ -0,0 +1,34 @@
+package server
+
+import (
+	"avrilko-rpc/protocol"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestGatewayRejectsOversizedBody(t *testing.T) {
+	old := protocol.MaxMessageLength
+	protocol.MaxMessageLength = 16
+	defer func() { protocol.MaxMessageLength = old }()
+
+	s := NewServer()
+	if err := s.RegisterName("Arith", new(Arith), ""); err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/Arith/Mul", strings.NewReader(`{"A":10000000,"B":20000000}`))
+	w := httptest.NewRecorder()
+	s.handleGatewayRequest(w, r)
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("超过长度限制的请求应该返回413，实际为%d", w.Code)
+	}
+
+	r = httptest.NewRequest(http.MethodPost, "/Arith/Mul", strings.NewReader(`{"A":2,"B":3}`))
+	w = httptest.NewRecorder()
+	s.handleGatewayRequest(w, r)
+	if w.Code != http.StatusOK || strings.TrimSpace(w.Body.String()) != `{"C":6}` {
+		t.Fatalf("未超过长度限制的请求应该正常处理，实际为%d %s", w.Code, w.Body.String())
+	}
+}
@@ -1,7 +1,295 @@
 package server
 
-import "net"
+import (
+	"avrilko-rpc/log"
+	"avrilko-rpc/protocol"
+	"avrilko-rpc/share"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+)
 
+// json-rpc 2.0 规范中定义的错误码
+const (
+	CodeParseJSONRPCError     = -32700 // 解析json失败
+	CodeInvalidJSONRPCRequest = -32600 // 不是合法的请求对象
+	CodeMethodNotFoundJSONRPC = -32601 // 方法不存在
+	CodeInvalidJSONRPCParams  = -32602 // 参数不合法
+	CodeInternalJSONRPCError  = -32603 // 内部错误
+	CodeServerJSONRPCError    = -32000 // 服务端自定义错误（鉴权失败）
+	CodeServiceJSONRPCError   = -32001 // 服务端自定义错误（业务方法返回的错误，错误码放在data中）
+)
+
+const jsonRPCVersion = "2.0"
+
+// json-rpc 请求对象
+type jsonrpcRequest struct {
+	Version string           `json:"jsonrpc"`
+	Method  string           `json:"method"`
+	Params  *json.RawMessage `json:"params,omitempty"`
+	ID      json.RawMessage  `json:"id,omitempty"` // 没有id的是通知，不需要返回（"id": null不是通知，解析出来是null）
+}
+
+// 只有没有id的才是通知
+func (req *jsonrpcRequest) isNotification() bool {
+	return req.ID == nil
+}
+
+// json-rpc 响应对象
+type jsonrpcResponse struct {
+	Version string           `json:"jsonrpc"`
+	Result  *json.RawMessage `json:"result,omitempty"`
+	Error   *JSONRPCError    `json:"error,omitempty"`
+	ID      *json.RawMessage `json:"id"` // 解析不出id的时候必须返回null
+}
+
+// json-rpc 错误对象
+type JSONRPCError struct {
+	Code    int         `json:"code"`
+	Message string      `json:"message"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+func (e *JSONRPCError) Error() string {
+	return e.Message
+}
+
+// 开启json-rpc 2.0网关
 func (s *Server) startJSONRPC2(ln net.Listener) {
-	
+	srv := &http.Server{
+		Handler:      http.HandlerFunc(s.handleJSONRPC2Request),
+		ReadTimeout:  s.readTimeout,
+		WriteTimeout: s.writeTimeout,
+		ConnContext:  connContext,
+	}
+
+	s.connMu.Lock()
+	s.jsonRPCHttpServer = srv
+	s.connMu.Unlock()
+
+	if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed && !strings.Contains(err.Error(), "listener closed") {
+		log.ErrorF("json-rpc网关服务异常退出，错误原因%v", err)
+	}
+}
+
+// 关闭json-rpc网关
+func (s *Server) closeJSONRPC2(ctx context.Context) error {
+	s.connMu.Lock()
+	defer s.connMu.Unlock()
+
+	if s.jsonRPCHttpServer != nil {
+		return ignoreClosedErr(s.jsonRPCHttpServer.Shutdown(ctx))
+	}
+	return nil
+}
+
+// 处理json-rpc请求（支持批量请求）
+func (s *Server) handleJSONRPC2Request(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if protocol.MaxMessageLength > 0 { // 和tcp一样限制消息体的长度
+		r.Body = http.MaxBytesReader(w, r.Body, int64(protocol.MaxMessageLength))
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeJSONRPCResponse(w, newJSONRPCErrorResponse(nil, CodeParseJSONRPCError, err.Error()))
+		return
+	}
+
+	body = bytes.TrimSpace(body)
+	if len(body) > 0 && body[0] == '[' { // 批量请求
+		var batch []json.RawMessage
+		if err := json.Unmarshal(body, &batch); err != nil {
+			writeJSONRPCResponse(w, newJSONRPCErrorResponse(nil, CodeParseJSONRPCError, err.Error()))
+			return
+		}
+		if len(batch) == 0 {
+			writeJSONRPCResponse(w, newJSONRPCErrorResponse(nil, CodeInvalidJSONRPCRequest, "批量请求不能为空"))
+			return
+		}
+
+		responses := make([]*jsonrpcResponse, 0, len(batch))
+		for _, raw := range batch {
+			if res := s.handleJSONRPC2Raw(r, raw); res != nil {
+				responses = append(responses, res)
+			}
+		}
+		if len(responses) == 0 { // 全部都是通知
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		writeJSONRPCResponse(w, responses)
+		return
+	}
+
+	res := s.handleJSONRPC2Raw(r, body)
+	if res == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeJSONRPCResponse(w, res)
+}
+
+// 解析并处理单个json-rpc请求，通知类型的请求返回nil
+func (s *Server) handleJSONRPC2Raw(r *http.Request, raw []byte) *jsonrpcResponse {
+	req := &jsonrpcRequest{}
+	if err := json.Unmarshal(raw, req); err != nil {
+		if _, ok := err.(*json.SyntaxError); ok {
+			return newJSONRPCErrorResponse(nil, CodeParseJSONRPCError, err.Error())
+		}
+		return newJSONRPCErrorResponse(nil, CodeInvalidJSONRPCRequest, err.Error())
+	}
+
+	var id *json.RawMessage
+	if !req.isNotification() {
+		id = &req.ID
+	}
+	if req.Version != jsonRPCVersion || req.Method == "" {
+		return newJSONRPCErrorResponse(id, CodeInvalidJSONRPCRequest, "不是合法的json-rpc 2.0请求")
+	}
+
+	res, jsonErr := s.handleJSONRPC2(r, req)
+	if req.isNotification() { // 通知不需要返回任何东西，包括错误
+		return nil
+	}
+	if jsonErr != nil {
+		return &jsonrpcResponse{Version: jsonRPCVersion, Error: jsonErr, ID: id}
+	}
+	return &jsonrpcResponse{Version: jsonRPCVersion, Result: res, ID: id}
+}
+
+// 将json-rpc请求转换为protocol.Message走和tcp一样的处理流程
+func (s *Server) handleJSONRPC2(r *http.Request, req *jsonrpcRequest) (*json.RawMessage, *JSONRPCError) {
+	ctx := share.WithValue(r.Context(), StartRequestContextKey, time.Now().UnixNano())
+	if err := s.Plugins.DoPreReadRequest(ctx); err != nil {
+		return nil, &JSONRPCError{Code: CodeServerJSONRPCError, Message: err.Error()}
+	}
+
+	request := protocol.GetPooledMsg()
+	defer protocol.FreeMsg(request)
+	request.SetMessageType(protocol.Request)
+	request.SetSerializeType(protocol.JSON)
+	request.SetOneway(req.isNotification())
+
+	// "服务名.方法名"，没有点的当作函数调用（函数注册时服务名和方法名相同）
+	if index := strings.LastIndex(req.Method, "."); index > 0 {
+		request.ServicePath, request.ServiceMethod = req.Method[:index], req.Method[index+1:]
+	} else {
+		request.ServicePath, request.ServiceMethod = req.Method, req.Method
+	}
+
+	request.Metadata = make(map[string]string)
+	if meta := r.Header.Get(XMeta); meta != "" {
+		if values, err := url.ParseQuery(meta); err == nil {
+			for k, v := range values {
+				if len(v) > 0 {
+					request.Metadata[k] = v[0]
+				}
+			}
+		}
+	}
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		request.Metadata[share.AuthKey] = auth
+	}
+
+	params, jsonErr := unwrapJSONRPCParams(req.Params)
+	if jsonErr != nil {
+		return nil, jsonErr
+	}
+	request.Payload = params
+
+	if err := s.Plugins.DoPostReadRequest(ctx, request, nil); err != nil {
+		return nil, &JSONRPCError{Code: CodeServerJSONRPCError, Message: err.Error()}
+	}
+
+	if err := s.auth(ctx, request); err != nil {
+		return nil, &JSONRPCError{Code: CodeServerJSONRPCError, Message: err.Error()}
+	}
+
+	if !s.HasMethod(request.ServicePath, request.ServiceMethod) {
+		return nil, &JSONRPCError{Code: CodeMethodNotFoundJSONRPC, Message: "方法不存在: " + req.Method}
+	}
+
+	// 正在处理的消息数量+1（优雅关闭时需要等待网关请求也处理完）
+	atomic.AddInt32(&s.handlerMsgNum, 1)
+	defer atomic.AddInt32(&s.handlerMsgNum, -1)
+
+	response, err := s.processRequest(ctx, request)
+	defer protocol.FreeMsg(response)
+	s.Plugins.DoPostWriteResponse(ctx, request, response, nil)
+	if err != nil {
+		return nil, newJSONRPCServiceError(response, err)
+	}
+
+	result := json.RawMessage(response.Payload)
+	if len(result) == 0 {
+		result = json.RawMessage("null")
+	}
+	return &result, nil
+}
+
+// 将处理请求返回的错误转换为json-rpc错误：参数解析失败是-32602，其他的业务错误使用服务端自定义的错误码
+func newJSONRPCServiceError(response *protocol.Message, err error) *JSONRPCError {
+	if errors.Is(err, ErrInvalidArgs) {
+		return &JSONRPCError{Code: CodeInvalidJSONRPCParams, Message: err.Error()}
+	}
+
+	jsonErr := &JSONRPCError{Code: CodeServiceJSONRPCError, Message: err.Error()}
+	if code := response.Metadata[protocol.ServiceErrorCode]; code != "" {
+		jsonErr.Data = map[string]string{protocol.ServiceErrorCode: code}
+	}
+	return jsonErr
+}
+
+// 取出请求参数：对象原样使用，数组必须只有一个元素（和net/rpc/jsonrpc的约定一致），没有参数当作null
+func unwrapJSONRPCParams(params *json.RawMessage) ([]byte, *JSONRPCError) {
+	if params == nil {
+		return []byte("null"), nil
+	}
+
+	data := bytes.TrimSpace(*params)
+	if len(data) == 0 || data[0] != '[' {
+		return data, nil
+	}
+
+	var array []json.RawMessage
+	if err := json.Unmarshal(data, &array); err != nil {
+		return nil, &JSONRPCError{Code: CodeInvalidJSONRPCParams, Message: err.Error()}
+	}
+	if len(array) != 1 {
+		return nil, &JSONRPCError{Code: CodeInvalidJSONRPCParams, Message: "数组形式的参数只能有一个元素"}
+	}
+	return array[0], nil
+}
+
+func newJSONRPCErrorResponse(id *json.RawMessage, code int, message string) *jsonrpcResponse {
+	return &jsonrpcResponse{
+		Version: jsonRPCVersion,
+		Error:   &JSONRPCError{Code: code, Message: message},
+		ID:      id,
+	}
+}
+
+// 写出json-rpc响应
+func writeJSONRPCResponse(w http.ResponseWriter, res interface{}) {
+	data, err := json.Marshal(res)
+	if err != nil {
+		log.WarnF("json-rpc响应序列化失败，错误原因%v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
 }
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"avrilko-rpc/protocol"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func (t *Arith) CodeFail(ctx context.Context, args *ArithArgs, reply *ArithReply) error {
+	return &CodeError{Code: "biz_error", Message: "业务出错了"}
+}
+
+// 发送一个json-rpc请求，返回http状态码和解析后的响应
+func doJSONRPC2(t *testing.T, s *Server, body string) (int, map[string]json.RawMessage) {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	s.handleJSONRPC2Request(w, r)
+	if w.Code == http.StatusNoContent {
+		return w.Code, nil
+	}
+	var res map[string]json.RawMessage
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatalf("响应不是合法的json: %v %s", err, w.Body.String())
+	}
+	return w.Code, res
+}
+
+func jsonRPCErrorOf(t *testing.T, res map[string]json.RawMessage) *JSONRPCError {
+	t.Helper()
+	jsonErr := &JSONRPCError{}
+	if err := json.Unmarshal(res["error"], jsonErr); err != nil {
+		t.Fatalf("响应中没有error: %v", res)
+	}
+	return jsonErr
+}
+
+func newJSONRPC2TestServer(t *testing.T) *Server {
+	s := NewServer()
+	if err := s.RegisterName("Arith", new(Arith), ""); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestJSONRPC2NullIDIsNotNotification(t *testing.T) {
+	s := newJSONRPC2TestServer(t)
+
+	code, res := doJSONRPC2(t, s, `{"jsonrpc":"2.0","method":"Arith.Mul","params":{"A":2,"B":3},"id":null}`)
+	if code != http.StatusOK || res == nil {
+		t.Fatalf("id为null的请求需要返回响应，实际为%d", code)
+	}
+	if string(res["id"]) != "null" || string(res["result"]) != `{"C":6}` {
+		t.Fatalf("响应不正确: id=%s result=%s", res["id"], res["result"])
+	}
+
+	if code, _ = doJSONRPC2(t, s, `{"jsonrpc":"2.0","method":"Arith.Mul","params":{"A":2,"B":3}}`); code != http.StatusNoContent {
+		t.Fatalf("没有id的通知不应该返回响应，实际为%d", code)
+	}
+}
+
+func TestJSONRPC2ErrorCodes(t *testing.T) {
+	s := newJSONRPC2TestServer(t)
+
+	_, res := doJSONRPC2(t, s, `{"jsonrpc":"2.0","method":"Arith.Mul","params":{"A":"x"},"id":1}`)
+	if jsonErr := jsonRPCErrorOf(t, res); jsonErr.Code != CodeInvalidJSONRPCParams {
+		t.Fatalf("参数解析失败应该返回%d，实际为%d", CodeInvalidJSONRPCParams, jsonErr.Code)
+	}
+
+	_, res = doJSONRPC2(t, s, `{"jsonrpc":"2.0","method":"Arith.Fail","params":{},"id":2}`)
+	if jsonErr := jsonRPCErrorOf(t, res); jsonErr.Code != CodeServiceJSONRPCError || jsonErr.Data != nil {
+		t.Fatalf("业务错误应该返回%d且没有data，实际为%d %v", CodeServiceJSONRPCError, jsonErr.Code, jsonErr.Data)
+	}
+
+	_, res = doJSONRPC2(t, s, `{"jsonrpc":"2.0","method":"Arith.CodeFail","params":{},"id":3}`)
+	jsonErr := jsonRPCErrorOf(t, res)
+	data, _ := jsonErr.Data.(map[string]interface{})
+	if jsonErr.Code != CodeServiceJSONRPCError || data[protocol.ServiceErrorCode] != "biz_error" {
+		t.Fatalf("带错误码的业务错误应该把错误码放在data中，实际为%d %v", jsonErr.Code, jsonErr.Data)
+	}
+}
+
+func TestJSONRPC2RejectsOversizedBody(t *testing.T) {
+	old := protocol.MaxMessageLength
+	protocol.MaxMessageLength = 16
+	defer func() { protocol.MaxMessageLength = old }()
+
+	s := newJSONRPC2TestServer(t)
+	_, res := doJSONRPC2(t, s, `{"jsonrpc":"2.0","method":"Arith.Mul","params":{"A":2,"B":3},"id":1}`)
+	if jsonErr := jsonRPCErrorOf(t, res); !isBodyTooLarge(jsonErr) {
+		t.Fatalf("超过长度限制的请求应该返回错误，实际为%v", jsonErr)
+	}
+}
@@ -42,3 +42,21 @@ func WithOnShutdown(shutdownFunc ...func(server *Server)) OptionFunc {
 		server.onShutdown = append(server.onShutdown, shutdownFunc...)
 	}
 }
+
+// 使用固定数量的协程处理请求，queueLen为排队的长度
+// 队列满了之后每个连接还可以有queueLen个（至少1个）请求等待进入队列，这期间心跳和取消消息照常处理；
+// 连接上等待的请求也满了就会暂停读取这个连接直到有空闲，这时后面的心跳和取消消息也读不到（队头阻塞），
+// 客户端可能因为心跳超时断开连接，不能接受时使用WithRejectWhenBusy
+func WithWorkerPool(size, queueLen int) OptionFunc {
+	return func(server *Server) {
+		server.workerPoolSize = size
+		server.workerQueueLen = queueLen
+	}
+}
+
+// 协程池排满时直接回复客户端ErrServerBusy，而不是暂停读取连接
+func WithRejectWhenBusy(flag bool) OptionFunc {
+	return func(server *Server) {
+		server.rejectWhenBusy = flag
+	}
+}
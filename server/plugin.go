@@ -2,16 +2,16 @@ package server
 
 import (
 	"avrilko-rpc/protocol"
-	"avrilko-rpc/share"
 	"context"
 	"net"
+	"sync"
 )
 
 // 插件接口(在程序不同生命周期时切入程序，实现不同的功能)
 type PluginContainer interface {
 	Add(plugin Plugin)    // 添加插件
 	Remove(plugin Plugin) // 移除插件
-	All(plugin Plugin)    // 获取所有插件
+	All() []Plugin        // 获取所有插件
 
 	// 注册相关周期
 	DoRegister(name string, object interface{}, metadata string) error                       // 反射注册对象时调用
@@ -36,75 +36,246 @@ type PluginContainer interface {
 	DoPostWriteResponse(ctx context.Context, request, response *protocol.Message, err error) error // 写入数据之后调用
 }
 
-// 最原始的plugin(可以是任何类型)
+// 最原始的plugin(可以是任何类型)，实现了下面哪个接口就会在对应的周期被调用
 type Plugin interface {
 }
 
+type (
+	// 反射注册对象时调用
+	RegisterPlugin interface {
+		Register(name string, object interface{}, metadata string) error
+	}
+
+	// 直接注册函数时调用
+	RegisterFunctionPlugin interface {
+		RegisterFunction(name, funcName string, funcObject interface{}, metadata string) error
+	}
+
+	// 反注册时调用
+	UnregisterPlugin interface {
+		Unregister(name string) error
+	}
+
+	// 连接被listen accept后调用，返回false则关闭连接
+	PostConnAcceptPlugin interface {
+		HandleConnAccept(conn net.Conn) (net.Conn, bool)
+	}
+
+	// 连接被关闭后调用
+	PostConnClosePlugin interface {
+		HandleConnClose(conn net.Conn) bool
+	}
+
+	// req数据转换为protocol.Message前调用
+	PreReadRequestPlugin interface {
+		PreReadRequest(ctx context.Context) error
+	}
+
+	// req数据转换为protocol.Message后调用
+	PostReadRequestPlugin interface {
+		PostReadRequest(ctx context.Context, message *protocol.Message, e error) error
+	}
+
+	// 处理请求前（路由查找前）调用，返回错误则不再处理该请求
+	PreHandleRequestPlugin interface {
+		PreHandleRequest(ctx context.Context, message *protocol.Message) error
+	}
+
+	// 调用自定义方法前调用，可以替换请求参数
+	PreCallPlugin interface {
+		PreCall(ctx context.Context, serviceName, serviceMethod string, request interface{}) (interface{}, error)
+	}
+
+	// 调用自定义方法后调用，可以替换返回值
+	PostCallPlugin interface {
+		PostCall(ctx context.Context, serviceName, serviceMethod string, request, response interface{}) (interface{}, error)
+	}
+
+	// 写入数据之前调用
+	PreWriteResponsePlugin interface {
+		PreWriteResponse(ctx context.Context, request, response *protocol.Message) error
+	}
+
+	// 写入数据之后调用
+	PostWriteResponsePlugin interface {
+		PostWriteResponse(ctx context.Context, request, response *protocol.Message, err error) error
+	}
+)
+
 // PluginContainer默认实现
+// 插件按添加的顺序执行，任何一个插件返回错误或者false都会中断后面的插件
+// 连接关闭和写入数据之后只是通知，不管前面的插件返回什么每个插件都会被调用（否则连接数、指标之类的统计会漏掉）
 type pluginContainer struct {
-	plugin []Plugin
+	mu     sync.RWMutex
+	plugin []Plugin // 写时复制，读的时候不需要一直持有锁
 }
 
 func (p *pluginContainer) Add(plugin Plugin) {
-	panic("implement me")
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	plugins := make([]Plugin, 0, len(p.plugin)+1)
+	plugins = append(plugins, p.plugin...)
+	p.plugin = append(plugins, plugin)
 }
 
 func (p *pluginContainer) Remove(plugin Plugin) {
-	panic("implement me")
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	plugins := make([]Plugin, 0, len(p.plugin))
+	for _, pp := range p.plugin {
+		if pp != plugin {
+			plugins = append(plugins, pp)
+		}
+	}
+	p.plugin = plugins
 }
 
-func (p *pluginContainer) All(plugin Plugin) {
-	panic("implement me")
+func (p *pluginContainer) All() []Plugin {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.plugin
 }
 
 func (p *pluginContainer) DoRegister(name string, object interface{}, metadata string) error {
+	for _, plugin := range p.All() {
+		if plugin, ok := plugin.(RegisterPlugin); ok {
+			if err := plugin.Register(name, object, metadata); err != nil {
+				return err
+			}
+		}
+	}
 	return nil
 }
 
 func (p *pluginContainer) DoRegisterFunction(name, funcName string, funcObject interface{}, metadata string) error {
+	for _, plugin := range p.All() {
+		if plugin, ok := plugin.(RegisterFunctionPlugin); ok {
+			if err := plugin.RegisterFunction(name, funcName, funcObject, metadata); err != nil {
+				return err
+			}
+		}
+	}
 	return nil
 }
 
 func (p *pluginContainer) DoUnregister(name string) error {
+	for _, plugin := range p.All() {
+		if plugin, ok := plugin.(UnregisterPlugin); ok {
+			if err := plugin.Unregister(name); err != nil {
+				return err
+			}
+		}
+	}
 	return nil
 }
 
 func (p *pluginContainer) DoPostConnAccept(conn net.Conn) (net.Conn, bool) {
+	var flag bool
+	for _, plugin := range p.All() {
+		if plugin, ok := plugin.(PostConnAcceptPlugin); ok {
+			conn, flag = plugin.HandleConnAccept(conn)
+			if !flag {
+				return conn, false
+			}
+		}
+	}
 	return conn, true
 }
 
+// 所有插件都会被调用，有插件返回false时返回false
 func (p *pluginContainer) DoPostConnClose(conn net.Conn) bool {
-	return true
+	result := true
+	for _, plugin := range p.All() {
+		if plugin, ok := plugin.(PostConnClosePlugin); ok {
+			if !plugin.HandleConnClose(conn) {
+				result = false
+			}
+		}
+	}
+	return result
 }
 
 func (p *pluginContainer) DoPreReadRequest(ctx context.Context) error {
+	for _, plugin := range p.All() {
+		if plugin, ok := plugin.(PreReadRequestPlugin); ok {
+			if err := plugin.PreReadRequest(ctx); err != nil {
+				return err
+			}
+		}
+	}
 	return nil
 }
 
 func (p *pluginContainer) DoPostReadRequest(ctx context.Context, message *protocol.Message, e error) error {
+	for _, plugin := range p.All() {
+		if plugin, ok := plugin.(PostReadRequestPlugin); ok {
+			if err := plugin.PostReadRequest(ctx, message, e); err != nil {
+				return err
+			}
+		}
+	}
 	return nil
 }
 
 func (p *pluginContainer) DoPreHandleRequest(ctx context.Context, message *protocol.Message) error {
+	for _, plugin := range p.All() {
+		if plugin, ok := plugin.(PreHandleRequestPlugin); ok {
+			if err := plugin.PreHandleRequest(ctx, message); err != nil {
+				return err
+			}
+		}
+	}
 	return nil
 }
 
 func (p *pluginContainer) DoPreCall(ctx context.Context, serviceName, serviceMethod string, request interface{}) (interface{}, error) {
+	var err error
+	for _, plugin := range p.All() {
+		if plugin, ok := plugin.(PreCallPlugin); ok {
+			request, err = plugin.PreCall(ctx, serviceName, serviceMethod, request)
+			if err != nil {
+				return request, err
+			}
+		}
+	}
 	return request, nil
 }
 
 func (p *pluginContainer) DoPostCall(ctx context.Context, serviceName, serviceMethod string, request interface{}, response interface{}) (interface{}, error) {
+	var err error
+	for _, plugin := range p.All() {
+		if plugin, ok := plugin.(PostCallPlugin); ok {
+			response, err = plugin.PostCall(ctx, serviceName, serviceMethod, request, response)
+			if err != nil {
+				return response, err
+			}
+		}
+	}
 	return response, nil
 }
 
 func (p *pluginContainer) DoPreWriteResponse(ctx context.Context, request, response *protocol.Message) error {
-	s := ctx.(*share.Context)
-	m := make(map[string]string)
-	m["name"] = "avrilko"
-	s.SetValue(share.ResMetaDataKey, m)
+	for _, plugin := range p.All() {
+		if plugin, ok := plugin.(PreWriteResponsePlugin); ok {
+			if err := plugin.PreWriteResponse(ctx, request, response); err != nil {
+				return err
+			}
+		}
+	}
 	return nil
 }
 
+// 所有插件都会被调用，返回第一个插件返回的错误
 func (p *pluginContainer) DoPostWriteResponse(ctx context.Context, request, response *protocol.Message, err error) error {
-	return nil
+	var firstErr error
+	for _, plugin := range p.All() {
+		if plugin, ok := plugin.(PostWriteResponsePlugin); ok {
+			if e := plugin.PostWriteResponse(ctx, request, response, err); e != nil && firstErr == nil {
+				firstErr = e
+			}
+		}
+	}
+	return firstErr
 }
@@ -0,0 +1,145 @@
+package server
+
+import (
+	"avrilko-rpc/protocol"
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+)
+
+// 记录调用顺序的插件，reject为true时拒绝连接和请求
+type orderPlugin struct {
+	name   string
+	reject bool
+	calls  *[]string
+}
+
+func (p *orderPlugin) record(hook string) {
+	*p.calls = append(*p.calls, hook+":"+p.name)
+}
+
+func (p *orderPlugin) HandleConnAccept(conn net.Conn) (net.Conn, bool) {
+	p.record("accept")
+	return conn, !p.reject
+}
+
+func (p *orderPlugin) HandleConnClose(conn net.Conn) bool {
+	p.record("close")
+	return !p.reject
+}
+
+func (p *orderPlugin) PreReadRequest(ctx context.Context) error {
+	p.record("preRead")
+	return p.err()
+}
+
+func (p *orderPlugin) PreHandleRequest(ctx context.Context, message *protocol.Message) error {
+	p.record("preHandle")
+	return p.err()
+}
+
+func (p *orderPlugin) PreCall(ctx context.Context, serviceName, serviceMethod string, request interface{}) (interface{}, error) {
+	p.record("preCall")
+	return request, p.err()
+}
+
+func (p *orderPlugin) PostWriteResponse(ctx context.Context, request, response *protocol.Message, err error) error {
+	p.record("postWrite")
+	return p.err()
+}
+
+func (p *orderPlugin) err() error {
+	if p.reject {
+		return errors.New(p.name + "拒绝")
+	}
+	return nil
+}
+
+func newOrderPlugins(rejects ...bool) (*pluginContainer, []*orderPlugin, *[]string) {
+	calls := new([]string)
+	container := &pluginContainer{}
+	plugins := make([]*orderPlugin, 0, len(rejects))
+	for i, reject := range rejects {
+		plugin := &orderPlugin{name: string(rune('a' + i)), reject: reject, calls: calls}
+		container.Add(plugin)
+		plugins = append(plugins, plugin)
+	}
+	return container, plugins, calls
+}
+
+// 插件按添加的顺序执行
+func TestPluginContainerOrder(t *testing.T) {
+	container, _, calls := newOrderPlugins(false, false, false)
+
+	if _, ok := container.DoPostConnAccept(nil); !ok {
+		t.Fatal("没有插件拒绝，连接不应该被拒绝")
+	}
+	if err := container.DoPreHandleRequest(context.Background(), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"accept:a", "accept:b", "accept:c", "preHandle:a", "preHandle:b", "preHandle:c"}
+	if !reflect.DeepEqual(*calls, want) {
+		t.Fatalf("插件的调用顺序不正确\n实际: %v\n期望: %v", *calls, want)
+	}
+}
+
+// 能拒绝的周期在第一个拒绝的插件处中断
+func TestPluginContainerRejectStopsEarly(t *testing.T) {
+	container, _, calls := newOrderPlugins(false, true, false)
+
+	if _, ok := container.DoPostConnAccept(nil); ok {
+		t.Fatal("插件b拒绝了连接")
+	}
+	if err := container.DoPreReadRequest(context.Background()); err == nil {
+		t.Fatal("插件b拒绝了读请求")
+	}
+	if err := container.DoPreHandleRequest(context.Background(), nil); err == nil {
+		t.Fatal("插件b拒绝了请求")
+	}
+	if _, err := container.DoPreCall(context.Background(), "Arith", "Mul", nil); err == nil {
+		t.Fatal("插件b拒绝了调用")
+	}
+
+	want := []string{"accept:a", "accept:b", "preRead:a", "preRead:b", "preHandle:a", "preHandle:b", "preCall:a", "preCall:b"}
+	if !reflect.DeepEqual(*calls, want) {
+		t.Fatalf("拒绝之后不应该再调用后面的插件\n实际: %v\n期望: %v", *calls, want)
+	}
+}
+
+// 连接关闭和写入数据之后的通知每个插件都会收到
+func TestPluginContainerNotifyAll(t *testing.T) {
+	container, _, calls := newOrderPlugins(false, true, true)
+
+	if container.DoPostConnClose(nil) {
+		t.Fatal("有插件返回false时DoPostConnClose应该返回false")
+	}
+	err := container.DoPostWriteResponse(context.Background(), nil, nil, nil)
+	if err == nil || err.Error() != "b拒绝" {
+		t.Fatalf("应该返回第一个插件的错误，实际为: %v", err)
+	}
+
+	want := []string{"close:a", "close:b", "close:c", "postWrite:a", "postWrite:b", "postWrite:c"}
+	if !reflect.DeepEqual(*calls, want) {
+		t.Fatalf("每个插件都应该被调用\n实际: %v\n期望: %v", *calls, want)
+	}
+}
+
+// 移除的插件不再被调用，其他插件的顺序不变
+func TestPluginContainerRemove(t *testing.T) {
+	container, plugins, calls := newOrderPlugins(false, false, false)
+
+	container.Remove(plugins[1])
+	container.Remove(&orderPlugin{name: "x", calls: calls}) // 移除不存在的插件什么都不做
+	if got := len(container.All()); got != 2 {
+		t.Fatalf("移除之后应该剩下2个插件，实际为%d个", got)
+	}
+
+	container.DoPostConnClose(nil)
+	want := []string{"close:a", "close:c"}
+	if !reflect.DeepEqual(*calls, want) {
+		t.Fatalf("移除的插件不应该再被调用\n实际: %v\n期望: %v", *calls, want)
+	}
+}
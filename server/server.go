@@ -16,6 +16,7 @@ import (
 	"os/signal"
 	"reflect"
 	"runtime"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -23,7 +24,11 @@ import (
 	"time"
 )
 
-var ErrServerClosed = errors.New("主服务已经关闭")
+var (
+	ErrServerClosed   = errors.New("主服务已经关闭")
+	ErrConnNotActive  = errors.New("连接不存在或者已经关闭")
+	ErrRequestTimeout = errors.New("请求已经超时，不再处理")
+)
 
 const (
 	ReadBuffSize = 1024 // 读取消息时候缓冲区大小
@@ -48,16 +53,18 @@ type Server struct {
 	readTimeout  time.Duration // 读超时
 	writeTimeout time.Duration // 写超时
 
-	gatewayHttpServer     *http.Server // 当启用http网关时候被挂载
-	disableHTTPGateway    bool         // 是否禁用http网关服务（开启时候方便测试和调试rpc服务）
-	disableJSONRPCGateway bool         // 是否禁用json rpc网关服务 
+	gatewayHttpServer     *http.Server            // 当启用http网关时候被挂载
+	httpHandlers          map[string]http.Handler // 挂载到http网关上的其他处理函数（比如/metrics）
+	jsonRPCHttpServer     *http.Server            // 当启用json rpc网关时候被挂载
+	disableHTTPGateway    bool                    // 是否禁用http网关服务（开启时候方便测试和调试rpc服务）
+	disableJSONRPCGateway bool                    // 是否禁用json rpc网关服务
 
 	serviceMapMu sync.RWMutex        // 服务提供者map读写锁
 	serviceMap   map[string]*service // 服务提供者集合map
 
-	connMu     sync.RWMutex          // 各个活跃连接读写锁
-	activeConn map[net.Conn]struct{} // 每个活跃的连接，map结构防止重复
-	doneChan   chan struct{}         // 服务结束chan
+	connMu     sync.RWMutex             // 各个活跃连接读写锁
+	activeConn map[net.Conn]*connWriter // 每个活跃的连接和它的写入者，map结构防止重复
+	doneChan   chan struct{}            // 服务结束chan
 
 	inShutdown int32             //服务是否关闭 1为关闭 0为正在运行
 	onShutdown []func(s *Server) // 服务结束后执行的钩子函数
@@ -69,6 +76,13 @@ type Server struct {
 	AuthFunc func(ctx context.Context, request *protocol.Message, token string) error // 认证函数
 
 	handlerMsgNum int32 // 正在处理的消息数量
+
+	fileTransfer *FileTransfer // 开启文件传输服务时候被挂载
+
+	workerPoolSize int         // 处理请求的协程数量，为0则每个请求一个协程
+	workerQueueLen int         // 协程池的排队长度
+	rejectWhenBusy bool        // 协程池排满时直接拒绝请求（默认暂停读取连接等待空闲）
+	workerPool     *workerPool // 开启协程池时候被挂载
 }
 
 // 初始化服务
@@ -76,7 +90,7 @@ func NewServer(opts ...OptionFunc) *Server {
 	server := &Server{
 		serviceMapMu: sync.RWMutex{},
 		serviceMap:   make(map[string]*service),
-		activeConn:   make(map[net.Conn]struct{}),
+		activeConn:   make(map[net.Conn]*connWriter),
 		doneChan:     make(chan struct{}),
 		Plugins:      &pluginContainer{},
 	}
@@ -87,6 +101,10 @@ func NewServer(opts ...OptionFunc) *Server {
 		}
 	}
 
+	if server.workerPoolSize > 0 {
+		server.workerPool = newWorkerPool(server.workerPoolSize, server.workerQueueLen, server.rejectWhenBusy)
+	}
+
 	return server
 }
 
@@ -104,9 +122,10 @@ func (s *Server) Serve(network, address string) error {
 // 开启服务
 func (s *Server) ServeListener(network string, ln net.Listener) error {
 	// 开启信号量监听
+	log.InfoF("rpc listen at %s", ln.Addr().String())
 	s.startShutdownServe()
-	// 开启网关
-	s.startGateway(network, ln)
+	// 开启网关（tcp协议会被多路复用，rpc请求只从分出来的listener中读取）
+	ln = s.startGateway(network, ln)
 
 	return s.serveListener(ln)
 }
@@ -165,17 +184,20 @@ func (s *Server) serveListener(ln net.Listener) error {
 		conn, ok := s.Plugins.DoPostConnAccept(conn)
 		if !ok { // 不允许链接则关闭（可能是限流没通过，验证没通过，业务方面的自己用插件扩展...）
 			s.closeChannel(conn)
+			s.Plugins.DoPostConnClose(conn) // 前面的插件可能已经接受了这个连接，通知它们连接关闭了
+			continue
 		}
 		s.connMu.Lock()
-		s.activeConn[conn] = struct{}{}
+		w := newConnWriter(conn, s.writeTimeout)
+		s.activeConn[conn] = w
 		s.connMu.Unlock()
 
-		go s.serveConn(conn)
+		go s.serveConn(conn, w)
 	}
 }
 
 // 开始处理消息
-func (s *Server) serveConn(conn net.Conn) {
+func (s *Server) serveConn(conn net.Conn, w *connWriter) {
 	// 单个conn协程中没有权限影响主进程panic，所有panic会这一层处理
 	defer func() {
 		if err := recover(); err != nil { // 发生panic
@@ -199,9 +221,9 @@ func (s *Server) serveConn(conn net.Conn) {
 		return
 	}
 
-	now := time.Now()
 	// tls连接需要先握手
 	if tlsL, ok := conn.(*tls.Conn); ok {
+		now := time.Now()
 		if s.readTimeout != 0 {
 			tlsL.SetReadDeadline(now.Add(s.readTimeout))
 		}
@@ -215,6 +237,15 @@ func (s *Server) serveConn(conn net.Conn) {
 	}
 	// 初始化读取缓冲区
 	rBuff := bufio.NewReaderSize(conn, ReadBuffSize)
+	inflight := &inflightRequests{cancels: make(map[uint64]context.CancelFunc)} // 这个连接上正在处理的请求
+
+	// 协程池排满时阻塞等待的是单独的派发协程，读协程可以继续处理心跳和取消消息，连接上等待的请求也排满了读协程才会暂停
+	var backlog chan poolTask
+	if s.workerPool != nil && !s.workerPool.reject {
+		backlog = make(chan poolTask, s.connBacklogLen())
+		defer close(backlog)
+		go s.dispatch(backlog)
+	}
 	for {
 		// 判断此时服务是否已经关闭
 		if s.isShutdown() {
@@ -222,8 +253,8 @@ func (s *Server) serveConn(conn net.Conn) {
 			return
 		}
 
-		if s.readTimeout != 0 { // 设置读取的超时时间
-			conn.SetReadDeadline(now.Add(s.readTimeout))
+		if s.readTimeout != 0 { // 设置读取的超时时间（每次读之前重新计算，连接上一直有请求就不会超时）
+			conn.SetReadDeadline(time.Now().Add(s.readTimeout))
 		}
 
 		ctx := share.WithValue(context.Background(), RemoteConnContextKey, conn)
@@ -239,83 +270,58 @@ func (s *Server) serveConn(conn net.Conn) {
 			return
 		}
 
-		// 要开始写入了
-		if s.writeTimeout != 0 {
-			conn.SetWriteDeadline(now.Add(s.writeTimeout))
+		if request.IsCancel() { // 客户端不等了，取消这个连接上对应seq的请求（不需要鉴权，只能取消自己连接上的请求）
+			inflight.cancel(request.Seq())
+			protocol.FreeMsg(request)
+			continue
 		}
 
 		// 将开始时间写上下文中
 		ctx = share.WithLocalValue(ctx, StartRequestContextKey, time.Now().UnixNano())
 		if !request.IsHeartbeat() { // auth鉴权
 			err := s.auth(ctx, request)
-			if err != nil { // 鉴权失败
-				if !request.IsOneway() { // 需要回复客户端鉴权失败
-					response := request.Clone()                // 复制一个请求出来
-					response.SetMessageType(protocol.Response) // 设置为response消息
-					handleError(response, err)
-					data := response.EncodeSlicePointer()
-					_, err = conn.Write(*data)
-					protocol.PutData(data)
-					s.Plugins.DoPostWriteResponse(ctx, request, response, err)
-					protocol.FreeMsg(response)
-				} else { // 不需要回复
-					s.Plugins.DoPreWriteResponse(ctx, request, nil)
-				}
+			if err != nil { // 鉴权失败，回复客户端之后关闭连接
+				s.writeErrorResponse(ctx, w, request, err)
 				protocol.FreeMsg(request)
 				log.InfoF("连接鉴权失败，%s,错误原因%v", conn.RemoteAddr(), err)
 				return
 			}
 		}
 
+		if request.IsHeartbeat() { // 如果是客户端心跳，直接原样返回（seq不变，客户端靠它找到对应的心跳请求）
+			request.SetMessageType(protocol.Response)
+			data := request.EncodeSlicePointer()
+			w.write(*data)
+			protocol.PutData(data)
+			protocol.FreeMsg(request)
+			continue
+		}
+
 		// 下面需要处理消息了噢
-		go func() {
-			// 正在处理的消息数量+1
-			atomic.AddInt32(&s.handlerMsgNum, 1)
-			// 正在处理消息的数量-1
-			defer atomic.AddInt32(&s.handlerMsgNum, - 1)
+		// 正在处理的消息数量+1（在协程池里排队的也算，Shutdown需要等它们处理完）
+		atomic.AddInt32(&s.handlerMsgNum, 1)
 
-			if request.IsHeartbeat() { // 如果是客户端心跳
-				request.SetMessageType(protocol.Response)
-				data := request.EncodeSlicePointer()
-				conn.Write(*data)
-				protocol.PutData(data)
-				return
-			}
+		// 在读协程中登记请求（还在排队的请求也能被取消），客户端发来取消消息时取消处理请求的ctx
+		var cancel context.CancelFunc
+		ctx.Context, cancel = context.WithCancel(ctx.Context)
+		seq := request.Seq()
+		inflight.add(seq, cancel)
 
-			// 不是心跳初始化返给客户端的meta
-			responseMetadata := make(map[string]string)
-			// 先将服务端的metadata方法进去
-			ctx = share.WithLocalValue(ctx, share.ReqMetaDataKey, request.Metadata)
-			// 再将客户端的metadata放进去
-			ctx = share.WithLocalValue(ctx, share.ResMetaDataKey, responseMetadata)
-			s.Plugins.DoPreHandleRequest(ctx, request) // 开始处理请求了
+		handle := func() {
+			// 正在处理消息的数量-1
+			defer atomic.AddInt32(&s.handlerMsgNum, -1)
+			defer inflight.remove(seq)
 
-			response, err := s.handleRequest(ctx, request)
-			if err != nil {
-				log.WarnF("处理请求错误: %v", err)
-			}
-			s.Plugins.DoPreWriteResponse(ctx, request, response)
+			response, err := s.processRequest(ctx, request)
 			if !request.IsOneway() { // 需要回复客户端
-				// 从ctx中拿出meta信息
-				responseMetadataCtx := ctx.Value(share.ResMetaDataKey).(map[string]string)
-				if len(responseMetadata) > 0 {
-					meta := response.Metadata
-					if meta == nil {
-						meta = responseMetadataCtx
-					} else {
-						for k, v := range responseMetadataCtx {
-							if meta[k] == "" {
-								meta[k] = v
-							}
-						}
-					}
-				}
-
 				if len(response.Payload) > 1024 && request.CompressType() != protocol.None {
 					response.SetCompressType(request.CompressType())
 				}
 				data := response.EncodeSlicePointer()
-				conn.Write(*data)
+				if wErr := w.write(*data); wErr != nil { // 写入失败（包括写超时）时告诉插件写入的错误
+					log.WarnF("写入响应失败，连接%s，错误原因%v", conn.RemoteAddr(), wErr)
+					err = wErr
+				}
 				protocol.PutData(data)
 			}
 
@@ -323,8 +329,172 @@ func (s *Server) serveConn(conn net.Conn) {
 
 			protocol.FreeMsg(response)
 			protocol.FreeMsg(request)
-		}()
+		}
+
+		// 协程池拒绝处理时直接回复客户端错误
+		reject := func(err error) {
+			atomic.AddInt32(&s.handlerMsgNum, -1)
+			inflight.remove(seq)
+			s.writeErrorResponse(ctx, w, request, err)
+			protocol.FreeMsg(request)
+		}
+
+		if s.workerPool == nil { // 没有开启协程池，每个请求一个协程
+			go handle()
+			continue
+		}
+		if backlog != nil { // 交给派发协程，连接上等待的请求排满了才会阻塞在这里
+			backlog <- poolTask{handle: handle, reject: reject}
+			continue
+		}
+		// 交给协程池处理，队列满了直接拒绝
+		if err := s.workerPool.submit(handle); err != nil {
+			reject(err)
+		}
+	}
+}
+
+// 交给协程池的请求
+type poolTask struct {
+	handle func()
+	reject func(err error)
+}
+
+// 每个连接上最多有多少个请求在等待进入协程池（和协程池的排队长度一样，至少1个）
+func (s *Server) connBacklogLen() int {
+	if s.workerQueueLen < 1 {
+		return 1
+	}
+	return s.workerQueueLen
+}
+
+// 把连接上等待的请求依次交给协程池，协程池排满时阻塞在这里而不是读协程中
+func (s *Server) dispatch(backlog <-chan poolTask) {
+	for task := range backlog {
+		if err := s.workerPool.submit(task.handle); err != nil {
+			task.reject(err)
+		}
+	}
+}
+
+// 不处理请求，直接回复客户端错误
+func (s *Server) writeErrorResponse(ctx context.Context, w *connWriter, request *protocol.Message, err error) {
+	if request.IsOneway() { // 不需要回复
+		s.Plugins.DoPreWriteResponse(ctx, request, nil)
+		return
+	}
+
+	response := request.Clone()                // 复制一个请求出来
+	response.SetMessageType(protocol.Response) // 设置为response消息
+	handleError(response, err)
+	data := response.EncodeSlicePointer()
+	err = w.write(*data)
+	protocol.PutData(data)
+	s.Plugins.DoPostWriteResponse(ctx, request, response, err)
+	protocol.FreeMsg(response)
+}
+
+// 一个连接上正在处理的请求（seq => 取消处理请求的ctx）
+type inflightRequests struct {
+	mu      sync.Mutex
+	cancels map[uint64]context.CancelFunc
+}
+
+func (r *inflightRequests) add(seq uint64, cancel context.CancelFunc) {
+	r.mu.Lock()
+	r.cancels[seq] = cancel
+	r.mu.Unlock()
+}
+
+// 请求处理完了，释放ctx
+func (r *inflightRequests) remove(seq uint64) {
+	r.mu.Lock()
+	cancel := r.cancels[seq]
+	delete(r.cancels, seq)
+	r.mu.Unlock()
+	if cancel != nil {
+		cancel()
+	}
+}
+
+func (r *inflightRequests) cancel(seq uint64) {
+	r.mu.Lock()
+	cancel := r.cancels[seq]
+	r.mu.Unlock()
+	if cancel != nil {
+		cancel()
+	}
+}
+
+// 处理请求的完整流程（tcp和网关共用），返回的响应已经合并了处理过程中写入的元数据
+func (s *Server) processRequest(ctx *share.Context, request *protocol.Message) (*protocol.Message, error) {
+	// 初始化返给客户端的meta
+	responseMetadata := make(map[string]string)
+	// 先将客户端的metadata放进去
+	ctx = share.WithLocalValue(ctx, share.ReqMetaDataKey, request.Metadata)
+	// 再将返给客户端的metadata放进去
+	ctx = share.WithLocalValue(ctx, share.ResMetaDataKey, responseMetadata)
+
+	// 客户端带了超时时间，处理请求的ctx到时间自动取消
+	cancel, err := withRequestTimeout(ctx, request)
+	defer cancel()
+
+	var response *protocol.Message
+	if err == nil {
+		err = s.Plugins.DoPreHandleRequest(ctx, request) // 开始处理请求了
+	}
+	if err != nil {
+		// 请求已经超时或者插件拒绝处理该请求
+		response = request.Clone()
+		response.SetMessageType(protocol.Response)
+		handleError(response, err)
+	} else {
+		response, err = s.handleRequest(ctx, request)
+	}
+	if err != nil {
+		log.WarnF("处理请求错误: %v", err)
 	}
+
+	if pErr := s.Plugins.DoPreWriteResponse(ctx, request, response); pErr != nil && err == nil {
+		err = pErr
+		handleError(response, err)
+	}
+
+	// 从ctx中拿出meta信息（插件可能替换掉了），已经存在的key不覆盖
+	if responseMetadataCtx, ok := ctx.Value(share.ResMetaDataKey).(map[string]string); ok && len(responseMetadataCtx) > 0 {
+		if response.Metadata == nil {
+			response.Metadata = responseMetadataCtx
+		} else {
+			for k, v := range responseMetadataCtx {
+				if _, ok := response.Metadata[k]; !ok {
+					response.Metadata[k] = v
+				}
+			}
+		}
+	}
+
+	return response, err
+}
+
+// 根据客户端元数据中的超时时间给ctx设置截止时间（从读到请求的时间开始算），已经超时的请求返回ErrRequestTimeout
+func withRequestTimeout(ctx *share.Context, request *protocol.Message) (context.CancelFunc, error) {
+	timeout, err := strconv.ParseInt(request.Metadata[share.TimeoutKey], 10, 64)
+	if err != nil {
+		return func() {}, nil
+	}
+
+	start := time.Now()
+	if startNano, ok := ctx.Value(StartRequestContextKey).(int64); ok {
+		start = time.Unix(0, startNano)
+	}
+	deadline := start.Add(time.Duration(timeout))
+	if !time.Now().Before(deadline) {
+		return func() {}, ErrRequestTimeout
+	}
+
+	var cancel context.CancelFunc
+	ctx.Context, cancel = context.WithDeadline(ctx.Context, deadline)
+	return cancel, nil
 }
 
 // 处理单个请求
@@ -336,11 +506,12 @@ func (s *Server) handleRequest(ctx context.Context, request *protocol.Message) (
 	response := request.Clone()
 	response.SetMessageType(protocol.Response)
 
+	// 只在这里取一次服务，服务被替换或者反注册时正在处理的请求继续使用取到的实现
 	s.serviceMapMu.RLock()
 	service, ok := s.serviceMap[serviceName]
 	s.serviceMapMu.RUnlock()
 	if !ok { // 都没注册直接返回错误
-		err = errors.New(fmt.Sprintf("不能找到服务发现者为%s的服务", serviceName))
+		err = fmt.Errorf("%w: %s", ErrServiceNotFound, serviceName)
 		return handleError(response, err)
 	}
 
@@ -348,7 +519,7 @@ func (s *Server) handleRequest(ctx context.Context, request *protocol.Message) (
 	if !ok { // 看看是否注册了函数的调用
 		if _, ok := service.function[methodName]; ok {
 			protocol.FreeMsg(response) // 这里创建对象要回收的
-			return s.handleRequestForFunction(ctx, request)
+			return s.handleRequestForFunction(ctx, service, request)
 		}
 		err = errors.New(fmt.Sprintf("不能找到服务提供者%s下方法名为%s的方法", serviceName, methodName))
 		return handleError(response, err)
@@ -364,7 +535,7 @@ func (s *Server) handleRequest(ctx context.Context, request *protocol.Message) (
 
 	err = codec.Decode(request.Payload, requestType)
 	if err != nil {
-		return handleError(response, err)
+		return handleError(response, fmt.Errorf("%w: %v", ErrInvalidArgs, err))
 	}
 
 	responseType := ObjectPool.Get(methodType.responseType)
@@ -398,7 +569,7 @@ func (s *Server) handleRequest(ctx context.Context, request *protocol.Message) (
 }
 
 // 处理函数类型的
-func (s *Server) handleRequestForFunction(ctx context.Context, request *protocol.Message) (*protocol.Message, error) {
+func (s *Server) handleRequestForFunction(ctx context.Context, service *service, request *protocol.Message) (*protocol.Message, error) {
 	var err error
 	response := request.Clone()
 	response.SetMessageType(protocol.Response)
@@ -406,15 +577,7 @@ func (s *Server) handleRequestForFunction(ctx context.Context, request *protocol
 	serviceName := request.ServicePath
 	methodName := request.ServiceMethod
 
-	s.serviceMapMu.RLock()
-	service, ok := s.serviceMap[serviceName]
-	s.serviceMapMu.RUnlock()
-	if !ok { // 都没注册直接返回错误
-		err = errors.New(fmt.Sprintf("不能找到服务发现者为%s的服务", serviceName))
-		return handleError(response, err)
-	}
-
-	funcType := service.function[serviceName]
+	funcType := service.function[methodName]
 	if funcType == nil {
 		err = errors.New(fmt.Sprintf("不能找到服务发现者为%s对应的函数调用%s", serviceName, methodName))
 		return handleError(response, err)
@@ -431,7 +594,7 @@ func (s *Server) handleRequestForFunction(ctx context.Context, request *protocol
 
 	err = codec.Decode(request.Payload, requestType)
 	if err != nil {
-		return handleError(response, err)
+		return handleError(response, fmt.Errorf("%w: %v", ErrInvalidArgs, err))
 	}
 
 	responseType := ObjectPool.Get(funcType.responseType)
@@ -475,10 +638,59 @@ func (s *Server) auth(ctx context.Context, request *protocol.Message) error {
 	return s.AuthFunc(ctx, request, token)
 }
 
+// 从上下文中取出客户端的连接（rpc请求和网关请求都会设置）
+func RemoteConn(ctx context.Context) net.Conn {
+	conn, _ := ctx.Value(RemoteConnContextKey).(net.Conn)
+	return conn
+}
+
+// 主动给客户端推送消息，客户端需要通过RegisterServerMessageChan注册通道来接收
+// conn只能是rpc连接（网关的http连接不支持推送），一般在业务方法中通过RemoteConn(ctx)获取
+func (s *Server) SendMessage(conn net.Conn, servicePath, serviceMethod string, metadata map[string]string, payload []byte) error {
+	s.connMu.RLock()
+	w, ok := s.activeConn[conn]
+	s.connMu.RUnlock()
+	if !ok {
+		return ErrConnNotActive
+	}
+
+	msg := protocol.GetPooledMsg()
+	defer protocol.FreeMsg(msg)
+	msg.SetMessageType(protocol.Request) // 客户端根据消息类型区分推送消息和响应
+	msg.SetOneway(true)
+	msg.SetSerializeType(protocol.SerializeNone)
+	msg.ServicePath = servicePath
+	msg.ServiceMethod = serviceMethod
+	msg.Metadata = metadata
+	msg.Payload = payload
+
+	data := msg.EncodeSlicePointer()
+	defer protocol.PutData(data)
+	return w.write(*data)
+}
+
+// 通知插件所有服务都下线了（服务仍然保留，正在处理的请求还需要用到）
+func (s *Server) unpublishServices() {
+	s.serviceMapMu.RLock()
+	names := make([]string, 0, len(s.serviceMap))
+	for name := range s.serviceMap {
+		names = append(names, name)
+	}
+	s.serviceMapMu.RUnlock()
+
+	for _, name := range names {
+		if err := s.Plugins.DoUnregister(name); err != nil {
+			log.WarnF("服务%s下线失败，错误原因%v", name, err)
+		}
+	}
+}
+
 // 暴力关闭服务（生产环境不建议使用，建议使用Shutdown）
 func (s *Server) Close() error {
-	s.serviceMapMu.Lock()
-	defer s.serviceMapMu.Unlock()
+	s.unpublishServices()
+
+	s.connMu.Lock()
+	defer s.connMu.Unlock()
 	var err error
 	if s.ln != nil {
 		err = s.ln.Close()
@@ -490,6 +702,13 @@ func (s *Server) Close() error {
 		s.Plugins.DoPostConnClose(conn)
 	}
 
+	if s.fileTransfer != nil {
+		s.fileTransfer.close()
+	}
+	if s.workerPool != nil {
+		s.workerPool.stop()
+	}
+
 	return err
 }
 
@@ -503,6 +722,9 @@ func (s *Server) Shutdown(ctx context.Context) error {
 	var err error
 	if atomic.CompareAndSwapInt32(&s.inShutdown, 0, 1) { // 保证结束进程只执行一次
 		log.Info("服务开始关闭...")
+		// 先从注册中心下线，客户端不再把新请求发过来
+		s.unpublishServices()
+
 		// 先关闭tcp链接的读端（写端要等所有请求都结束后才能关闭）
 		s.connMu.Lock()
 		if s.ln != nil {
@@ -540,6 +762,21 @@ func (s *Server) Shutdown(ctx context.Context) error {
 			}
 		}
 
+		if s.jsonRPCHttpServer != nil {
+			if err = s.closeJSONRPC2(ctx); err != nil {
+				log.WarnF("关闭json-rpc网关时出错：%v", err)
+			} else {
+				log.Info("json-rpc网关服务已经关闭")
+			}
+		}
+
+		if s.fileTransfer != nil {
+			s.fileTransfer.close()
+		}
+		if s.workerPool != nil {
+			s.workerPool.stop()
+		}
+
 		s.connMu.Lock()
 		for conn, _ := range s.activeConn {
 			conn.Close()
@@ -561,6 +798,18 @@ func (s *Server) checkMsgHandlerFinish() bool {
 	return size == 0
 }
 
+// 活跃的连接数量
+func (s *Server) ActiveConns() int {
+	s.connMu.RLock()
+	defer s.connMu.RUnlock()
+	return len(s.activeConn)
+}
+
+// 正在处理（包括在协程池中排队）的消息数量
+func (s *Server) HandlingMsgNum() int {
+	return int(atomic.LoadInt32(&s.handlerMsgNum))
+}
+
 // 关闭结束通道（如果别的协程已经关闭，则直接返回）
 func (s *Server) closeDoneChanLocked() {
 	select {
@@ -574,7 +823,6 @@ func (s *Server) closeDoneChanLocked() {
 // 监听结束服务事件(terminated)
 func (s *Server) startShutdownServe() {
 	go func(s *Server) {
-		log.InfoF("rpc listen at %s", s.ln.Addr().String())
 		c := make(chan os.Signal, 1)
 		signal.Notify(c, syscall.SIGTERM)
 		sg := <-c
@@ -612,10 +860,6 @@ func (s *Server) readRequest(ctx context.Context, rBuff io.Reader) (*protocol.Me
 		return nil, err
 	}
 	request := protocol.GetPooledMsg()
-	err = s.Plugins.DoPreReadRequest(ctx)
-	if err != nil {
-		return nil, err
-	}
 	// 开始解码
 	err = request.Decode(rBuff)
 	if err == io.EOF { // io.EOF代表读完了
@@ -638,6 +882,20 @@ func handleError(response *protocol.Message, err error) (*protocol.Message, erro
 	}
 
 	response.Metadata[protocol.ServiceError] = err.Error()
+	var codeErr *CodeError
+	if errors.As(err, &codeErr) {
+		response.Metadata[protocol.ServiceErrorCode] = codeErr.Code
+	}
 
 	return response, err
 }
+
+// 带错误码的错误，错误码会放在响应元数据的protocol.ServiceErrorCode中，方便客户端区分错误的类型（比如被限流）
+type CodeError struct {
+	Code    string
+	Message string
+}
+
+func (e *CodeError) Error() string {
+	return e.Message
+}
@@ -0,0 +1,236 @@
+package server
+
+import (
+	"avrilko-rpc/protocol"
+	"avrilko-rpc/share"
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type ArithArgs struct {
+	A int
+	B int
+}
+
+type ArithReply struct {
+	C int
+}
+
+type Arith struct{}
+
+func (t *Arith) Mul(ctx context.Context, args *ArithArgs, reply *ArithReply) error {
+	reply.C = args.A * args.B
+	return nil
+}
+
+func (t *Arith) Fail(ctx context.Context, args *ArithArgs, reply *ArithReply) error {
+	return errors.New("业务出错了")
+}
+
+// 在随机端口上启动服务，返回监听地址
+func startTestServer(t *testing.T, s *Server) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.ServeListener("tcp", ln)
+	t.Cleanup(func() { s.Close() })
+	return ln.Addr().String()
+}
+
+// 直接使用协议和服务端交互的连接
+type testConn struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func dialTestServer(t *testing.T, addr string) *testConn {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &testConn{t: t, conn: conn, r: bufio.NewReader(conn)}
+}
+
+// 发送一个请求，args为nil时payload为空
+func (c *testConn) send(seq uint64, servicePath, serviceMethod string, args interface{}, setup func(m *protocol.Message)) {
+	c.t.Helper()
+	req := protocol.GetPooledMsg()
+	defer protocol.FreeMsg(req)
+	req.SetMessageType(protocol.Request)
+	req.SetSerializeType(protocol.JSON)
+	req.SetSeq(seq)
+	req.ServicePath = servicePath
+	req.ServiceMethod = serviceMethod
+	if args != nil {
+		payload, err := share.Codecs[protocol.JSON].Encode(args)
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		req.Payload = payload
+	}
+	if setup != nil {
+		setup(req)
+	}
+
+	data := req.EncodeSlicePointer()
+	defer protocol.PutData(data)
+	if _, err := c.conn.Write(*data); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// 读取一个响应
+func (c *testConn) recv() *protocol.Message {
+	c.t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	res := protocol.GetPooledMsg()
+	if err := res.Decode(c.r); err != nil {
+		c.t.Fatalf("读取响应失败: %v", err)
+	}
+	return res
+}
+
+func TestSeqEchoedOnResponses(t *testing.T) {
+	s := NewServer()
+	if err := s.RegisterName("Test", &Arith{}, ""); err != nil {
+		t.Fatal(err)
+	}
+	c := dialTestServer(t, startTestServer(t, s))
+
+	// 心跳
+	c.send(7, "", "", nil, func(m *protocol.Message) { m.SetHeartbeat(true) })
+	res := c.recv()
+	if res.Seq() != 7 || !res.IsHeartbeat() || res.MessageType() != protocol.Response {
+		t.Errorf("心跳响应不正确: seq=%d heartbeat=%v type=%d", res.Seq(), res.IsHeartbeat(), res.MessageType())
+	}
+
+	// 正常调用
+	c.send(8, "Test", "Mul", &ArithArgs{A: 3, B: 4}, nil)
+	res = c.recv()
+	reply := &ArithReply{}
+	share.Codecs[protocol.JSON].Decode(res.Payload, reply)
+	if res.Seq() != 8 || res.MessageStatusType() != protocol.Normal || reply.C != 12 {
+		t.Errorf("调用响应不正确: seq=%d status=%d reply=%d", res.Seq(), res.MessageStatusType(), reply.C)
+	}
+
+	// 业务返回错误
+	c.send(9, "Test", "Fail", &ArithArgs{}, nil)
+	res = c.recv()
+	if res.Seq() != 9 || res.MessageStatusType() != protocol.Error || res.Metadata[protocol.ServiceError] != "业务出错了" {
+		t.Errorf("错误响应不正确: seq=%d status=%d meta=%v", res.Seq(), res.MessageStatusType(), res.Metadata)
+	}
+
+	// 服务不存在
+	c.send(10, "Nope", "Mul", &ArithArgs{}, nil)
+	res = c.recv()
+	if res.Seq() != 10 || res.MessageStatusType() != protocol.Error {
+		t.Errorf("服务不存在的响应不正确: seq=%d status=%d", res.Seq(), res.MessageStatusType())
+	}
+}
+
+func TestSeqEchoedOnAuthFailure(t *testing.T) {
+	s := NewServer()
+	s.AuthFunc = func(ctx context.Context, request *protocol.Message, token string) error {
+		if token != "ok" {
+			return errors.New("鉴权失败")
+		}
+		return nil
+	}
+	if err := s.RegisterName("Test", &Arith{}, ""); err != nil {
+		t.Fatal(err)
+	}
+	c := dialTestServer(t, startTestServer(t, s))
+
+	c.send(11, "Test", "Mul", &ArithArgs{A: 1, B: 1}, nil)
+	res := c.recv()
+	if res.Seq() != 11 || res.MessageStatusType() != protocol.Error || res.Metadata[protocol.ServiceError] != "鉴权失败" {
+		t.Errorf("鉴权失败的响应不正确: seq=%d status=%d meta=%v", res.Seq(), res.MessageStatusType(), res.Metadata)
+	}
+}
+
+// 记录被调用的次数，返回处理请求时ctx剩余的超时时间（毫秒，没有截止时间返回-1）
+type Deadline struct {
+	calls int32
+}
+
+func (d *Deadline) Remaining(ctx context.Context, args *ArithArgs, reply *ArithReply) error {
+	atomic.AddInt32(&d.calls, 1)
+	reply.C = -1
+	if deadline, ok := ctx.Deadline(); ok {
+		reply.C = int(time.Until(deadline) / time.Millisecond)
+	}
+	return nil
+}
+
+func withTimeout(timeout time.Duration) func(m *protocol.Message) {
+	return func(m *protocol.Message) {
+		m.Metadata = map[string]string{share.TimeoutKey: strconv.FormatInt(int64(timeout), 10)}
+	}
+}
+
+// 服务端按照客户端带过来的剩余超时时间设置处理请求的ctx的截止时间，已经超时的请求不调用服务直接返回错误
+func TestRequestTimeout(t *testing.T) {
+	s := NewServer()
+	d := &Deadline{}
+	if err := s.RegisterName("Deadline", d, ""); err != nil {
+		t.Fatal(err)
+	}
+	c := dialTestServer(t, startTestServer(t, s))
+
+	c.send(1, "Deadline", "Remaining", &ArithArgs{}, nil)
+	reply := &ArithReply{}
+	share.Codecs[protocol.JSON].Decode(c.recv().Payload, reply)
+	if reply.C != -1 {
+		t.Fatalf("没有带超时时间的请求不应该有截止时间，实际剩余%dms", reply.C)
+	}
+
+	c.send(2, "Deadline", "Remaining", &ArithArgs{}, withTimeout(time.Second))
+	share.Codecs[protocol.JSON].Decode(c.recv().Payload, reply)
+	if reply.C <= 0 || reply.C > 1000 {
+		t.Fatalf("处理请求的ctx应该在1s之内到期，实际剩余%dms", reply.C)
+	}
+
+	c.send(3, "Deadline", "Remaining", &ArithArgs{}, withTimeout(time.Nanosecond))
+	res := c.recv()
+	if res.Seq() != 3 || res.MessageStatusType() != protocol.Error || res.Metadata[protocol.ServiceError] != ErrRequestTimeout.Error() {
+		t.Fatalf("已经超时的请求应该返回ErrRequestTimeout: seq=%d meta=%v", res.Seq(), res.Metadata)
+	}
+	if calls := atomic.LoadInt32(&d.calls); calls != 2 {
+		t.Fatalf("已经超时的请求不应该调用服务，服务被调用了%d次", calls)
+	}
+}
+
+// 超时时间从开始读取请求的时候算起，在队列中等待的时间也算在里面
+func TestWithRequestTimeoutFromStart(t *testing.T) {
+	request := protocol.GetPooledMsg()
+	defer protocol.FreeMsg(request)
+	withTimeout(100 * time.Millisecond)(request)
+
+	ctx := share.NewContext(context.Background())
+	ctx = share.WithLocalValue(ctx, StartRequestContextKey, time.Now().Add(-50*time.Millisecond).UnixNano())
+	cancel, err := withRequestTimeout(ctx, request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cancel()
+	deadline, ok := ctx.Deadline()
+	if remaining := time.Until(deadline); !ok || remaining > 50*time.Millisecond {
+		t.Fatalf("截止时间应该从开始读取请求的时候算起，实际剩余%v", remaining)
+	}
+
+	ctx = share.WithLocalValue(share.NewContext(context.Background()), StartRequestContextKey, time.Now().Add(-time.Second).UnixNano())
+	if _, err = withRequestTimeout(ctx, request); err != ErrRequestTimeout {
+		t.Fatalf("已经超时的请求应该返回ErrRequestTimeout，实际为%v", err)
+	}
+}
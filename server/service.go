@@ -18,6 +18,11 @@ var (
 	errorType   = reflect.TypeOf((*error)(nil)).Elem()
 )
 
+var (
+	ErrServiceNotFound = errors.New("服务不存在")
+	ErrInvalidArgs     = errors.New("请求参数解析失败")
+)
+
 // 反射方法得到的摘要
 type methodType struct {
 	sync.Mutex                  // 互斥锁
@@ -44,6 +49,7 @@ type service struct {
 }
 
 // 注册服务提供者(自定义名称)
+// 名称已经注册过时会原子地替换成新的实现，正在处理的请求继续使用旧的实现，之后的请求使用新的实现
 func (s *Server) RegisterName(name string, object interface{}, metadata string) error {
 	_, err := s.register(object, name, true)
 	if err != nil {
@@ -108,16 +114,15 @@ func (s *Server) register(object interface{}, name string, useName bool) (string
 	return serviceName, nil
 }
 
-// 通过指定名称注册函数
+// 通过指定名称注册函数（名称已经注册过时会原子地替换）
 func (s *Server) RegisterFuncName(function interface{}, name string, metadata string) error {
 	_, err := s.registerFunction(function, name, true)
 	if err != nil {
 		return err
 	}
 
-	s.Plugins.DoRegister(name, function, metadata)
-
-	return nil
+	// 函数注册时服务名和方法名相同
+	return s.Plugins.DoRegisterFunction(name, name, function, metadata)
 }
 
 // 通过反射注册函数
@@ -127,8 +132,39 @@ func (s *Server) RegisterFunc(function interface{}, metadata string) error {
 		return err
 	}
 
-	s.Plugins.DoRegister(name, function, metadata)
-	return nil
+	return s.Plugins.DoRegisterFunction(name, name, function, metadata)
+}
+
+// 反注册服务提供者或者函数，正在处理的请求不受影响，之后的请求会返回服务不存在
+func (s *Server) Unregister(name string) error {
+	s.serviceMapMu.Lock()
+	_, ok := s.serviceMap[name]
+	delete(s.serviceMap, name)
+	s.serviceMapMu.Unlock()
+
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrServiceNotFound, name)
+	}
+	return s.Plugins.DoUnregister(name)
+}
+
+// 反注册所有的服务提供者和函数
+func (s *Server) UnregisterAll() error {
+	s.serviceMapMu.Lock()
+	names := make([]string, 0, len(s.serviceMap))
+	for name := range s.serviceMap {
+		names = append(names, name)
+	}
+	s.serviceMap = make(map[string]*service)
+	s.serviceMapMu.Unlock()
+
+	var err error
+	for _, name := range names {
+		if e := s.Plugins.DoUnregister(name); e != nil {
+			err = e
+		}
+	}
+	return err
 }
 
 // 反射注册函数类型
@@ -355,3 +391,19 @@ func formatFuncName(funcName string) string {
 
 	return funcName
 }
+
+// 判断服务提供者的方法或者函数是否已经注册
+func (s *Server) HasMethod(servicePath, serviceMethod string) bool {
+	s.serviceMapMu.RLock()
+	defer s.serviceMapMu.RUnlock()
+
+	service, ok := s.serviceMap[servicePath]
+	if !ok {
+		return false
+	}
+	if _, ok := service.method[serviceMethod]; ok {
+		return true
+	}
+	_, ok = service.function[serviceMethod]
+	return ok
+}
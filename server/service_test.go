@@ -0,0 +1,155 @@
+package server
+
+import (
+	"avrilko-rpc/protocol"
+	"avrilko-rpc/share"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// 返回自己版本号的服务，release没有关闭时处理请求会一直等待
+type Versioned struct {
+	version int
+	started chan struct{}
+	release chan struct{}
+}
+
+func newVersioned(version int) *Versioned {
+	return &Versioned{version: version, started: make(chan struct{}, 1), release: make(chan struct{})}
+}
+
+func (v *Versioned) Get(ctx context.Context, args *ArithArgs, reply *ArithReply) error {
+	v.started <- struct{}{}
+	<-v.release
+	reply.C = v.version
+	return nil
+}
+
+func replyOf(t *testing.T, res *protocol.Message) int {
+	t.Helper()
+	if res.MessageStatusType() != protocol.Normal {
+		t.Fatalf("调用失败: %v", res.Metadata)
+	}
+	reply := &ArithReply{}
+	if err := share.Codecs[protocol.JSON].Decode(res.Payload, reply); err != nil {
+		t.Fatal(err)
+	}
+	return reply.C
+}
+
+// 替换正在使用的服务：正在处理的请求继续使用旧的实现，之后的请求使用新的实现
+func TestReregisterWhileInFlight(t *testing.T) {
+	s := NewServer()
+	old := newVersioned(1)
+	if err := s.RegisterName("Test", old, ""); err != nil {
+		t.Fatal(err)
+	}
+	c := dialTestServer(t, startTestServer(t, s))
+
+	c.send(1, "Test", "Get", &ArithArgs{}, nil)
+	<-old.started
+
+	replacement := newVersioned(2)
+	close(replacement.release)
+	if err := s.RegisterName("Test", replacement, ""); err != nil {
+		t.Fatal(err)
+	}
+	c.send(2, "Test", "Get", &ArithArgs{}, nil)
+	if res := c.recv(); res.Seq() != 2 || replyOf(t, res) != 2 {
+		t.Fatalf("替换之后的请求应该使用新的实现: seq=%d", res.Seq())
+	}
+
+	close(old.release)
+	if res := c.recv(); res.Seq() != 1 || replyOf(t, res) != 1 {
+		t.Fatalf("正在处理的请求应该使用旧的实现完成: seq=%d", res.Seq())
+	}
+}
+
+// 反注册之后的请求返回服务不存在，正在处理的请求不受影响
+func TestUnregister(t *testing.T) {
+	s := NewServer()
+	v := newVersioned(1)
+	if err := s.RegisterName("Test", v, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RegisterName("Arith", &Arith{}, ""); err != nil {
+		t.Fatal(err)
+	}
+	c := dialTestServer(t, startTestServer(t, s))
+
+	c.send(1, "Test", "Get", &ArithArgs{}, nil)
+	<-v.started
+	if err := s.Unregister("Test"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Unregister("Test"); !errors.Is(err, ErrServiceNotFound) {
+		t.Fatalf("反注册不存在的服务应该返回ErrServiceNotFound，实际为%v", err)
+	}
+
+	c.send(2, "Test", "Get", &ArithArgs{}, nil)
+	res := c.recv()
+	if res.Seq() != 2 || res.MessageStatusType() != protocol.Error || !strings.Contains(res.Metadata[protocol.ServiceError], ErrServiceNotFound.Error()) {
+		t.Fatalf("反注册之后的请求应该返回服务不存在: seq=%d meta=%v", res.Seq(), res.Metadata)
+	}
+
+	close(v.release)
+	if res = c.recv(); res.Seq() != 1 || replyOf(t, res) != 1 {
+		t.Fatalf("反注册之前已经在处理的请求应该正常完成: seq=%d", res.Seq())
+	}
+
+	// 反注册所有的服务
+	if err := s.UnregisterAll(); err != nil {
+		t.Fatal(err)
+	}
+	c.send(3, "Arith", "Mul", &ArithArgs{A: 2, B: 3}, nil)
+	if res = c.recv(); res.MessageStatusType() != protocol.Error || !strings.Contains(res.Metadata[protocol.ServiceError], ErrServiceNotFound.Error()) {
+		t.Fatalf("反注册所有服务之后的请求应该返回服务不存在: meta=%v", res.Metadata)
+	}
+}
+
+func mulFunc(ctx context.Context, args *ArithArgs, reply *ArithReply) error {
+	reply.C = args.A * args.B
+	return nil
+}
+
+func addFunc(ctx context.Context, args *ArithArgs, reply *ArithReply) error {
+	reply.C = args.A + args.B
+	return nil
+}
+
+// 注册的函数按服务名和方法名找到，替换之后调用新的函数，反注册之后返回服务不存在
+func TestFunctionLookup(t *testing.T) {
+	s := NewServer()
+	if err := s.RegisterFuncName(mulFunc, "Calc", ""); err != nil {
+		t.Fatal(err)
+	}
+	c := dialTestServer(t, startTestServer(t, s))
+
+	c.send(1, "Calc", "Calc", &ArithArgs{A: 2, B: 3}, nil)
+	if res := c.recv(); replyOf(t, res) != 6 {
+		t.Fatal("调用注册的函数结果不正确")
+	}
+
+	c.send(2, "Calc", "Other", &ArithArgs{A: 2, B: 3}, nil)
+	if res := c.recv(); res.MessageStatusType() != protocol.Error {
+		t.Fatal("调用不存在的函数应该返回错误")
+	}
+
+	if err := s.RegisterFuncName(addFunc, "Calc", ""); err != nil {
+		t.Fatal(err)
+	}
+	c.send(3, "Calc", "Calc", &ArithArgs{A: 2, B: 3}, nil)
+	if res := c.recv(); replyOf(t, res) != 5 {
+		t.Fatal("替换之后应该调用新的函数")
+	}
+
+	if err := s.Unregister("Calc"); err != nil {
+		t.Fatal(err)
+	}
+	c.send(4, "Calc", "Calc", &ArithArgs{A: 2, B: 3}, nil)
+	if res := c.recv(); res.MessageStatusType() != protocol.Error || !strings.Contains(res.Metadata[protocol.ServiceError], ErrServiceNotFound.Error()) {
+		t.Fatalf("反注册之后调用函数应该返回服务不存在: meta=%v", res.Metadata)
+	}
+}
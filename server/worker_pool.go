@@ -0,0 +1,71 @@
+package server
+
+import (
+	"errors"
+	"sync"
+)
+
+var ErrServerBusy = errors.New("服务繁忙，请稍后再试")
+
+// 处理请求的协程池，固定数量的协程从队列中取出请求处理，避免突发流量创建大量协程
+type workerPool struct {
+	tasks  chan func()
+	reject bool // 队列满了直接拒绝，否则阻塞等待
+
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+func newWorkerPool(size, queueLen int, reject bool) *workerPool {
+	if queueLen < 0 {
+		queueLen = 0
+	}
+	p := &workerPool{
+		tasks:  make(chan func(), queueLen),
+		reject: reject,
+		done:   make(chan struct{}),
+	}
+	for i := 0; i < size; i++ {
+		go p.work()
+	}
+	return p
+}
+
+func (p *workerPool) work() {
+	for {
+		select {
+		case task := <-p.tasks:
+			task()
+		case <-p.done:
+			return
+		}
+	}
+}
+
+// 提交任务，队列满了时拒绝返回ErrServerBusy或者阻塞到有空闲，协程池已经停止返回ErrServerClosed
+func (p *workerPool) submit(task func()) error {
+	if p.reject {
+		select {
+		case <-p.done:
+			return ErrServerClosed
+		case p.tasks <- task:
+			return nil
+		default:
+			return ErrServerBusy
+		}
+	}
+
+	select {
+	case <-p.done:
+		return ErrServerClosed
+	case p.tasks <- task:
+		return nil
+	}
+}
+
+// 停止所有协程（还在排队的任务不会再处理）
+func (p *workerPool) stop() {
+	p.stopOnce.Do(func() {
+		close(p.done)
+	})
+}
@@ -0,0 +1,94 @@
+package server
+
+import (
+	"avrilko-rpc/protocol"
+	"context"
+	"testing"
+	"time"
+)
+
+// 一直等到请求被取消
+func (t *Arith) Slow(ctx context.Context, args *ArithArgs, reply *ArithReply) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(5 * time.Second):
+		return nil
+	}
+}
+
+// 返回处理请求时ctx的错误
+func (t *Arith) CtxErr(ctx context.Context, args *ArithArgs, reply *ArithReply) error {
+	return ctx.Err()
+}
+
+func sendCancel(c *testConn, seq uint64) {
+	c.send(seq, "", "", nil, func(m *protocol.Message) {
+		m.SetCancel(true)
+		m.SetOneway(true)
+	})
+}
+
+// 在协程池里排队的请求也能被取消
+func TestCancelQueuedRequest(t *testing.T) {
+	s := NewServer(WithWorkerPool(1, 1))
+	if err := s.RegisterName("Test", &Arith{}, ""); err != nil {
+		t.Fatal(err)
+	}
+	c := dialTestServer(t, startTestServer(t, s))
+
+	c.send(1, "Test", "Slow", &ArithArgs{}, nil) // 占住唯一的协程
+	time.Sleep(50 * time.Millisecond)
+	c.send(2, "Test", "CtxErr", &ArithArgs{}, nil) // 在队列里排队
+	time.Sleep(20 * time.Millisecond)
+	sendCancel(c, 2)
+	time.Sleep(20 * time.Millisecond)
+	sendCancel(c, 1)
+
+	errs := make(map[uint64]string)
+	for i := 0; i < 2; i++ {
+		res := c.recv()
+		errs[res.Seq()] = res.Metadata[protocol.ServiceError]
+		protocol.FreeMsg(res)
+	}
+	if errs[1] != context.Canceled.Error() || errs[2] != context.Canceled.Error() {
+		t.Fatalf("排队中被取消的请求处理时ctx应该已经取消，实际为%v", errs)
+	}
+}
+
+// 协程池排满时读协程仍然能处理心跳和取消消息
+func TestHeartbeatNotBlockedByFullPool(t *testing.T) {
+	s := NewServer(WithWorkerPool(1, 1))
+	if err := s.RegisterName("Test", &Arith{}, ""); err != nil {
+		t.Fatal(err)
+	}
+	c := dialTestServer(t, startTestServer(t, s))
+
+	// 1在处理，2在协程池的队列里，3在等待进入队列，4在连接上等待
+	for seq := uint64(1); seq <= 4; seq++ {
+		c.send(seq, "Test", "Slow", &ArithArgs{}, nil)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	c.send(100, "", "", nil, func(m *protocol.Message) { m.SetHeartbeat(true) })
+	c.conn.SetReadDeadline(time.Now().Add(time.Second))
+	res := protocol.GetPooledMsg()
+	if err := res.Decode(c.r); err != nil {
+		t.Fatalf("协程池排满时心跳没有响应: %v", err)
+	}
+	if res.Seq() != 100 || !res.IsHeartbeat() {
+		t.Fatalf("第一个响应应该是心跳，实际为seq=%d", res.Seq())
+	}
+	protocol.FreeMsg(res)
+
+	for seq := uint64(1); seq <= 4; seq++ {
+		sendCancel(c, seq)
+	}
+	for i := 0; i < 4; i++ {
+		res := c.recv()
+		if res.Metadata[protocol.ServiceError] != context.Canceled.Error() {
+			t.Fatalf("请求%d应该被取消，实际为%v", res.Seq(), res.Metadata)
+		}
+		protocol.FreeMsg(res)
+	}
+}
@@ -0,0 +1,77 @@
+package serverplugin
+
+import (
+	"avrilko-rpc/log"
+	"net"
+	"sync"
+)
+
+// 连接数限制插件，限制总连接数和每个客户端ip的连接数，超过限制的连接直接关闭
+type ConnLimitPlugin struct {
+	MaxConns      int // 最大连接数，0表示不限制
+	MaxConnsPerIP int // 每个ip的最大连接数，0表示不限制
+
+	mu    sync.Mutex
+	perIP map[string]int
+	conns map[net.Conn]string // 已经接受的连接 => ip（同一个连接关闭时可能通知多次，只能减一次）
+}
+
+func NewConnLimitPlugin(maxConns, maxConnsPerIP int) *ConnLimitPlugin {
+	return &ConnLimitPlugin{
+		MaxConns:      maxConns,
+		MaxConnsPerIP: maxConnsPerIP,
+		perIP:         make(map[string]int),
+		conns:         make(map[net.Conn]string),
+	}
+}
+
+func (p *ConnLimitPlugin) HandleConnAccept(conn net.Conn) (net.Conn, bool) {
+	ip := remoteIP(conn)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.MaxConns > 0 && len(p.conns) >= p.MaxConns {
+		log.WarnF("连接数已经达到上限%d，拒绝连接%s", p.MaxConns, conn.RemoteAddr())
+		return conn, false
+	}
+	if p.MaxConnsPerIP > 0 && p.perIP[ip] >= p.MaxConnsPerIP {
+		log.WarnF("ip%s的连接数已经达到上限%d，拒绝连接%s", ip, p.MaxConnsPerIP, conn.RemoteAddr())
+		return conn, false
+	}
+
+	p.conns[conn] = ip
+	p.perIP[ip]++
+	return conn, true
+}
+
+func (p *ConnLimitPlugin) HandleConnClose(conn net.Conn) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	ip, ok := p.conns[conn]
+	if !ok {
+		return true
+	}
+	delete(p.conns, conn)
+	if p.perIP[ip]--; p.perIP[ip] <= 0 {
+		delete(p.perIP, ip)
+	}
+	return true
+}
+
+// 当前的连接数
+func (p *ConnLimitPlugin) Conns() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.conns)
+}
+
+// 客户端的ip（不带端口）
+func remoteIP(conn net.Conn) string {
+	addr := conn.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
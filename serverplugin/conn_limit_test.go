@@ -0,0 +1,124 @@
+package serverplugin
+
+import (
+	"avrilko-rpc/client"
+	"avrilko-rpc/server"
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// 只有远程地址的连接
+type addrConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (c *addrConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+func newAddrConn(t *testing.T, addr string) net.Conn {
+	t.Helper()
+	tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &addrConn{addr: tcpAddr}
+}
+
+func TestConnLimitMaxConns(t *testing.T) {
+	p := NewConnLimitPlugin(2, 0)
+	a, b, c := newAddrConn(t, "10.0.0.1:1"), newAddrConn(t, "10.0.0.2:1"), newAddrConn(t, "10.0.0.3:1")
+
+	for _, conn := range []net.Conn{a, b} {
+		if _, ok := p.HandleConnAccept(conn); !ok {
+			t.Fatalf("没有达到上限，连接%s不应该被拒绝", conn.RemoteAddr())
+		}
+	}
+	if _, ok := p.HandleConnAccept(c); ok {
+		t.Fatal("连接数达到上限之后应该拒绝新的连接")
+	}
+
+	p.HandleConnClose(a)
+	if _, ok := p.HandleConnAccept(c); !ok {
+		t.Fatal("有连接关闭之后应该可以接受新的连接")
+	}
+	if p.Conns() != 2 {
+		t.Fatalf("当前的连接数应该为2，实际为%d", p.Conns())
+	}
+}
+
+func TestConnLimitMaxConnsPerIP(t *testing.T) {
+	p := NewConnLimitPlugin(0, 1)
+	first := newAddrConn(t, "10.0.0.1:1")
+
+	if _, ok := p.HandleConnAccept(first); !ok {
+		t.Fatal("第一个连接不应该被拒绝")
+	}
+	if _, ok := p.HandleConnAccept(newAddrConn(t, "10.0.0.1:2")); ok {
+		t.Fatal("同一个ip的连接数达到上限之后应该拒绝")
+	}
+	if _, ok := p.HandleConnAccept(newAddrConn(t, "10.0.0.2:1")); !ok {
+		t.Fatal("其他ip的连接不应该被拒绝")
+	}
+
+	// 同一个连接关闭时通知多次只能减一次
+	p.HandleConnClose(first)
+	p.HandleConnClose(first)
+	if p.Conns() != 1 {
+		t.Fatalf("关闭之后连接数应该为1，实际为%d", p.Conns())
+	}
+	if _, ok := p.HandleConnAccept(newAddrConn(t, "10.0.0.1:3")); !ok {
+		t.Fatal("关闭之后同一个ip应该可以再建立连接")
+	}
+}
+
+// 在服务器上超过上限的连接被关闭，客户端断开之后连接数减少
+func TestConnLimitServer(t *testing.T) {
+	p := NewConnLimitPlugin(1, 0)
+	s := server.NewServer()
+	s.Plugins.Add(p)
+	if err := s.RegisterName("Echo", new(Echo), ""); err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.ServeListener("tcp", ln)
+	defer s.Close()
+
+	option := client.DefaultOption
+	option.Heartbeat = false
+	call := func(c *client.Client) error {
+		args, reply := "hello", ""
+		return c.Call(context.Background(), "Echo", "Say", &args, &reply)
+	}
+
+	first := client.NewClient(option)
+	if err := first.Connect("tcp", ln.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	if err := call(first); err != nil {
+		t.Fatal(err)
+	}
+
+	second := client.NewClient(option)
+	if err := second.Connect("tcp", ln.Addr().String()); err == nil {
+		if err = call(second); err == nil {
+			t.Fatal("超过连接数上限的连接应该被关闭")
+		}
+		second.Close()
+	}
+
+	first.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for p.Conns() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("客户端断开之后连接数应该为0，实际为%d", p.Conns())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
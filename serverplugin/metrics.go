@@ -0,0 +1,212 @@
+package serverplugin
+
+import (
+	"avrilko-rpc/protocol"
+	"avrilko-rpc/server"
+	"avrilko-rpc/share"
+	"bufio"
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const MetricsPath = "/metrics" // 指标挂载在http网关上的路径
+
+const unknownLabel = "unknown" // 没有注册的服务和方法都记在这个标签下，防止客户端随便传名字让指标无限增长
+
+var inflightKey = share.ContextKey("__metrics_inflight") // 请求在PreHandleRequest中计入的方法，写入响应之后从这个方法中减掉
+
+var labelReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`) // 标签值中需要转义的字符
+
+// 默认的请求耗时分桶（秒），和prometheus客户端的默认值一致
+var DefaultLatencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// 一个方法的指标（都是原子操作，不需要加锁）
+type methodMetrics struct {
+	requests      uint64
+	errors        uint64
+	inflight      int64 // 正在处理的请求数
+	requestBytes  uint64
+	responseBytes uint64
+	latencyNum    uint64   // 记录了耗时的请求数
+	latencySum    uint64   // 耗时的总和（纳秒）
+	latencyCounts []uint64 // 每个分桶的数量（不是累计的，输出的时候再累加）
+}
+
+type methodKey struct {
+	service string
+	method  string
+}
+
+// 指标插件，统计每个服务每个方法的请求数、错误数、耗时分布和数据大小，以prometheus文本格式输出
+// 创建时会挂载到服务的http网关上（MetricsPath），需要在Serve之前创建
+type MetricsPlugin struct {
+	Namespace string    // 指标名的前缀
+	Buckets   []float64 // 请求耗时的分桶（秒），需要从小到大排列，开始记录指标之后不能再修改
+
+	server *server.Server
+
+	mu      sync.RWMutex
+	methods map[methodKey]*methodMetrics
+}
+
+func NewMetricsPlugin(s *server.Server) *MetricsPlugin {
+	p := &MetricsPlugin{
+		Namespace: "avrilko_rpc",
+		Buckets:   DefaultLatencyBuckets,
+		server:    s,
+		methods:   make(map[methodKey]*methodMetrics),
+	}
+	s.HandleHTTP(MetricsPath, p)
+	return p
+}
+
+// 开始处理请求时计入正在处理的请求数
+// 前面的插件拒绝了请求时不会调用到这里，所以在ctx中记下计入的方法，写入响应之后只减掉记下的
+func (p *MetricsPlugin) PreHandleRequest(ctx context.Context, request *protocol.Message) error {
+	sctx, ok := ctx.(*share.Context)
+	if !ok {
+		return nil
+	}
+	m := p.method(request.ServicePath, request.ServiceMethod)
+	atomic.AddInt64(&m.inflight, 1)
+	share.WithLocalValue(sctx, inflightKey, m)
+	return nil
+}
+
+// 响应写入之后记录指标，耗时从读到请求开始算
+func (p *MetricsPlugin) PostWriteResponse(ctx context.Context, request, response *protocol.Message, err error) error {
+	if m, ok := ctx.Value(inflightKey).(*methodMetrics); ok {
+		atomic.AddInt64(&m.inflight, -1)
+	}
+
+	m := p.method(request.ServicePath, request.ServiceMethod)
+
+	atomic.AddUint64(&m.requests, 1)
+	if err != nil || (response != nil && response.MessageStatusType() == protocol.Error) {
+		atomic.AddUint64(&m.errors, 1)
+	}
+	atomic.AddUint64(&m.requestBytes, uint64(len(request.Payload)))
+	if response != nil {
+		atomic.AddUint64(&m.responseBytes, uint64(len(response.Payload)))
+	}
+
+	if start, ok := ctx.Value(server.StartRequestContextKey).(int64); ok {
+		latency := time.Duration(time.Now().UnixNano() - start)
+		atomic.AddUint64(&m.latencyNum, 1)
+		atomic.AddUint64(&m.latencySum, uint64(latency))
+		seconds := latency.Seconds()
+		for i, bound := range p.Buckets {
+			if seconds <= bound {
+				atomic.AddUint64(&m.latencyCounts[i], 1)
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// 方法对应的指标，没有就创建（只有注册过的方法才单独记录）
+func (p *MetricsPlugin) method(service, method string) *methodMetrics {
+	if p.server != nil && !p.server.HasMethod(service, method) {
+		service, method = unknownLabel, unknownLabel
+	}
+	key := methodKey{service: service, method: method}
+
+	p.mu.RLock()
+	m, ok := p.methods[key]
+	p.mu.RUnlock()
+	if ok {
+		return m
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if m, ok = p.methods[key]; !ok {
+		m = &methodMetrics{latencyCounts: make([]uint64, len(p.Buckets))}
+		p.methods[key] = m
+	}
+	return m
+}
+
+// 以prometheus文本格式输出所有指标
+func (p *MetricsPlugin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	bw := bufio.NewWriter(w)
+	p.writeMetrics(bw)
+	bw.Flush()
+}
+
+// 按prometheus文本格式写入所有指标
+func (p *MetricsPlugin) writeMetrics(w *bufio.Writer) {
+	p.mu.RLock()
+	keys := make([]methodKey, 0, len(p.methods))
+	for k := range p.methods {
+		keys = append(keys, k)
+	}
+	methods := make([]*methodMetrics, len(keys))
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].service != keys[j].service {
+			return keys[i].service < keys[j].service
+		}
+		return keys[i].method < keys[j].method
+	})
+	for i, k := range keys {
+		methods[i] = p.methods[k]
+	}
+	p.mu.RUnlock()
+
+	ns := p.Namespace
+	labels := func(k methodKey) string {
+		return fmt.Sprintf(`service="%s",method="%s"`, escapeLabel(k.service), escapeLabel(k.method))
+	}
+	counter := func(name, help string, value func(m *methodMetrics) uint64) {
+		fmt.Fprintf(w, "# HELP %s_%s %s\n# TYPE %s_%s counter\n", ns, name, help, ns, name)
+		for i, k := range keys {
+			fmt.Fprintf(w, "%s_%s{%s} %d\n", ns, name, labels(k), value(methods[i]))
+		}
+	}
+
+	counter("server_requests_total", "处理的请求数", func(m *methodMetrics) uint64 { return atomic.LoadUint64(&m.requests) })
+	counter("server_errors_total", "返回错误的请求数", func(m *methodMetrics) uint64 { return atomic.LoadUint64(&m.errors) })
+	counter("server_request_bytes_total", "请求payload的总字节数", func(m *methodMetrics) uint64 { return atomic.LoadUint64(&m.requestBytes) })
+	counter("server_response_bytes_total", "响应payload的总字节数", func(m *methodMetrics) uint64 { return atomic.LoadUint64(&m.responseBytes) })
+
+	fmt.Fprintf(w, "# HELP %s_server_inflight_requests 正在处理的请求数\n# TYPE %s_server_inflight_requests gauge\n", ns, ns)
+	for i, k := range keys {
+		fmt.Fprintf(w, "%s_server_inflight_requests{%s} %d\n", ns, labels(k), atomic.LoadInt64(&methods[i].inflight))
+	}
+
+	name := ns + "_server_request_duration_seconds"
+	fmt.Fprintf(w, "# HELP %s 请求的处理耗时（从读到请求到写完响应）\n# TYPE %s histogram\n", name, name)
+	for i, k := range keys {
+		m := methods[i]
+		var cumulative uint64
+		for j, bound := range p.Buckets {
+			cumulative += atomic.LoadUint64(&m.latencyCounts[j])
+			fmt.Fprintf(w, "%s_bucket{%s,le=\"%s\"} %d\n", name, labels(k), strconv.FormatFloat(bound, 'g', -1, 64), cumulative)
+		}
+		count := atomic.LoadUint64(&m.latencyNum)
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, labels(k), count)
+		fmt.Fprintf(w, "%s_sum{%s} %s\n", name, labels(k), strconv.FormatFloat(time.Duration(atomic.LoadUint64(&m.latencySum)).Seconds(), 'g', -1, 64))
+		fmt.Fprintf(w, "%s_count{%s} %d\n", name, labels(k), count)
+	}
+
+	if p.server != nil {
+		fmt.Fprintf(w, "# HELP %s_server_handling_requests 正在处理（包括排队）的请求数\n# TYPE %s_server_handling_requests gauge\n", ns, ns)
+		fmt.Fprintf(w, "%s_server_handling_requests %d\n", ns, p.server.HandlingMsgNum())
+		fmt.Fprintf(w, "# HELP %s_server_active_connections 活跃的连接数\n# TYPE %s_server_active_connections gauge\n", ns, ns)
+		fmt.Fprintf(w, "%s_server_active_connections %d\n", ns, p.server.ActiveConns())
+	}
+}
+
+// 转义标签值中的特殊字符
+func escapeLabel(s string) string {
+	return labelReplacer.Replace(s)
+}
@@ -0,0 +1,96 @@
+package serverplugin
+
+import (
+	"avrilko-rpc/protocol"
+	"avrilko-rpc/server"
+	"avrilko-rpc/share"
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+type Echo struct{}
+
+func (e *Echo) Say(ctx context.Context, args *string, reply *string) error {
+	*reply = *args
+	return nil
+}
+
+// 没有注册的服务和方法都记在unknown下面，客户端传再多不同的名字也不会增加指标
+func TestMetricsOnlyRegisteredMethods(t *testing.T) {
+	s := server.NewServer()
+	if err := s.RegisterName("Echo", new(Echo), ""); err != nil {
+		t.Fatal(err)
+	}
+	p := NewMetricsPlugin(s)
+
+	record := func(service, method string) {
+		request := protocol.GetPooledMsg()
+		request.ServicePath, request.ServiceMethod = service, method
+		p.PostWriteResponse(context.Background(), request, nil, nil)
+		protocol.FreeMsg(request)
+	}
+	record("Echo", "Say")
+	for i := 0; i < 100; i++ {
+		record("Echo", "Nope"+strconv.Itoa(i))
+		record("Random"+strconv.Itoa(i), "Say")
+	}
+
+	if len(p.methods) != 2 {
+		t.Fatalf("应该只有注册的方法和unknown两组指标，实际为%d组", len(p.methods))
+	}
+	if m := p.methods[methodKey{service: "Echo", method: "Say"}]; m == nil || m.requests != 1 {
+		t.Fatal("注册的方法没有单独记录")
+	}
+	if m := p.methods[methodKey{service: unknownLabel, method: unknownLabel}]; m == nil || m.requests != 200 {
+		t.Fatal("没有注册的方法应该都记在unknown下面")
+	}
+}
+
+// 正在处理的请求数在开始处理时加一，写入响应之后减一；前面的插件拒绝了请求时不会减成负数
+func TestMetricsInflight(t *testing.T) {
+	s := server.NewServer()
+	if err := s.RegisterName("Echo", new(Echo), ""); err != nil {
+		t.Fatal(err)
+	}
+	p := NewMetricsPlugin(s)
+
+	request := protocol.GetPooledMsg()
+	defer protocol.FreeMsg(request)
+	request.ServicePath, request.ServiceMethod = "Echo", "Say"
+	inflight := func() int64 {
+		return atomic.LoadInt64(&p.method("Echo", "Say").inflight)
+	}
+
+	ctx := share.NewContext(context.Background())
+	if err := p.PreHandleRequest(ctx, request); err != nil {
+		t.Fatal(err)
+	}
+	if got := inflight(); got != 1 {
+		t.Fatalf("开始处理之后正在处理的请求数应该为1，实际为%d", got)
+	}
+
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	p.writeMetrics(w)
+	w.Flush()
+	if line := `avrilko_rpc_server_inflight_requests{service="Echo",method="Say"} 1`; !strings.Contains(buf.String(), line) {
+		t.Fatalf("输出的指标中没有%s\n%s", line, buf.String())
+	}
+
+	p.PostWriteResponse(ctx, request, nil, nil)
+	if got := inflight(); got != 0 {
+		t.Fatalf("写入响应之后正在处理的请求数应该为0，实际为%d", got)
+	}
+
+	// 请求被前面的插件拒绝，没有经过PreHandleRequest
+	p.PostWriteResponse(share.NewContext(context.Background()), request, nil, errors.New("拒绝"))
+	if got := inflight(); got != 0 {
+		t.Fatalf("没有计入的请求不应该减掉，实际为%d", got)
+	}
+}
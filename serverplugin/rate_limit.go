@@ -0,0 +1,130 @@
+package serverplugin
+
+import (
+	"avrilko-rpc/server"
+	"context"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 被限流时返回的错误，客户端可以通过元数据中的protocol.ServiceErrorCode判断
+var ErrRateLimited = &server.CodeError{Code: "rate_limited", Message: "请求太频繁，已经被限流"}
+
+// 令牌桶，每秒生成rate个令牌，最多存burst个
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// 拿一个令牌，没有令牌返回false
+func (b *tokenBucket) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// 请求限流插件，每个服务的每个方法一个令牌桶，令牌不够时拒绝请求并返回ErrRateLimited
+type RateLimitPlugin struct {
+	Rate  float64 // 每个方法默认每秒允许的请求数，0表示没有单独设置的方法不限流
+	Burst int     // 默认允许的突发请求数
+
+	mu      sync.RWMutex
+	limits  map[string]rateLimit    // 单独设置的限制 服务名.方法名（方法名为空表示整个服务） => 限制
+	buckets map[string]*tokenBucket // 服务名.方法名 => 令牌桶
+}
+
+type rateLimit struct {
+	rate  float64
+	burst int
+}
+
+func NewRateLimitPlugin(rate float64, burst int) *RateLimitPlugin {
+	return &RateLimitPlugin{
+		Rate:    rate,
+		Burst:   burst,
+		limits:  make(map[string]rateLimit),
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// 单独设置服务或者方法的限制（serviceMethod为空时对服务下的每个方法生效），rate为0表示不限流
+func (p *RateLimitPlugin) SetLimit(serviceName, serviceMethod string, rate float64, burst int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	key := serviceName + "." + serviceMethod
+	p.limits[key] = rateLimit{rate: rate, burst: burst}
+	// 已经创建的令牌桶按新的限制重新创建
+	for k := range p.buckets {
+		if k == key || serviceMethod == "" && strings.HasPrefix(k, key) {
+			delete(p.buckets, k)
+		}
+	}
+}
+
+func (p *RateLimitPlugin) PreCall(ctx context.Context, serviceName, serviceMethod string, request interface{}) (interface{}, error) {
+	bucket := p.bucket(serviceName, serviceMethod)
+	if bucket != nil && !bucket.allow() {
+		return request, ErrRateLimited
+	}
+	return request, nil
+}
+
+// 方法对应的令牌桶，不限流返回nil
+func (p *RateLimitPlugin) bucket(serviceName, serviceMethod string) *tokenBucket {
+	key := serviceName + "." + serviceMethod
+
+	p.mu.RLock()
+	bucket, ok := p.buckets[key]
+	p.mu.RUnlock()
+	if ok {
+		return bucket
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if bucket, ok = p.buckets[key]; ok {
+		return bucket
+	}
+
+	limit, ok := p.limits[key]
+	if !ok {
+		limit, ok = p.limits[serviceName+"."]
+	}
+	if !ok {
+		limit = rateLimit{rate: p.Rate, burst: p.Burst}
+	}
+	if limit.rate > 0 {
+		bucket = newTokenBucket(limit.rate, limit.burst)
+	}
+	p.buckets[key] = bucket // 不限流的也记下来（nil），避免每次都加写锁
+	return bucket
+}
@@ -0,0 +1,117 @@
+package serverplugin
+
+import (
+	"avrilko-rpc/client"
+	"avrilko-rpc/protocol"
+	"avrilko-rpc/server"
+	"avrilko-rpc/share"
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// 连续拿令牌直到被拒绝，返回拿到的个数
+func drain(allow func() bool) int {
+	n := 0
+	for n < 1000 && allow() {
+		n++
+	}
+	return n
+}
+
+// 一开始可以突发burst个请求，之后按rate补充令牌，补充的令牌不超过burst
+func TestTokenBucketBurstAndRefill(t *testing.T) {
+	b := newTokenBucket(10, 3)
+	if n := drain(b.allow); n != 3 {
+		t.Fatalf("一开始应该允许突发3个请求，实际为%d个", n)
+	}
+
+	b.mu.Lock()
+	b.last = b.last.Add(-100 * time.Millisecond) // 过了100ms补充1个令牌
+	b.mu.Unlock()
+	if n := drain(b.allow); n != 1 {
+		t.Fatalf("100ms之后应该补充1个令牌，实际为%d个", n)
+	}
+
+	b.mu.Lock()
+	b.last = b.last.Add(-10 * time.Second)
+	b.mu.Unlock()
+	if n := drain(b.allow); n != 3 {
+		t.Fatalf("补充的令牌不应该超过burst，实际为%d个", n)
+	}
+}
+
+func TestRateLimitSetLimit(t *testing.T) {
+	p := NewRateLimitPlugin(0.001, 1)
+	allow := func(service, method string) func() bool {
+		return func() bool {
+			_, err := p.PreCall(context.Background(), service, method, nil)
+			return err == nil
+		}
+	}
+
+	if n := drain(allow("Echo", "Say")); n != 1 {
+		t.Fatalf("没有单独设置的方法使用默认的限制，应该允许1个请求，实际为%d个", n)
+	}
+
+	// 单独设置之后已经创建的令牌桶按新的限制重新创建
+	p.SetLimit("Echo", "Say", 0.001, 3)
+	if n := drain(allow("Echo", "Say")); n != 3 {
+		t.Fatalf("单独设置的方法应该允许3个请求，实际为%d个", n)
+	}
+
+	// 整个服务的限制对服务下的每个方法生效，方法的限制优先
+	p.SetLimit("Arith", "", 0.001, 2)
+	p.SetLimit("Arith", "Mul", 0.001, 4)
+	if n := drain(allow("Arith", "Add")); n != 2 {
+		t.Fatalf("服务的限制应该允许2个请求，实际为%d个", n)
+	}
+	if n := drain(allow("Arith", "Mul")); n != 4 {
+		t.Fatalf("方法的限制优先，应该允许4个请求，实际为%d个", n)
+	}
+
+	// rate为0表示不限流
+	p.SetLimit("Echo", "Say", 0, 0)
+	if n := drain(allow("Echo", "Say")); n != 1000 {
+		t.Fatalf("rate为0不应该限流，实际只允许了%d个请求", n)
+	}
+}
+
+// 被限流的请求在客户端拿到ServiceError，元数据中带着限流的错误码
+func TestRateLimitErrorCodeReachesClient(t *testing.T) {
+	s := server.NewServer()
+	s.Plugins.Add(NewRateLimitPlugin(0.001, 1))
+	if err := s.RegisterName("Echo", new(Echo), ""); err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.ServeListener("tcp", ln)
+	defer s.Close()
+
+	option := client.DefaultOption
+	option.Heartbeat = false
+	c := client.NewClient(option)
+	if err := c.Connect("tcp", ln.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	args, reply := "hello", ""
+	if err := c.Call(context.Background(), "Echo", "Say", &args, &reply); err != nil {
+		t.Fatal(err)
+	}
+
+	resMeta := make(map[string]string)
+	ctx := share.WithValue(context.Background(), share.ResMetaDataKey, resMeta)
+	err = c.Call(ctx, "Echo", "Say", &args, &reply)
+	if _, ok := err.(client.ServiceError); !ok {
+		t.Fatalf("被限流应该返回ServiceError，实际为%v", err)
+	}
+	if code := resMeta[protocol.ServiceErrorCode]; code != ErrRateLimited.Code {
+		t.Fatalf("错误码应该为%s，实际为%q", ErrRateLimited.Code, code)
+	}
+}
@@ -0,0 +1,162 @@
+package serverplugin
+
+import (
+	"avrilko-rpc/log"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrRegistryStoreNil = errors.New("注册中心的存储不能为空")
+
+// 注册中心插件，把服务发布到存储中：BasePath/服务名/服务地址 => 元数据
+// 元数据和client的filterByStateAndGroup约定一致，例如 weight=10&group=test&state=active
+// 设置了TTL时会定时续期，进程异常退出之后注册信息会自动过期
+type RegistryPlugin struct {
+	ServiceAddress string        // 服务地址，和客户端服务发现的key一致，例如 tcp@127.0.0.1:8972
+	BasePath       string        // 注册路径的前缀
+	Store          RegistryStore // 存储
+	TTL            time.Duration // 注册信息的有效期，0表示永不过期
+	UpdateInterval time.Duration // 续期的间隔时间，为0时使用TTL的1/3
+
+	mu       sync.Mutex
+	services map[string]string // 已经注册的服务 服务名 => 元数据
+	done     chan struct{}
+}
+
+// 开始定时续期（没有设置TTL不需要续期）
+func (p *RegistryPlugin) Start() error {
+	if p.Store == nil {
+		return ErrRegistryStoreNil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.services == nil {
+		p.services = make(map[string]string)
+	}
+	if p.TTL <= 0 || p.done != nil {
+		return nil
+	}
+
+	interval := p.UpdateInterval
+	if interval <= 0 {
+		interval = p.TTL / 3
+	}
+	p.done = make(chan struct{})
+	go p.renew(interval, p.done)
+	return nil
+}
+
+// 停止续期并删除所有注册信息
+func (p *RegistryPlugin) Stop() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.done != nil {
+		close(p.done)
+		p.done = nil
+	}
+
+	var err error
+	for name := range p.services {
+		if e := p.Store.Delete(p.serviceKey(name)); e != nil {
+			err = e
+		}
+		delete(p.services, name)
+	}
+	return err
+}
+
+// 定时重新写入所有服务，刷新过期时间
+func (p *RegistryPlugin) renew(interval time.Duration, done chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		// 存储可能是远程的，写入的时候不能持有锁，否则会阻塞注册和反注册
+		p.mu.Lock()
+		services := make(map[string]string, len(p.services))
+		for name, metadata := range p.services {
+			services[name] = metadata
+		}
+		p.mu.Unlock()
+
+		for name, metadata := range services {
+			if err := p.Store.Put(p.serviceKey(name), metadata, p.TTL); err != nil {
+				log.WarnF("服务%s续期失败，错误原因%v", name, err)
+				continue
+			}
+			p.removeIfUnregistered(name)
+		}
+	}
+}
+
+// 续期的同时服务被反注册了，把续期写进去的数据删掉
+func (p *RegistryPlugin) removeIfUnregistered(name string) {
+	p.mu.Lock()
+	_, ok := p.services[name]
+	p.mu.Unlock()
+	if ok {
+		return
+	}
+	if err := p.Store.Delete(p.serviceKey(name)); err != nil {
+		log.WarnF("服务%s下线失败，错误原因%v", name, err)
+	}
+}
+
+// 服务注册时发布到存储中
+func (p *RegistryPlugin) Register(name string, object interface{}, metadata string) error {
+	return p.register(name, metadata)
+}
+
+// 函数注册时发布到存储中
+func (p *RegistryPlugin) RegisterFunction(name, funcName string, funcObject interface{}, metadata string) error {
+	return p.register(name, metadata)
+}
+
+// 服务反注册（或者服务关闭）时从存储中删除
+func (p *RegistryPlugin) Unregister(name string) error {
+	if p.Store == nil {
+		return ErrRegistryStoreNil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if _, ok := p.services[name]; !ok {
+		return nil
+	}
+	delete(p.services, name)
+	return p.Store.Delete(p.serviceKey(name))
+}
+
+func (p *RegistryPlugin) register(name, metadata string) error {
+	if p.Store == nil {
+		return ErrRegistryStoreNil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err := p.Store.Put(p.serviceKey(name), metadata, p.TTL); err != nil {
+		return err
+	}
+	if p.services == nil {
+		p.services = make(map[string]string)
+	}
+	p.services[name] = metadata
+	return nil
+}
+
+// 服务在存储中的key
+func (p *RegistryPlugin) serviceKey(name string) string {
+	return strings.TrimSuffix(p.BasePath, "/") + "/" + name + "/" + p.ServiceAddress
+}
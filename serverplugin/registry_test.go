@@ -0,0 +1,205 @@
+package serverplugin
+
+import (
+	"avrilko-rpc/server"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLocalStore(t *testing.T) {
+	s := NewMemoryStore()
+	s.Put("/rpc/Echo/tcp@a", "weight=1", 0)
+	s.Put("/rpc/Echo/tcp@b", "weight=2", 20*time.Millisecond)
+	s.Put("/rpc/Arith/tcp@a", "", 0)
+
+	values, _ := s.List("/rpc/Echo/")
+	if len(values) != 2 || values["/rpc/Echo/tcp@a"] != "weight=1" || values["/rpc/Echo/tcp@b"] != "weight=2" {
+		t.Fatalf("按前缀列出的数据不正确: %v", values)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if values, _ = s.List("/rpc/Echo/"); len(values) != 1 {
+		t.Fatalf("过期的数据不应该列出来: %v", values)
+	}
+
+	s.Delete("/rpc/Echo/tcp@a")
+	if values, _ = s.List("/rpc/"); len(values) != 1 || values["/rpc/Arith/tcp@a"] != "" {
+		t.Fatalf("删除之后的数据不正确: %v", values)
+	}
+}
+
+// 保存到文件的存储重新打开之后数据还在
+func TestFileStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "registry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	fileName := filepath.Join(dir, "registry.json")
+
+	s, err := NewFileStore(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Put("/rpc/Echo/tcp@a", "weight=1", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := NewFileStore(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if values, _ := reopened.List("/rpc/"); values["/rpc/Echo/tcp@a"] != "weight=1" {
+		t.Fatalf("重新打开之后的数据不正确: %v", values)
+	}
+}
+
+func newTestRegistry(store RegistryStore, ttl time.Duration) *RegistryPlugin {
+	return &RegistryPlugin{
+		ServiceAddress: "tcp@127.0.0.1:8972",
+		BasePath:       "/rpc/",
+		Store:          store,
+		TTL:            ttl,
+		UpdateInterval: ttl / 5,
+	}
+}
+
+// 注册服务时发布，反注册时删除
+func TestRegistryPluginRegister(t *testing.T) {
+	store := NewMemoryStore()
+	p := newTestRegistry(store, 0)
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	s := server.NewServer()
+	s.Plugins.Add(p)
+
+	if err := s.RegisterName("Echo", new(Echo), "weight=10"); err != nil {
+		t.Fatal(err)
+	}
+	key := "/rpc/Echo/tcp@127.0.0.1:8972"
+	if values, _ := store.List("/rpc/Echo/"); len(values) != 1 || values[key] != "weight=10" {
+		t.Fatalf("注册的服务没有发布: %v", values)
+	}
+
+	if err := s.Unregister("Echo"); err != nil {
+		t.Fatal(err)
+	}
+	if values, _ := store.List("/rpc/"); len(values) != 0 {
+		t.Fatalf("反注册之后应该删除: %v", values)
+	}
+}
+
+// 设置了TTL时定时续期，超过TTL注册信息也不会过期，停止之后删除
+func TestRegistryPluginRenew(t *testing.T) {
+	store := NewMemoryStore()
+	p := newTestRegistry(store, 50*time.Millisecond)
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Register("Echo", new(Echo), ""); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	if values, _ := store.List("/rpc/Echo/"); len(values) != 1 {
+		t.Fatal("续期之后注册信息不应该过期")
+	}
+
+	if err := p.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if values, _ := store.List("/rpc/"); len(values) != 0 {
+		t.Fatalf("停止之后应该删除所有注册信息: %v", values)
+	}
+}
+
+// 服务关闭时从注册中心下线
+func TestRegistryPluginUnpublishOnClose(t *testing.T) {
+	for name, stop := range map[string]func(s *server.Server) error{
+		"Close":    func(s *server.Server) error { return s.Close() },
+		"Shutdown": func(s *server.Server) error { return s.Shutdown(context.Background()) },
+	} {
+		stop := stop
+		t.Run(name, func(t *testing.T) {
+			store := NewMemoryStore()
+			p := newTestRegistry(store, 0)
+			if err := p.Start(); err != nil {
+				t.Fatal(err)
+			}
+			s := server.NewServer()
+			s.Plugins.Add(p)
+			if err := s.RegisterName("Echo", new(Echo), ""); err != nil {
+				t.Fatal(err)
+			}
+
+			stop(s)
+			if values, _ := store.List("/rpc/"); len(values) != 0 {
+				t.Fatalf("服务关闭之后应该下线: %v", values)
+			}
+		})
+	}
+}
+
+// 打开block之后Put会阻塞，直到release被关闭
+type blockingStore struct {
+	*LocalStore
+	block   int32
+	putting chan struct{}
+	release chan struct{}
+}
+
+func (s *blockingStore) Put(key, value string, ttl time.Duration) error {
+	if atomic.LoadInt32(&s.block) == 1 {
+		s.putting <- struct{}{}
+		<-s.release
+	}
+	return s.LocalStore.Put(key, value, ttl)
+}
+
+// 续期写存储的时候不持有锁，卡住的存储不会阻塞反注册，续期写进去的数据在反注册之后会被删掉
+func TestRegistryPluginRenewDoesNotBlockUnregister(t *testing.T) {
+	store := &blockingStore{LocalStore: NewMemoryStore(), putting: make(chan struct{}), release: make(chan struct{})}
+	p := newTestRegistry(store, 50*time.Millisecond)
+	if err := p.Register("Echo", new(Echo), ""); err != nil {
+		t.Fatal(err)
+	}
+	atomic.StoreInt32(&store.block, 1)
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Stop()
+
+	<-store.putting // 续期卡在了Put中
+	unregistered := make(chan error, 1)
+	go func() { unregistered <- p.Unregister("Echo") }()
+	select {
+	case err := <-unregistered:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		atomic.StoreInt32(&store.block, 0) // 放开续期，否则Stop也会一直阻塞
+		close(store.release)
+		t.Fatal("续期写存储的时候阻塞了反注册")
+	}
+
+	atomic.StoreInt32(&store.block, 0)
+	close(store.release)
+	deadline := time.Now().Add(time.Second)
+	for {
+		values, _ := store.List("/rpc/")
+		if len(values) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("反注册之后续期写进去的数据应该被删掉: %v", values)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,127 @@
+package serverplugin
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 注册中心的存储，可以用etcd、consul或者自己的kv系统实现
+type RegistryStore interface {
+	Put(key, value string, ttl time.Duration) error // 写入，ttl之后没有续期则过期（0表示永不过期）
+	Delete(key string) error                        // 删除
+	List(prefix string) (map[string]string, error)  // 列出所有前缀为prefix并且没有过期的数据
+}
+
+type localEntry struct {
+	Value    string `json:"value"`
+	ExpireAt int64  `json:"expire_at,omitempty"` // 过期时间（UnixNano），0表示永不过期
+}
+
+func (e *localEntry) expired(now time.Time) bool {
+	return e.ExpireAt != 0 && now.UnixNano() > e.ExpireAt
+}
+
+// 本地存储，数据保存在内存中，设置了文件名时每次修改都会写到文件里（方便测试和单机部署）
+type LocalStore struct {
+	mu       sync.RWMutex
+	entries  map[string]*localEntry
+	fileName string
+}
+
+// 新建一个纯内存的存储
+func NewMemoryStore() *LocalStore {
+	return &LocalStore{entries: make(map[string]*localEntry)}
+}
+
+// 新建一个保存到文件的存储，文件存在时先加载文件中的数据
+func NewFileStore(fileName string) (*LocalStore, error) {
+	s := NewMemoryStore()
+	s.fileName = fileName
+
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s, nil
+		}
+		return nil, err
+	}
+	if len(data) > 0 {
+		if err = json.Unmarshal(data, &s.entries); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (s *LocalStore) Put(key, value string, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry := &localEntry{Value: value}
+	if ttl > 0 {
+		entry.ExpireAt = time.Now().Add(ttl).UnixNano()
+	}
+	s.entries[key] = entry
+	return s.flushLocked()
+}
+
+func (s *LocalStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.entries, key)
+	return s.flushLocked()
+}
+
+func (s *LocalStore) List(prefix string) (map[string]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	now := time.Now()
+	values := make(map[string]string)
+	for k, entry := range s.entries {
+		if strings.HasPrefix(k, prefix) && !entry.expired(now) {
+			values[k] = entry.Value
+		}
+	}
+	return values, nil
+}
+
+// 写到文件中（先写临时文件再重命名，防止读到写了一半的文件），过期的数据顺便清理掉
+func (s *LocalStore) flushLocked() error {
+	if s.fileName == "" {
+		return nil
+	}
+
+	now := time.Now()
+	for k, entry := range s.entries {
+		if entry.expired(now) {
+			delete(s.entries, k)
+		}
+	}
+
+	data, err := json.MarshalIndent(s.entries, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(s.fileName), filepath.Base(s.fileName)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), s.fileName)
+}
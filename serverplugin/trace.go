@@ -0,0 +1,55 @@
+package serverplugin
+
+import (
+	"avrilko-rpc/protocol"
+	"avrilko-rpc/server"
+	"avrilko-rpc/share"
+	"context"
+	"errors"
+)
+
+var serverSpanKey = share.ContextKey("__server_span")
+
+// 链路追踪插件，处理请求前从元数据中取出W3C的traceparent/tracestate开始服务端span，写完响应后结束span交给导出者
+// span的SpanContext会放到上下文的share.SpanContextKey中，处理函数用这个上下文调用下游服务时（客户端开启了链路追踪插件）会属于同一个trace
+// 只导出被采样的span，采样标记跟着父span传递
+type TracePlugin struct {
+	Exporter share.SpanExporter
+}
+
+func NewTracePlugin(exporter share.SpanExporter) *TracePlugin {
+	return &TracePlugin{Exporter: exporter}
+}
+
+func (p *TracePlugin) PreHandleRequest(ctx context.Context, request *protocol.Message) error {
+	sctx, ok := ctx.(*share.Context)
+	if !ok {
+		return nil
+	}
+
+	parent, _ := share.ExtractSpanContext(request.Metadata)
+	span := share.StartSpan(request.ServicePath+"."+request.ServiceMethod, share.SpanKindServer, parent)
+	if conn := server.RemoteConn(ctx); conn != nil {
+		span.Attributes["remote_addr"] = conn.RemoteAddr().String()
+	}
+
+	share.WithLocalValue(sctx, serverSpanKey, span)
+	share.WithLocalValue(sctx, share.SpanContextKey, span.SpanContext)
+	return nil
+}
+
+func (p *TracePlugin) PostWriteResponse(ctx context.Context, request, response *protocol.Message, err error) error {
+	span, ok := ctx.Value(serverSpanKey).(*share.Span)
+	if !ok {
+		return nil
+	}
+
+	if err == nil && response != nil && response.MessageStatusType() == protocol.Error {
+		err = errors.New(response.Metadata[protocol.ServiceError])
+	}
+	span.Finish(err)
+	if p.Exporter != nil && span.SpanContext.IsSampled() {
+		p.Exporter.ExportSpan(span)
+	}
+	return nil
+}
@@ -0,0 +1,253 @@
+package serverplugin
+
+import (
+	"avrilko-rpc/client"
+	"avrilko-rpc/protocol"
+	"avrilko-rpc/server"
+	"avrilko-rpc/share"
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 客户端和服务端都开启链路追踪插件，服务端span是客户端span的子span，客户端span是上下文中父span的子span
+func TestTraceClientServerLinkage(t *testing.T) {
+	exporter := share.NewMemoryExporter()
+
+	s := server.NewServer()
+	s.Plugins.Add(NewTracePlugin(exporter))
+	if err := s.RegisterName("Echo", new(Echo), ""); err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.ServeListener("tcp", ln)
+	defer s.Close()
+
+	xc := client.NewXClient("Echo", client.Failfast, client.RandomSelect, client.NewPeer2PeerDiscovery("tcp@"+ln.Addr().String(), ""), client.DefaultOption)
+	defer xc.Close()
+	plugins := client.NewPluginContainer()
+	plugins.Add(client.NewTracePlugin(exporter))
+	xc.SetPlugins(plugins)
+
+	parent := share.StartSpan("caller", share.SpanKindServer, share.SpanContext{})
+	ctx := share.WithValue(context.Background(), share.SpanContextKey, parent.SpanContext)
+	args, reply := "hello", ""
+	if err = xc.Call(ctx, "Say", &args, &reply); err != nil {
+		t.Fatal(err)
+	}
+
+	// 服务端在写完响应之后才结束span，等一下
+	var clientSpan, serverSpan *share.Span
+	deadline := time.Now().Add(2 * time.Second)
+	for clientSpan == nil || serverSpan == nil {
+		if time.Now().After(deadline) {
+			t.Fatalf("没有导出客户端和服务端的span: %v", exporter.Spans())
+		}
+		time.Sleep(10 * time.Millisecond)
+		for _, span := range exporter.Spans() {
+			switch span.Kind {
+			case share.SpanKindClient:
+				clientSpan = span
+			case share.SpanKindServer:
+				serverSpan = span
+			}
+		}
+	}
+
+	if clientSpan.Name != "Echo.Say" || serverSpan.Name != "Echo.Say" {
+		t.Fatalf("span的名字不正确: %s %s", clientSpan.Name, serverSpan.Name)
+	}
+	traceID := parent.SpanContext.TraceID
+	if clientSpan.SpanContext.TraceID != traceID || serverSpan.SpanContext.TraceID != traceID {
+		t.Fatal("客户端和服务端的span应该和父span属于同一个trace")
+	}
+	if clientSpan.ParentSpanID != parent.SpanContext.SpanID {
+		t.Fatal("客户端span的父span应该是上下文中的span")
+	}
+	if serverSpan.ParentSpanID != clientSpan.SpanContext.SpanID {
+		t.Fatal("服务端span的父span应该是客户端span")
+	}
+	if serverSpan.Attributes["remote_addr"] == "" || serverSpan.Err != "" || clientSpan.Err != "" {
+		t.Fatalf("span的属性不正确: %+v %+v", clientSpan, serverSpan)
+	}
+}
+
+// 记录服务端收到的请求元数据
+type metaRecorder struct {
+	mu    sync.Mutex
+	metas []map[string]string
+}
+
+func (r *metaRecorder) PreHandleRequest(ctx context.Context, request *protocol.Message) error {
+	meta := make(map[string]string, len(request.Metadata))
+	for k, v := range request.Metadata {
+		meta[k] = v
+	}
+	r.mu.Lock()
+	r.metas = append(r.metas, meta)
+	r.mu.Unlock()
+	return nil
+}
+
+func (r *metaRecorder) all() []map[string]string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]map[string]string(nil), r.metas...)
+}
+
+// 启动开启了链路追踪插件的Echo服务，返回监听地址
+func startTraceServer(t *testing.T, exporter share.SpanExporter, plugins ...server.Plugin) string {
+	t.Helper()
+	s := server.NewServer()
+	s.Plugins.Add(NewTracePlugin(exporter))
+	for _, plugin := range plugins {
+		s.Plugins.Add(plugin)
+	}
+	if err := s.RegisterName("Echo", new(Echo), ""); err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.ServeListener("tcp", ln)
+	t.Cleanup(func() { s.Close() })
+	return ln.Addr().String()
+}
+
+// 等到导出了n个kind类型的span
+func waitSpans(t *testing.T, exporter *share.MemoryExporter, kind string, n int) []*share.Span {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		var spans []*share.Span
+		for _, span := range exporter.Spans() {
+			if span.Kind == kind {
+				spans = append(spans, span)
+			}
+		}
+		if len(spans) >= n {
+			return spans
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("应该导出%d个%s span，实际为%d个", n, kind, len(spans))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// XClient的Go、SendRaw和直接使用Client发出的请求都带上traceparent，span收到响应后结束
+func TestTraceEveryRequest(t *testing.T) {
+	exporter := share.NewMemoryExporter()
+	recorder := &metaRecorder{}
+	addr := startTraceServer(t, exporter, recorder)
+	plugins := client.NewPluginContainer()
+	plugins.Add(client.NewTracePlugin(exporter))
+
+	xc := client.NewXClient("Echo", client.Failfast, client.RandomSelect, client.NewPeer2PeerDiscovery("tcp@"+addr, ""), client.DefaultOption)
+	defer xc.Close()
+	xc.SetPlugins(plugins)
+
+	args, reply := "hello", ""
+	call, err := xc.Go(context.Background(), "Say", &args, &reply, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if call = <-call.Done; call.Error != nil {
+		t.Fatal(call.Error)
+	}
+
+	payload, err := share.Codecs[protocol.MsgPack].Encode(&args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := protocol.GetPooledMsg()
+	defer protocol.FreeMsg(r)
+	r.SetMessageType(protocol.Request)
+	r.SetSerializeType(protocol.MsgPack)
+	r.ServicePath = "Echo"
+	r.ServiceMethod = "Say"
+	r.Payload = payload
+	if _, _, err = xc.SendRaw(context.Background(), r); err != nil {
+		t.Fatal(err)
+	}
+
+	option := client.DefaultOption
+	option.Heartbeat = false
+	c := client.NewClient(option)
+	c.Plugins = plugins
+	if err = c.Connect("tcp", addr); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err = c.Call(context.Background(), "Echo", "Say", &args, &reply); err != nil {
+		t.Fatal(err)
+	}
+
+	metas := recorder.all()
+	if len(metas) != 3 {
+		t.Fatalf("服务端应该收到3个请求，实际为%d个", len(metas))
+	}
+	clientSpans := waitSpans(t, exporter, share.SpanKindClient, 3)
+	spanIDs := make(map[[8]byte]bool)
+	for _, span := range clientSpans {
+		spanIDs[span.SpanContext.SpanID] = true
+		if span.End.IsZero() || span.Err != "" {
+			t.Fatalf("客户端span没有正常结束: %+v", span)
+		}
+	}
+	for i, meta := range metas {
+		sc, ok := share.ExtractSpanContext(meta)
+		if !ok {
+			t.Fatalf("第%d个请求没有带上traceparent: %v", i+1, meta)
+		}
+		if !spanIDs[sc.SpanID] {
+			t.Fatalf("第%d个请求的traceparent不是导出的客户端span", i+1)
+		}
+		if _, ok := meta["__trace_call"]; ok {
+			t.Fatalf("调用编号不应该发给服务端: %v", meta)
+		}
+	}
+}
+
+// 没有被采样的trace只传递不导出
+func TestTraceNotSampled(t *testing.T) {
+	exporter := share.NewMemoryExporter()
+	recorder := &metaRecorder{}
+	addr := startTraceServer(t, exporter, recorder)
+
+	xc := client.NewXClient("Echo", client.Failfast, client.RandomSelect, client.NewPeer2PeerDiscovery("tcp@"+addr, ""), client.DefaultOption)
+	defer xc.Close()
+	plugins := client.NewPluginContainer()
+	plugins.Add(client.NewTracePlugin(exporter))
+	xc.SetPlugins(plugins)
+
+	parent := share.StartSpan("caller", share.SpanKindServer, share.SpanContext{})
+	parent.SpanContext.Flags = 0
+	ctx := share.WithValue(context.Background(), share.SpanContextKey, parent.SpanContext)
+	args, reply := "hello", ""
+	if err := xc.Call(ctx, "Say", &args, &reply); err != nil {
+		t.Fatal(err)
+	}
+	// 一个被采样的调用，它的span导出之后没有被采样的调用也一定处理完了
+	if err := xc.Call(context.Background(), "Say", &args, &reply); err != nil {
+		t.Fatal(err)
+	}
+	waitSpans(t, exporter, share.SpanKindServer, 1)
+
+	for _, span := range exporter.Spans() {
+		if span.SpanContext.TraceID == parent.SpanContext.TraceID {
+			t.Fatalf("没有被采样的span不应该导出: %+v", span)
+		}
+	}
+	metas := recorder.all()
+	sc, ok := share.ExtractSpanContext(metas[0])
+	if !ok || sc.TraceID != parent.SpanContext.TraceID || sc.IsSampled() {
+		t.Fatalf("没有被采样的trace应该传递给服务端: %v", metas[0])
+	}
+}
@@ -7,6 +7,10 @@ import (
 
 const (
 	AuthKey = "__AUTH"
+
+	TimeoutKey           = "__timeout"     // 元数据中请求剩余的超时时间（纳秒），服务端据此设置处理请求的ctx的截止时间
+	SendFileServiceName  = "_filetransfer" // 文件传输服务的服务名
+	FileTransferTokenLen = 16              // 文件传输凭证的长度
 )
 
 type ContextKey string
@@ -23,3 +27,23 @@ var (
 		protocol.MsgPack:       &codec.MsgpackCodec{},
 	}
 )
+
+// 上传文件的请求参数
+type FileTransferArgs struct {
+	FileName string            `json:"file_name,omitempty"`
+	FileSize int64             `json:"file_size,omitempty"`
+	Meta     map[string]string `json:"meta,omitempty"`
+}
+
+// 下载文件的请求参数
+type DownloadFileArgs struct {
+	FileName string            `json:"file_name,omitempty"`
+	Meta     map[string]string `json:"meta,omitempty"`
+}
+
+// 文件传输协商的结果，客户端拿着Token连接Addr传输文件数据
+type FileTransferReply struct {
+	Token    []byte `json:"token,omitempty"`
+	Addr     string `json:"addr,omitempty"`
+	FileSize int64  `json:"file_size,omitempty"` // 下载时文件的大小
+}
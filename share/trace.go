@@ -0,0 +1,177 @@
+package share
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+// W3C trace context在元数据中使用的key
+const (
+	TraceParentKey = "traceparent"
+	TraceStateKey  = "tracestate"
+)
+
+// 上下文中当前span的SpanContext，服务端处理请求时放进去，调用下游服务时客户端从这里拿到父span
+var SpanContextKey = ContextKey("__span_context")
+
+var ErrInvalidTraceParent = errors.New("traceparent格式不正确")
+
+// span的类型
+const (
+	SpanKindClient = "client"
+	SpanKindServer = "server"
+)
+
+// 跨服务传递的span信息
+type SpanContext struct {
+	TraceID    [16]byte
+	SpanID     [8]byte
+	Flags      byte   // 0x01表示采样
+	TraceState string // 原样传递的厂商信息
+}
+
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != [16]byte{} && sc.SpanID != [8]byte{}
+}
+
+// 是否被采样，没有被采样的span只传递不导出
+func (sc SpanContext) IsSampled() bool {
+	return sc.Flags&0x01 != 0
+}
+
+// 转换为traceparent头部的格式：版本-trace_id-span_id-flags
+func (sc SpanContext) TraceParent() string {
+	return "00-" + hex.EncodeToString(sc.TraceID[:]) + "-" + hex.EncodeToString(sc.SpanID[:]) + "-" + hex.EncodeToString([]byte{sc.Flags})
+}
+
+// 解析traceparent头部
+func ParseTraceParent(traceParent string) (SpanContext, error) {
+	var sc SpanContext
+	parts := strings.Split(strings.TrimSpace(traceParent), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return sc, ErrInvalidTraceParent
+	}
+	if len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return sc, ErrInvalidTraceParent
+	}
+
+	var flags [1]byte
+	if _, err := hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil {
+		return sc, ErrInvalidTraceParent
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil {
+		return sc, ErrInvalidTraceParent
+	}
+	if _, err := hex.Decode(flags[:], []byte(parts[3])); err != nil {
+		return sc, ErrInvalidTraceParent
+	}
+	sc.Flags = flags[0]
+	if !sc.IsValid() {
+		return sc, ErrInvalidTraceParent
+	}
+	return sc, nil
+}
+
+// 把SpanContext写入元数据
+func InjectSpanContext(meta map[string]string, sc SpanContext) {
+	meta[TraceParentKey] = sc.TraceParent()
+	if sc.TraceState != "" {
+		meta[TraceStateKey] = sc.TraceState
+	}
+}
+
+// 从元数据中取出SpanContext，没有或者格式不对返回false
+func ExtractSpanContext(meta map[string]string) (SpanContext, bool) {
+	sc, err := ParseTraceParent(meta[TraceParentKey])
+	if err != nil {
+		return sc, false
+	}
+	sc.TraceState = meta[TraceStateKey]
+	return sc, true
+}
+
+// 一次调用的记录
+type Span struct {
+	Name         string // 服务名.方法名
+	Kind         string // SpanKindClient或者SpanKindServer
+	SpanContext  SpanContext
+	ParentSpanID [8]byte // 没有父span时全为0
+	Start        time.Time
+	End          time.Time
+	Attributes   map[string]string
+	Err          string // 调用出错时的错误信息
+}
+
+// 开始一个span，父span有效时属于同一个trace，否则开始新的trace
+func StartSpan(name, kind string, parent SpanContext) *Span {
+	span := &Span{
+		Name:       name,
+		Kind:       kind,
+		Start:      time.Now(),
+		Attributes: make(map[string]string),
+	}
+	if parent.IsValid() {
+		span.SpanContext.TraceID = parent.TraceID
+		span.SpanContext.Flags = parent.Flags
+		span.SpanContext.TraceState = parent.TraceState
+		span.ParentSpanID = parent.SpanID
+	} else {
+		rand.Read(span.SpanContext.TraceID[:])
+		span.SpanContext.Flags = 0x01
+	}
+	rand.Read(span.SpanContext.SpanID[:])
+	return span
+}
+
+// 结束span
+func (s *Span) Finish(err error) {
+	s.End = time.Now()
+	if err != nil {
+		s.Err = err.Error()
+	}
+}
+
+func (s *Span) Duration() time.Duration {
+	return s.End.Sub(s.Start)
+}
+
+// span的导出者，结束的span会交给它（发送到链路追踪系统、写日志等），需要是并发安全的
+type SpanExporter interface {
+	ExportSpan(span *Span)
+}
+
+// 保存在内存中的导出者，方便测试和调试
+type MemoryExporter struct {
+	mu    sync.Mutex
+	spans []*Span
+}
+
+func NewMemoryExporter() *MemoryExporter {
+	return &MemoryExporter{}
+}
+
+func (e *MemoryExporter) ExportSpan(span *Span) {
+	e.mu.Lock()
+	e.spans = append(e.spans, span)
+	e.mu.Unlock()
+}
+
+// 导出的所有span（按结束的顺序）
+func (e *MemoryExporter) Spans() []*Span {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	spans := make([]*Span, len(e.spans))
+	copy(spans, e.spans)
+	return spans
+}
+
+// 清空所有span
+func (e *MemoryExporter) Reset() {
+	e.mu.Lock()
+	e.spans = nil
+	e.mu.Unlock()
+}
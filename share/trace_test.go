@@ -0,0 +1,79 @@
+package share
+
+import (
+	"testing"
+)
+
+func TestTraceParentRoundTrip(t *testing.T) {
+	const traceParent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	sc, err := ParseTraceParent(traceParent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sc.Flags != 0x01 || !sc.IsValid() {
+		t.Fatalf("解析结果不正确: %+v", sc)
+	}
+	if got := sc.TraceParent(); got != traceParent {
+		t.Fatalf("重新编码之后不一致: %s", got)
+	}
+
+	// 写入元数据再取出来
+	sc.TraceState = "congo=t61rcWkgMzE"
+	meta := make(map[string]string)
+	InjectSpanContext(meta, sc)
+	if meta[TraceParentKey] != traceParent || meta[TraceStateKey] != sc.TraceState {
+		t.Fatalf("写入元数据不正确: %v", meta)
+	}
+	extracted, ok := ExtractSpanContext(meta)
+	if !ok || extracted != sc {
+		t.Fatalf("从元数据中取出的结果不一致: %+v %v", extracted, ok)
+	}
+
+	// 更高的版本可以带额外的字段
+	if _, err = ParseTraceParent("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra"); err != nil {
+		t.Fatalf("更高版本的traceparent应该可以解析: %v", err)
+	}
+}
+
+func TestParseMalformedTraceParent(t *testing.T) {
+	malformed := []string{
+		"",
+		"00",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",          // 少了flags
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", // 版本00不能有额外的字段
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",       // 版本ff不合法
+		"0-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",        // 版本长度不对
+		"00-4bf92f3577b34da6a3ce929d0e0e473-00f067aa0ba902b7-01",        // trace_id长度不对
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b-01",        // span_id长度不对
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-1",        // flags长度不对
+		"00-4bf92f3577b34da6a3ce929d0e0e473g-00f067aa0ba902b7-01",       // trace_id不是十六进制
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902bz-01",       // span_id不是十六进制
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-0x",       // flags不是十六进制
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",       // trace_id全为0
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",       // span_id全为0
+		"00_4bf92f3577b34da6a3ce929d0e0e4736_00f067aa0ba902b7_01",       // 分隔符不对
+	}
+	for _, traceParent := range malformed {
+		if _, err := ParseTraceParent(traceParent); err != ErrInvalidTraceParent {
+			t.Errorf("%q应该解析失败，实际错误为%v", traceParent, err)
+		}
+		if _, ok := ExtractSpanContext(map[string]string{TraceParentKey: traceParent}); ok {
+			t.Errorf("%q不应该从元数据中取出SpanContext", traceParent)
+		}
+	}
+}
+
+func TestStartSpanLinksParent(t *testing.T) {
+	root := StartSpan("Arith.Mul", SpanKindClient, SpanContext{})
+	if !root.SpanContext.IsValid() || root.ParentSpanID != [8]byte{} {
+		t.Fatalf("没有父span时应该开始新的trace: %+v", root)
+	}
+
+	child := StartSpan("Arith.Mul", SpanKindServer, root.SpanContext)
+	if child.SpanContext.TraceID != root.SpanContext.TraceID || child.ParentSpanID != root.SpanContext.SpanID {
+		t.Fatalf("子span应该属于同一个trace并指向父span: %+v", child)
+	}
+	if child.SpanContext.SpanID == root.SpanContext.SpanID {
+		t.Fatal("子span应该有新的span_id")
+	}
+}
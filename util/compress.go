@@ -57,7 +57,10 @@ func Zip(data []byte) ([]byte, error) {
 		return nil, err
 	}
 
-	return buff.Bytes(), nil
+	// buff会被放回缓存池，这里必须拷贝一份出去，不然会被别的协程覆盖
+	zipData := make([]byte, buff.Len())
+	copy(zipData, buff.Bytes())
+	return zipData, nil
 }
 
 // 使用gzip解压缩